@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package rmux
+
+import (
+	"encoding/json"
+	"net/http"
+	"rmux/connection"
+	"rmux/log"
+	"sync/atomic"
+	"time"
+)
+
+// The state of a connection pool, as shown by the admin interface
+type adminPool struct {
+	Endpoint         string          `json:"endpoint"`
+	Connected        bool            `json:"connected"`
+	CheckedOut       int             `json:"checkedOut"`
+	Idle             int             `json:"idle"`
+	Waiting          int             `json:"waiting"`
+	LongCheckouts    uint64          `json:"longCheckouts"`
+	WaitTimeouts     uint64          `json:"waitTimeouts"`
+	Sheds            uint64          `json:"sheds"`
+	SharedRequests   uint64          `json:"sharedRequests"`
+	ConcurrencyLimit int             `json:"concurrencyLimit,omitempty"`
+	Checkouts        []adminCheckout `json:"checkouts"`
+}
+
+// A checked out connection, as shown by the admin interface
+type adminCheckout struct {
+	Owner    string    `json:"owner"`
+	Database int       `json:"database"`
+	Since    time.Time `json:"since"`
+	HeldFor  string    `json:"heldFor"`
+}
+
+// Serves the admin interface over http on the given tcp address, until the listener fails
+// GET /pools lists every connection pool with the clients that currently hold its connections, the longest held first
+func (this *RedisMultiplexer) ServeAdmin(address string) error {
+	log.Info("Serving the admin interface on %s", address)
+	err := http.ListenAndServe(address, this.adminHandler())
+	log.Error("The admin interface on %s stopped: %s", address, err)
+	return err
+}
+
+func (this *RedisMultiplexer) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pools", this.servePools)
+	return mux
+}
+
+func (this *RedisMultiplexer) servePools(response http.ResponseWriter, request *http.Request) {
+	pools := make([]adminPool, 0, len(this.ConnectionCluster))
+	now := time.Now()
+	for _, connectionPool := range this.ConnectionCluster {
+		pools = append(pools, newAdminPool(connectionPool, now))
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(response)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(pools); err != nil {
+		log.Warn("Could not write the admin pools response: %s", err)
+	}
+}
+
+func newAdminPool(connectionPool *connection.ConnectionPool, now time.Time) adminPool {
+	checkouts := connectionPool.Checkouts()
+	pool := adminPool{
+		Endpoint:         connectionPool.Protocol + ":" + connectionPool.Endpoint,
+		Connected:        connectionPool.IsConnected(),
+		CheckedOut:       len(checkouts),
+		Idle:             connectionPool.IdleCount(),
+		Waiting:          connectionPool.Waiting(),
+		LongCheckouts:    atomic.LoadUint64(&connectionPool.LongCheckouts),
+		WaitTimeouts:     atomic.LoadUint64(&connectionPool.WaitTimeouts),
+		Sheds:            atomic.LoadUint64(&connectionPool.Sheds),
+		SharedRequests:   atomic.LoadUint64(&connectionPool.SharedRequests),
+		ConcurrencyLimit: connectionPool.ConcurrencyLimiter.Limit(),
+		Checkouts:        make([]adminCheckout, 0, len(checkouts)),
+	}
+	for _, checkout := range checkouts {
+		pool.Checkouts = append(pool.Checkouts, adminCheckout{
+			Owner:    checkout.Owner,
+			Database: checkout.DatabaseId,
+			Since:    checkout.Since,
+			HeldFor:  now.Sub(checkout.Since).String(),
+		})
+	}
+	return pool
+}
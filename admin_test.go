@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package rmux
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"rmux/connection"
+	"testing"
+	"time"
+)
+
+func TestServePools(t *testing.T) {
+	os.Remove("/tmp/rmuxAdminTest.sock")
+	os.Remove("/tmp/rmuxAdminTestRedis.sock")
+	server, err := NewRedisMultiplexer("unix", "/tmp/rmuxAdminTest.sock", 2)
+	if err != nil {
+		t.Fatalf("Error creating multiplexer: %s", err)
+	}
+	defer server.Listener.Close()
+
+	listenSock := StartPongResponseServer(t, "/tmp/rmuxAdminTestRedis.sock")
+	defer listenSock.Close()
+	server.AddConnection("unix", "/tmp/rmuxAdminTestRedis.sock")
+
+	connectionPool := server.PrimaryConnectionPool
+	conn, err := connectionPool.GetConnectionFor(connection.ConnectionRequest{DatabaseId: connection.DEFAULT_DATABASE, Owner: "client 1"})
+	if err != nil {
+		t.Fatalf("Failed to get a connection: %s", err)
+	}
+	defer connectionPool.RecycleRemoteConnection(conn)
+
+	recorder := httptest.NewRecorder()
+	server.adminHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/pools", nil))
+
+	var pools []adminPool
+	if err := json.Unmarshal(recorder.Body.Bytes(), &pools); err != nil {
+		t.Fatalf("Failed to decode the pools response %q: %s", recorder.Body.String(), err)
+	}
+	if len(pools) != 1 {
+		t.Fatalf("Expected 1 pool, got %d", len(pools))
+	}
+	if pools[0].Endpoint != "unix:/tmp/rmuxAdminTestRedis.sock" {
+		t.Errorf("Unexpected endpoint %s", pools[0].Endpoint)
+	}
+	if pools[0].CheckedOut != 1 || len(pools[0].Checkouts) != 1 {
+		t.Fatalf("Expected 1 checked out connection, got %d", pools[0].CheckedOut)
+	}
+	if checkout := pools[0].Checkouts[0]; checkout.Owner != "client 1" || time.Since(checkout.Since) > time.Minute {
+		t.Errorf("Unexpected checkout %v", checkout)
+	}
+}
@@ -28,43 +28,75 @@ package rmux
 import (
 	"bytes"
 	"errors"
-	"io"
+	"fmt"
 	"net"
 	"rmux/connection"
 	"rmux/graphite"
 	"rmux/log"
 	"rmux/protocol"
 	"rmux/writer"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type readItem struct {
-	command protocol.Command
-	err     error
-}
-
 // Represents a redis client that is connected to our rmux server
 type Client struct {
+	//Identifies the client among the others that were accepted by this process
+	Id uint64
 	//The underlying ReadWriter for this connection
 	Writer *writer.FlexibleWriter
 	//Whether or not this client needs to consider multiplexing
 	Multiplexing bool
 	Connection   net.Conn
 	//The Database that our client thinks we're connected to
+	//Until the client selects one, this is connection.DEFAULT_DATABASE, the default database of the target endpoint
 	DatabaseId int
 	//Whether or not this client connection is active or not
 	//Upon QUIT command, this gets toggled off
-	Active                 bool
-	ReadChannel            chan readItem
-	HashRing               *connection.HashRing
-	Scanner                *protocol.RespScanner
-	TransactionTimeout     time.Duration
+	Active             bool
+	HashRing           *connection.HashRing
+	Scanner            *protocol.RespScanner
+	TransactionTimeout time.Duration
+	//The time the client may take to send the rest of a command, to send its next command, and to read its responses
+	//before it is disconnected, zero for no limit
+	ReadTimeout  time.Duration
+	IdleTimeout  time.Duration
+	WriteTimeout time.Duration
+	//The amount of pipelined commands the client sends to the redis servers at once
+	MaxInFlight int
+	//The amount of commands the client may pipeline before waiting for responses, zero for any amount
+	MaxPipelineDepth       int
 	queued                 []protocol.Command
 	reservedRedisConn      chan *connection.Connection
 	transactionMode        transactionMode
 	transactionDoneChannel chan interface{}
+	owner                  string
+	err                    error
+
+	//Identifies where the client connects from, see connectionSource.  Empty if that is unknown
+	Source string
+	//The priority class of the client, when it waits for a connection
+	Priority int
+	//The name the client gave itself with CLIENT SETNAME, and the user it authenticated as, if any
+	name string
+	user string
+	//The rate limits of the client's multiplexer, if any, and the limit of the client's identity among them
+	RateLimiter       *RateLimiter
+	rateLimit         *RateLimit
+	rateLimitIdentity string
+
+	//The limits on the output the client holds, and the budget of all clients of its multiplexer, if any
+	OutputLimits          OutputLimits
+	OutputBudget          *OutputBudget
+	output                int64
+	overSoftLimitSince    int64
+	disconnectedForOutput int32
 }
 
+// The id of the most recently accepted client
+var lastClientId uint64
+
 // Represents the connection transaction mode of this client / connection
 type transactionMode byte
 
@@ -73,38 +105,71 @@ var (
 	ERR_CONNECTION_DOWN     = errors.New(string(CONNECTION_DOWN_RESPONSE))
 	ERR_TIMEOUT             = errors.New("Proxy timeout")
 	ERR_TRANSACTION_TIMEOUT = errors.New("Transaction timeout")
+	ERR_TRANSACTION_ABORTED = errors.New("Client disconnected during a transaction")
 )
 
 const (
 	//Default transaction timeout, for clients. Can be adjusted on individual clients after initialization
 	EXTERN_TRANSACTION_TIMEOUT = time.Millisecond * 500
+	//Default amount of pipelined commands a client sends at once. Can be adjusted on individual clients after initialization
+	EXTERN_MAX_IN_FLIGHT = 64
+	//Default amount of bytes buffered for a client before they are written to it, without waiting for the rest of a response
+	EXTERN_WRITE_HIGH_WATER_MARK = 64 * 1024
+	//Default limits on the requests of clients, like the defaults of redis. Can be adjusted on individual clients' scanners
+	EXTERN_MAX_BULK_LENGTH   = 512 * 1024 * 1024
+	EXTERN_MAX_ARGUMENTS     = 1024 * 1024
+	EXTERN_MAX_INLINE_LENGTH = 64 * 1024
 
 	transactionModeNone transactionMode = iota
 	transactionModePre
 	transactionModeMulti
 )
 
-// Initializes a new client, for the given established net connection, with the specified read/write timeouts
-func NewClient(connection net.Conn, isMuliplexing bool, hashRing *connection.HashRing,
+// Initializes a new client, for the given established net connection. Its read, idle and write timeouts are unlimited
+// until they are set
+func NewClient(localConnection net.Conn, isMuliplexing bool, hashRing *connection.HashRing,
 	transactionTimeout time.Duration) (newClient *Client) {
 
 	newClient = &Client{}
-	newClient.Connection = connection
-	newClient.Writer = writer.NewFlexibleWriter(connection)
+	newClient.Id = atomic.AddUint64(&lastClientId, 1)
+	newClient.Connection = localConnection
+	newClient.owner = fmt.Sprintf("client %d (%s)", newClient.Id, localConnection.RemoteAddr())
+	newClient.Writer = writer.NewFlexibleWriter(timedClientConnection{newClient})
+	newClient.Writer.HighWaterMark = EXTERN_WRITE_HIGH_WATER_MARK
 	newClient.Active = true
 	newClient.Multiplexing = isMuliplexing
-	newClient.ReadChannel = make(chan readItem, 10000)
 	newClient.queued = make([]protocol.Command, 0, 4)
 	newClient.HashRing = hashRing
-	newClient.DatabaseId = 0
-	newClient.Scanner = protocol.NewRespScanner(connection)
+	newClient.DatabaseId = connection.DEFAULT_DATABASE
+	newClient.Scanner = protocol.NewRespScanner(timedClientConnection{newClient})
+	newClient.Scanner.SetLimits(protocol.ScanLimits{
+		MaxBulkLength:  EXTERN_MAX_BULK_LENGTH,
+		MaxArrayLength: EXTERN_MAX_ARGUMENTS,
+		MaxLineLength:  EXTERN_MAX_INLINE_LENGTH,
+	})
 	newClient.TransactionTimeout = transactionTimeout
+	newClient.MaxInFlight = EXTERN_MAX_IN_FLIGHT
 	newClient.transactionMode = transactionModeNone
 	return
 }
 
+// Describes this client as the owner of the connections it checks out
+func (this *Client) Owner() string {
+	return this.owner
+}
+
 // Parses the given command
 func (this *Client) ParseCommand(command protocol.Command) ([]byte, error) {
+	//AUTH and CLIENT SETNAME only identify the client to rmux, the servers are not told about them
+	if bytes.Equal(command.GetCommand(), protocol.AUTH_COMMAND) {
+		return this.authenticate(command.GetArgs())
+	}
+
+	if bytes.Equal(command.GetCommand(), protocol.CLIENT_COMMAND) &&
+		bytes.EqualFold(command.GetFirstArg(), protocol.SETNAME_SUBCOMMAND) {
+		return this.setName(command.GetArgs())
+	}
+
 	//block all unsafe commands
 	if !protocol.IsSupportedFunction(command.GetCommand(), this.Multiplexing, command.GetArgCount() > 2) {
 		return nil, protocol.ERR_COMMAND_UNSUPPORTED
@@ -120,7 +185,7 @@ func (this *Client) ParseCommand(command protocol.Command) ([]byte, error) {
 
 	if bytes.Equal(command.GetCommand(), protocol.SELECT_COMMAND) {
 		databaseId, err := protocol.ParseInt(command.GetFirstArg())
-		if err != nil {
+		if err != nil || databaseId < 0 {
 			return nil, protocol.ERR_BAD_ARGUMENTS
 		}
 
@@ -128,9 +193,40 @@ func (this *Client) ParseCommand(command protocol.Command) ([]byte, error) {
 		return protocol.OK_RESPONSE, nil
 	}
 
+	// Only commands for the redis servers count against the rate limits
+	if this.RateLimiter != nil {
+		if err := this.waitForRateLimits(command.GetCommand()); err != nil {
+			return nil, err
+		}
+	}
+
 	return nil, nil
 }
 
+// Records the user of an AUTH <user> <password>.  The password is not checked: rmux authenticates to the redis
+// servers with its own credentials
+func (this *Client) authenticate(args [][]byte) ([]byte, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, protocol.ERR_BAD_ARGUMENTS
+	}
+	if len(args) == 2 {
+		this.user = string(args[0])
+		this.joinRateLimit()
+	}
+	return protocol.OK_RESPONSE, nil
+}
+
+// Records the name of a CLIENT SETNAME <name>.  An empty name clears it, names with spaces or special characters are
+// refused like redis does
+func (this *Client) setName(args [][]byte) ([]byte, error) {
+	if len(args) != 2 || bytes.IndexFunc(args[1], func(r rune) bool { return r < '!' || r > '~' }) >= 0 {
+		return nil, protocol.ERR_BAD_ARGUMENTS
+	}
+	this.name = string(args[1])
+	this.joinRateLimit()
+	return protocol.OK_RESPONSE, nil
+}
+
 func (this *Client) WriteError(err error, flush bool) error {
 	return protocol.WriteError([]byte(err.Error()), this.Writer, flush)
 }
@@ -153,18 +249,36 @@ func (this *Client) FlushRedisAndRespond() (err error) {
 		return this.Writer.Flush()
 	}
 
-	var connectionPool *connection.ConnectionPool
-	if !this.Multiplexing {
-		connectionPool = this.HashRing.DefaultConnectionPool
-	} else {
-		if len(this.queued) != 1 {
-			panic("Should not have multiple commands to flush when multiplexing")
-		}
-		connectionPool, err = this.HashRing.GetConnectionPool(this.queued[0])
-		if err != nil {
-			log.Error("Failed to retrieve a connection pool from the hashring")
-			this.ReadChannel <- readItem{nil, err}
-			return
+	if this.Multiplexing {
+		return this.flushPipeline()
+	}
+
+	connectionPool := this.HashRing.DefaultConnectionPool
+	// Requests on a reserved (transaction) connection bypass the circuit breaker
+	admitted := this.reservedRedisConn == nil
+	if admitted && !connectionPool.CircuitBreaker.Allow() {
+		this.fail(ERR_CONNECTION_DOWN)
+		return ERR_CONNECTION_DOWN
+	}
+
+	if sharedConn := this.sharedConnectionFor(connectionPool, this.queued); sharedConn != nil {
+		var responses [][]byte
+		if responses, err = this.sendShared(connectionPool, sharedConn, this.queued); err != connection.ERR_SHARED_CONNECTION_BUSY {
+			this.resetQueued()
+			held := responsesSize(responses)
+			defer this.releaseOutput(held)
+			if outputErr := this.holdOutput(held); outputErr != nil {
+				err = outputErr
+			} else {
+				for _, response := range responses {
+					this.Writer.WriteChunk(response)
+				}
+				this.Writer.Flush()
+			}
+			if err != nil {
+				this.fail(err)
+			}
+			return err
 		}
 	}
 
@@ -175,23 +289,39 @@ func (this *Client) FlushRedisAndRespond() (err error) {
 		redisConn = <-this.reservedRedisConn
 		if redisConn == nil {
 			// Check if a transaction timeout handler closed the channel and report to the client
-			this.ReadChannel <- readItem{nil, ERR_TRANSACTION_TIMEOUT}
+			this.fail(ERR_TRANSACTION_TIMEOUT)
 			return ERR_TRANSACTION_TIMEOUT
 		}
 	} else {
-		redisConn, err = connectionPool.GetConnection()
-		if err != nil {
-			log.Error("Failed to retrieve an active connection from the provided connection pool")
-			this.ReadChannel <- readItem{nil, ERR_CONNECTION_DOWN}
-			return ERR_CONNECTION_DOWN
+		if redisConn, err = this.getRedisConnection(connectionPool); err == connection.ERR_POOL_QUEUE_FULL {
+			// Shed load by answering every queued command with an error, and keep the client connected
+			for range this.queued {
+				this.WriteError(err, false)
+			}
+			this.resetQueued()
+			this.Writer.Flush()
+			return err
+		} else if err != nil {
+			this.fail(err)
+			return err
 		}
 	}
 
+	unavailable := false
+
 	defer func() {
+		if admitted {
+			if err != nil || unavailable {
+				connectionPool.RecordFailure()
+			} else {
+				connectionPool.RecordSuccess()
+			}
+		}
+
 		if err != nil {
 			// In case of an error the upstream and the downstream connection need to be disconnected
 			redisConn.Disconnect()
-			this.ReadChannel <- readItem{nil, err}
+			this.fail(err)
 		}
 
 		if this.reservedRedisConn == nil {
@@ -213,11 +343,8 @@ func (this *Client) FlushRedisAndRespond() (err error) {
 		}
 	}()
 
-	if redisConn.DatabaseId != this.DatabaseId {
-		if err = redisConn.SelectDatabase(this.DatabaseId); err != nil {
-			log.Error("Select database failed: %s", err)
-			return
-		}
+	if err = this.selectDatabase(connectionPool, redisConn); err != nil {
+		return
 	}
 
 	numCommands := len(this.queued)
@@ -233,6 +360,7 @@ func (this *Client) FlushRedisAndRespond() (err error) {
 		}
 	}
 	this.resetQueued()
+	redisConn.ExpectResponses(numCommands)
 	for redisConn.Writer.Buffered() > 0 {
 		err = redisConn.Writer.Flush()
 		if err != nil {
@@ -243,10 +371,16 @@ func (this *Client) FlushRedisAndRespond() (err error) {
 
 	graphite.Timing("redis_write", time.Now().Sub(startWrite))
 
-	if err = protocol.CopyServerResponses(redisConn.Reader, this.Writer, numCommands); err != nil {
-		log.Error("Error when copying redis responses to client: %s. Disconnecting the connection.", err)
-		return
+	if unavailable, err = protocol.CopyServerResponsesWithStatus(redisConn.Reader, this.Writer, numCommands); err != nil {
+		if _, ok := err.(*protocol.UnexpectedDataError); !ok {
+			log.Error("Error when copying redis responses to client: %s. Disconnecting the connection.", err)
+			return
+		}
+		// The client received all of its responses, only the redis connection must not be reused
+		redisConn.MarkOutOfSync(err)
+		err = nil
 	}
+	redisConn.ResponsesRead(numCommands)
 
 	this.Writer.Flush()
 
@@ -258,19 +392,25 @@ func (this *Client) FlushRedisAndRespond() (err error) {
 		this.transactionDoneChannel = transactionDoneChannel
 
 		go func() {
+			var reason interface{}
 			select {
-			case <-transactionDoneChannel:
-				// Exit the routine if the transaction has already finished
-			case <-time.After(this.TransactionTimeout):
-				// Handle a transaction timeout, needs to reserve the redis connection to prevent race conditions
-				redisConn = <-reservedRedisConn
-				if redisConn != nil {
-					// Only enforce the timeout if we actually got the connection back
-					close(reservedRedisConn)
-					log.Error("Transaction timed out. Disconnecting the connection.")
-					redisConn.Disconnect()
-					connectionPool.RecycleRemoteConnection(redisConn)
+			case reason = <-transactionDoneChannel:
+				if reason == nil {
+					// Exit the routine if the transaction has already finished
+					return
 				}
+				// The client was disconnected during the transaction
+			case <-time.After(this.TransactionTimeout):
+				reason = ERR_TRANSACTION_TIMEOUT
+			}
+			// Needs to reserve the redis connection to prevent race conditions
+			redisConn = <-reservedRedisConn
+			if redisConn != nil {
+				// Only end the transaction if we actually got the connection back
+				close(reservedRedisConn)
+				log.Error("%s. Disconnecting the connection.", reason)
+				redisConn.Disconnect()
+				connectionPool.RecycleRemoteConnection(redisConn)
 			}
 		}()
 	}
@@ -278,34 +418,302 @@ func (this *Client) FlushRedisAndRespond() (err error) {
 	return nil
 }
 
-func (this *Client) HasBufferedOutput() bool {
-	return this.Writer.Buffered() > 0
+// Checks out a connection to the given pool, that has allowed the request already
+// If no connection can be checked out, the outcome of the request is recorded, and the error for the client returned
+func (this *Client) getRedisConnection(connectionPool *connection.ConnectionPool) (redisConn *connection.Connection, err error) {
+	redisConn, err = connectionPool.GetConnectionFor(connection.ConnectionRequest{
+		DatabaseId: connectionPool.ResolveDatabase(this.DatabaseId),
+		Owner:      this.Owner(),
+		Priority:   this.Priority,
+	})
+	if err == nil {
+		return redisConn, nil
+	}
+
+	if err == connection.ERR_POOL_TIMEOUT || err == connection.ERR_POOL_QUEUE_FULL ||
+		err == connection.ERR_POOL_BACKOFF {
+		// The request never reached the server, so it says nothing new about the health of the server
+		connectionPool.CircuitBreaker.Cancel()
+	} else {
+		connectionPool.RecordFailure()
+	}
+	if err == connection.ERR_POOL_QUEUE_FULL {
+		// Fail fast with a distinct error, so that overload can be told apart from a server that is down
+		log.Warn("Too many clients are waiting for a connection to %s", connectionPool.Endpoint)
+		return nil, err
+	}
+	log.Error("Failed to retrieve an active connection from the provided connection pool")
+	return nil, ERR_CONNECTION_DOWN
+}
+
+// Returns a shared connection of the pool to send the given commands over, or nil if they need a connection of their own
+// Connections are only shared for commands on the default database of the pool, outside of transactions, that do not
+// block the connection
+func (this *Client) sharedConnectionFor(connectionPool *connection.ConnectionPool, commands []protocol.Command) *connection.SharedConnection {
+	if connectionPool.SharedConnections <= 0 || this.reservedRedisConn != nil ||
+		connectionPool.ResolveDatabase(this.DatabaseId) != connectionPool.ResolveDatabase(connection.DEFAULT_DATABASE) {
+		return nil
+	}
+	for _, command := range commands {
+		if protocol.NeedsExclusiveConnection(command.GetCommand()) {
+			return nil
+		}
+	}
+	return connectionPool.SharedConnection()
+}
+
+// Sends commands over a shared connection of a pool that has allowed the request already, and records its outcome
+// If the shared connection is too busy, ERR_SHARED_CONNECTION_BUSY is returned without recording an outcome, so that the
+// commands can be sent over a connection of their own instead
+func (this *Client) sendShared(connectionPool *connection.ConnectionPool, sharedConn *connection.SharedConnection,
+	commands []protocol.Command) (responses [][]byte, err error) {
+	responses, unavailable, err := sharedConn.Do(commands, this.maxHeldResponseLength())
+	switch err {
+	case nil, protocol.ERR_RESPONSE_TOO_LONG:
+		if unavailable {
+			connectionPool.RecordFailure()
+		} else {
+			connectionPool.RecordSuccess()
+		}
+	case connection.ERR_SHARED_CONNECTION_BUSY:
+		graphite.Increment("shared_connection_busy")
+	case connection.ERR_POOL_BACKOFF:
+		// The request never reached the server, so it says nothing new about the health of the server
+		connectionPool.CircuitBreaker.Cancel()
+		err = ERR_CONNECTION_DOWN
+	default:
+		connectionPool.RecordFailure()
+	}
+	return responses, err
+}
+
+// Selects the database of this client on the given connection, if it has another one selected
+func (this *Client) selectDatabase(connectionPool *connection.ConnectionPool, redisConn *connection.Connection) (err error) {
+	if databaseId := connectionPool.ResolveDatabase(this.DatabaseId); redisConn.DatabaseId != databaseId {
+		graphite.Increment("select")
+		if err = redisConn.SelectDatabase(databaseId); err != nil {
+			log.Error("Select database failed: %s", err)
+		}
+	}
+	return
+}
+
+// The commands of a pipeline that go to the same connection pool, and their responses
+type pipelineGroup struct {
+	connectionPool *connection.ConnectionPool
+	commands       []protocol.Command
+	responses      [][]byte
+	// Whether the responses were written to the client as they arrived, instead of being held
+	streamed bool
+	err      error
+}
+
+// Sends the queued commands of a multiplexing client to their connection pools, and responds in the order of the commands
+// The commands for each pool are sent in one write, and all pools are sent to concurrently, so that a pipeline takes
+// about one round trip instead of one per command. Commands of a pool with too many clients waiting for a connection are
+// answered with an error. If a command can not be served otherwise, the responses of the commands before it are still
+// sent, and the error is handed to the client loop.
+// Responses of a pipeline that goes to a single pool over a connection of its own are passed on as they arrive. Others
+// are held until they can be written in order, and a response longer than the client's hard output limit disconnects
+// the client without being held.
+func (this *Client) flushPipeline() (err error) {
+	queued := this.queued
+	defer this.resetQueued()
+
+	// The group of every command, in the order of the commands
+	order := make([]*pipelineGroup, 0, len(queued))
+	groups := make(map[*connection.ConnectionPool]*pipelineGroup)
+	admitted := make(map[*connection.ConnectionPool]bool)
+	for _, command := range queued {
+		var connectionPool *connection.ConnectionPool
+		if connectionPool, err = this.HashRing.GetBatchConnectionPool(command, admitted); err != nil {
+			log.Error("Failed to retrieve a connection pool from the hashring")
+			break
+		}
+		group := groups[connectionPool]
+		if group == nil {
+			group = &pipelineGroup{connectionPool: connectionPool}
+			groups[connectionPool] = group
+			admitted[connectionPool] = true
+		}
+		group.commands = append(group.commands, command)
+		order = append(order, group)
+	}
+
+	switch len(groups) {
+	case 0:
+	case 1:
+		this.dispatchGroup(order[0], this.Writer)
+	default:
+		var waitGroup sync.WaitGroup
+		for _, group := range groups {
+			waitGroup.Add(1)
+			go func(group *pipelineGroup) {
+				defer waitGroup.Done()
+				this.dispatchGroup(group, nil)
+			}(group)
+		}
+		waitGroup.Wait()
+	}
+
+	// The responses are held until they were written to the client
+	held := 0
+	for _, group := range groups {
+		held += responsesSize(group.responses)
+	}
+	defer this.releaseOutput(held)
+	outputErr := this.holdOutput(held)
+
+	for _, group := range order {
+		if outputErr != nil {
+			err = outputErr
+			break
+		} else if group.err == connection.ERR_POOL_QUEUE_FULL {
+			this.WriteError(group.err, false)
+			continue
+		} else if group.err == protocol.ERR_RESPONSE_TOO_LONG {
+			log.Warn("Disconnecting %s, which asked for a response longer than its output limit", this.Owner())
+			this.disconnectForOutput("output_hard_limit")
+			err = ERR_OUTPUT_LIMIT
+			break
+		} else if group.err != nil {
+			err = group.err
+			break
+		} else if group.streamed {
+			continue
+		}
+		this.Writer.WriteChunk(group.responses[0])
+		group.responses = group.responses[1:]
+	}
+	this.Writer.Flush()
+
+	if err != nil {
+		this.fail(err)
+	}
+	return err
 }
 
-// Read loop for this client - moves commands and channels to the worker loop
-func (this *Client) ReadLoop(rmux *RedisMultiplexer) {
-	for rmux.active && this.Active && this.Scanner.Scan() {
-		bytes := this.Scanner.Bytes()
-		command, err := protocol.ParseCommand(bytes)
-		this.ReadChannel <- readItem{command, err}
+// Sends the commands of a group over a shared connection of its pool, or over a connection of their own, and reads their
+// responses.  Given a destination, responses read over a connection of their own are copied to it as they arrive,
+// instead of being held.
+func (this *Client) dispatchGroup(group *pipelineGroup, destination *writer.FlexibleWriter) {
+	connectionPool := group.connectionPool
+	if sharedConn := this.sharedConnectionFor(connectionPool, group.commands); sharedConn != nil {
+		responses, err := this.sendShared(connectionPool, sharedConn, group.commands)
+		if err != connection.ERR_SHARED_CONNECTION_BUSY {
+			group.responses, group.err = responses, err
+			return
+		}
 	}
 
-	if err := this.Scanner.Err(); err != nil {
-		this.ReadChannel <- readItem{nil, err}
+	redisConn, err := this.getRedisConnection(connectionPool)
+	if err != nil {
+		group.err = err
+		return
+	}
+
+	unavailable := false
+
+	defer func() {
+		if err != nil || unavailable {
+			connectionPool.RecordFailure()
+		} else {
+			connectionPool.RecordSuccess()
+		}
+
+		if err != nil {
+			// In case of an error the upstream connection needs to be disconnected
+			redisConn.Disconnect()
+			group.err = err
+		}
+		connectionPool.RecycleRemoteConnection(redisConn)
+	}()
+
+	if err = this.selectDatabase(connectionPool, redisConn); err != nil {
+		return
+	}
+
+	numCommands := len(group.commands)
+
+	startWrite := time.Now()
+
+	for _, command := range group.commands {
+		if _, err = redisConn.Writer.Write(command.GetBuffer()); err != nil {
+			log.Error("Error when writing to server: %s. Disconnecting the connection.", err)
+			return
+		}
+	}
+	redisConn.ExpectResponses(numCommands)
+	for redisConn.Writer.Buffered() > 0 {
+		if err = redisConn.Writer.Flush(); err != nil {
+			log.Error("Error when flushing to server: %s. Disconnecting the connection.", err)
+			return
+		}
+	}
+
+	graphite.Timing("redis_write", time.Now().Sub(startWrite))
+
+	if destination != nil {
+		group.streamed = true
+		unavailable, err = protocol.CopyServerResponsesWithStatus(redisConn.Reader, destination, numCommands)
 	} else {
-		this.ReadChannel <- readItem{nil, io.EOF}
+		group.responses, unavailable, err = protocol.ReadServerResponses(redisConn.Reader, numCommands,
+			this.maxHeldResponseLength())
 	}
+	if err == protocol.ERR_RESPONSE_TOO_LONG {
+		// All responses were read, they just can not be held for this client
+		group.err, err = err, nil
+	} else if err != nil {
+		if _, ok := err.(*protocol.UnexpectedDataError); !ok {
+			log.Error("Error when reading redis responses: %s. Disconnecting the connection.", err)
+			return
+		}
+		// All responses were read, only the redis connection must not be reused
+		redisConn.MarkOutOfSync(err)
+		err = nil
+	}
+	redisConn.ResponsesRead(numCommands)
 }
 
+func (this *Client) HasBufferedOutput() bool {
+	return this.Writer.Buffered() > 0
+}
+
+// Records an error that ends the current request, for the client loop to handle once the request is done
+// Only the first error is kept, since the client loop acts on it by deactivating or disconnecting the client
+func (this *Client) fail(err error) {
+	if this.err == nil {
+		this.err = err
+	}
+}
+
+// Returns and clears the error recorded by fail
+func (this *Client) takeError() (err error) {
+	err, this.err = this.err, nil
+	return
+}
+
+// Releases the queued commands once they were written upstream, along with the scanner memory they reference
 func (this *Client) resetQueued() {
-	// We make a new one instead of using this.queued=this.queued[:0] so that the command arrays are eligible for GC
-	this.queued = make([]protocol.Command, 0, 4)
+	for i, command := range this.queued {
+		protocol.ReleaseCommand(command)
+		this.queued[i] = nil
+	}
+	this.queued = this.queued[:0]
+	if this.Scanner != nil {
+		this.Scanner.Release()
+	}
 }
 
 func (this *Client) HasQueued() bool {
 	return len(this.queued) > 0
 }
 
+// Whether the amount of queued commands reached the amount this client may have in flight
+func (this *Client) QueueFull() bool {
+	return len(this.queued) >= this.MaxInFlight
+}
+
 func (this *Client) Queue(command protocol.Command) {
 	this.queued = append(this.queued, command)
 }
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package rmux
+
+import (
+	"net"
+	"rmux/graphite"
+	"rmux/protocol"
+	"rmux/writer"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The clients connected to a multiplexer at once are limited in total, like the maxclients of redis, and per source:
+// the IP address of a TCP client, or the user id of the process on the other end of a unix socket, where the platform
+// reports it. A connection beyond a limit is answered with an error and closed right away, without being handled as a
+// client.
+
+var MAX_CLIENTS_RESPONSE = []byte("max number of clients reached")
+
+// Counts the clients connected to a multiplexer, in total and by their source
+type ClientLimiter struct {
+	// The most clients connected at once, and the most connected from a single source.  Zero disables a limit
+	MaxClients          int
+	MaxClientsPerSource int
+
+	lock    sync.Mutex
+	total   int
+	sources map[string]int
+	// The amount of connections that were turned away
+	rejected uint64
+}
+
+func NewClientLimiter(maxClients, maxClientsPerSource int) *ClientLimiter {
+	return &ClientLimiter{
+		MaxClients:          maxClients,
+		MaxClientsPerSource: maxClientsPerSource,
+		sources:             make(map[string]int),
+	}
+}
+
+// Counts a client from the given source, or an empty source if it is unknown, unless that exceeds a limit
+// Returns the reason the client was turned away, or an empty string if it was admitted
+func (this *ClientLimiter) Admit(source string) (reason string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.MaxClients > 0 && this.total >= this.MaxClients {
+		reason = "rejected_max_clients"
+	} else if source != "" && this.MaxClientsPerSource > 0 && this.sources[source] >= this.MaxClientsPerSource {
+		reason = "rejected_max_clients_per_source"
+	} else {
+		this.total++
+		if source != "" {
+			this.sources[source]++
+		}
+		return ""
+	}
+
+	atomic.AddUint64(&this.rejected, 1)
+	return reason
+}
+
+// Stops counting a client that was admitted from the given source
+func (this *ClientLimiter) Release(source string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.total--
+	if source == "" {
+		return
+	}
+	if count := this.sources[source] - 1; count > 0 {
+		this.sources[source] = count
+	} else {
+		delete(this.sources, source)
+	}
+}
+
+// The amount of clients from the given source
+func (this *ClientLimiter) Count(source string) int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.sources[source]
+}
+
+// The amount of connections that were turned away
+func (this *ClientLimiter) Rejected() uint64 {
+	return atomic.LoadUint64(&this.rejected)
+}
+
+// Identifies where a connection comes from, or returns an empty string if that is unknown
+func connectionSource(localConnection net.Conn) string {
+	if address, ok := localConnection.RemoteAddr().(*net.TCPAddr); ok {
+		return "ip:" + address.IP.String()
+	}
+	if uid, ok := peerUid(localConnection); ok {
+		return "uid:" + strconv.FormatUint(uint64(uid), 10)
+	}
+	return ""
+}
+
+// Answers a connection that is turned away with an error, and closes it
+func rejectClient(localConnection net.Conn, reason string, writeTimeout time.Duration) {
+	graphite.Increment(reason)
+	defer localConnection.Close()
+	protocol.WriteError(MAX_CLIENTS_RESPONSE, writer.NewFlexibleWriter(
+		protocol.NewTimedNetReadWriter(localConnection, 0, writeTimeout)), true)
+}
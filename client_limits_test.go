@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package rmux
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientLimiter(t *testing.T) {
+	limiter := NewClientLimiter(3, 2)
+
+	for _, source := range []string{"ip:10.0.0.1", "ip:10.0.0.1", ""} {
+		if reason := limiter.Admit(source); reason != "" {
+			t.Fatalf("Expected a client from %q to be admitted, got %s", source, reason)
+		}
+	}
+	if reason := limiter.Admit("ip:10.0.0.1"); reason != "rejected_max_clients" {
+		t.Errorf("Expected a client beyond the limit to be rejected, got %q", reason)
+	}
+
+	limiter.Release("")
+	if reason := limiter.Admit("ip:10.0.0.1"); reason != "rejected_max_clients_per_source" {
+		t.Errorf("Expected a client beyond the limit of its source to be rejected, got %q", reason)
+	}
+	if reason := limiter.Admit("ip:10.0.0.2"); reason != "" {
+		t.Errorf("Expected a client from another source to be admitted, got %s", reason)
+	}
+
+	limiter.Release("ip:10.0.0.1")
+	if count := limiter.Count("ip:10.0.0.1"); count != 1 {
+		t.Errorf("Expected 1 client from the source, got %d", count)
+	}
+	if limiter.Rejected() != 2 {
+		t.Errorf("Expected 2 rejections, got %d", limiter.Rejected())
+	}
+}
+
+func TestAcceptClient_MaxClients(t *testing.T) {
+	server, stop := newBenchmarkServer(t)
+	defer stop()
+	server.activeConnectionCount = 1
+	server.clientLimiter.MaxClients = 1
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	server.acceptClient(local, 0)
+	go remote.Write([]byte("*1\r\n$4\r\nping\r\n"))
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	if line, err := bufio.NewReader(remote).ReadString('\n'); err != nil || line != "+PONG\r\n" {
+		t.Fatalf("Expected the first client to be served, got %q: %v", line, err)
+	}
+
+	rejectedLocal, rejected := net.Pipe()
+	defer rejected.Close()
+	go server.acceptClient(rejectedLocal, 0)
+	rejected.SetReadDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(rejected)
+	if line, err := reader.ReadString('\n'); err != nil || line != "-ERR max number of clients reached\r\n" {
+		t.Fatalf("Expected the second client to be rejected, got %q: %v", line, err)
+	}
+	if _, err := reader.ReadByte(); err == nil {
+		t.Error("Expected the rejected client to be disconnected")
+	}
+}
+
+func TestConnectionSource_Tcp(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		if conn, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+			defer conn.Close()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %s", err)
+	}
+	defer conn.Close()
+	if source := connectionSource(conn); source != "ip:127.0.0.1" {
+		t.Errorf("Expected the source to be the address of the client, got %q", source)
+	}
+}
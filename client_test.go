@@ -30,8 +30,12 @@ import (
 	"bufio"
 	"bytes"
 	"net"
+	"os"
+	"rmux/connection"
 	"rmux/protocol"
 	"rmux/writer"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -115,7 +119,13 @@ func TestParseCommand(test *testing.T) {
 		//select in a bad format should err
 		{[]byte("*2\r\n$6\r\nselect\r\n$1\r\na\r\n"), nil, protocol.ERR_BAD_ARGUMENTS},
 		//random command on our blacklist should respond appropriately
-		{[]byte("*1\r\n$4\r\nauth\r\n"), nil, protocol.ERR_COMMAND_UNSUPPORTED},
+		{[]byte("*1\r\n$6\r\nconfig\r\n"), nil, protocol.ERR_COMMAND_UNSUPPORTED},
+		//auth and client setname only identify the client to rmux
+		{[]byte("*1\r\n$4\r\nauth\r\n"), nil, protocol.ERR_BAD_ARGUMENTS},
+		{[]byte("*3\r\n$4\r\nauth\r\n$5\r\nalice\r\n$6\r\nsecret\r\n"), protocol.OK_RESPONSE, nil},
+		{[]byte("*3\r\n$6\r\nclient\r\n$7\r\nSETNAME\r\n$6\r\nworker\r\n"), protocol.OK_RESPONSE, nil},
+		{[]byte("*3\r\n$6\r\nclient\r\n$7\r\nsetname\r\n$3\r\na b\r\n"), nil, protocol.ERR_BAD_ARGUMENTS},
+		{[]byte("*2\r\n$6\r\nclient\r\n$4\r\nlist\r\n"), nil, protocol.ERR_COMMAND_UNSUPPORTED},
 		//random command on our pubsub list should respond appropriately
 		{[]byte("*1\r\n$6\r\npubsub\r\n"), nil, protocol.ERR_COMMAND_UNSUPPORTED},
 		//multi should fail
@@ -164,3 +174,257 @@ func TestParseCommand(test *testing.T) {
 		}
 	}
 }
+
+// Answers every command with the name of the server and the first argument of the command, after the given delay
+func startKeyEchoServer(t testing.TB, sock, name string, delay time.Duration) net.Listener {
+	os.Remove(sock)
+	listenSock, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Cannot listen on %s: %s", sock, err)
+	}
+
+	go func() {
+		for {
+			c, err := listenSock.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				scanner := protocol.NewRespScanner(c)
+				for scanner.Scan() {
+					command, err := protocol.ParseCommand(scanner.Bytes())
+					if err != nil {
+						return
+					}
+					time.Sleep(delay)
+					c.Write([]byte("+" + name + ":" + string(command.GetFirstArg()) + "\r\n"))
+				}
+			}()
+		}
+	}()
+
+	return listenSock
+}
+
+func TestFlushPipeline(t *testing.T) {
+	slowServer := startKeyEchoServer(t, "/tmp/rmuxPipelineSlow.sock", "slow", 10*time.Millisecond)
+	defer slowServer.Close()
+	fastServer := startKeyEchoServer(t, "/tmp/rmuxPipelineFast.sock", "fast", 0)
+	defer fastServer.Close()
+
+	for _, sharedConnections := range []int{0, 1} {
+		timeout := 100 * time.Millisecond
+		pools := []*connection.ConnectionPool{
+			connection.NewConnectionPool("unix", "/tmp/rmuxPipelineSlow.sock", 2, timeout, timeout, timeout, time.Hour, "", ""),
+			connection.NewConnectionPool("unix", "/tmp/rmuxPipelineFast.sock", 2, timeout, timeout, timeout, time.Hour, "", ""),
+		}
+		names := map[*connection.ConnectionPool]string{pools[0]: "slow", pools[1]: "fast"}
+		for _, pool := range pools {
+			pool.SetIsConnected(true)
+			pool.SharedConnections = sharedConnections
+		}
+		hashRing, err := connection.NewHashRing(pools, false)
+		if err != nil {
+			t.Fatalf("Failed to create the hash ring: %s", err)
+		}
+
+		client := NewClient(&net.UnixConn{}, true, hashRing, time.Second)
+		output := new(bytes.Buffer)
+		client.Writer = writer.NewFlexibleWriter(output)
+
+		var expected bytes.Buffer
+		seen := make(map[*connection.ConnectionPool]bool)
+		for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+			command, err := protocol.ParseCommand([]byte("*2\r\n$3\r\nget\r\n$1\r\n" + key + "\r\n"))
+			if err != nil {
+				t.Fatalf("Failed to parse a command: %s", err)
+			}
+			pool, _ := hashRing.GetConnectionPool(command)
+			seen[pool] = true
+			expected.WriteString("+" + names[pool] + ":" + key + "\r\n")
+			client.Queue(command)
+		}
+		if len(seen) != 2 {
+			t.Fatalf("Expected the keys to spread over both pools")
+		}
+
+		if err := client.FlushRedisAndRespond(); err != nil {
+			t.Fatalf("Failed to flush the pipeline: %s", err)
+		}
+		if output.String() != expected.String() {
+			t.Errorf("Expected the responses %q, got %q", expected.String(), output.String())
+		}
+		if client.HasQueued() {
+			t.Errorf("Expected no queued commands after the flush")
+		}
+		for _, pool := range pools {
+			if checkouts := pool.Checkouts(); len(checkouts) != 0 {
+				t.Errorf("Expected all connections to be recycled, got %v", checkouts)
+			}
+			if sharedRequests := pool.SharedRequests; (sharedRequests > 0) != (sharedConnections > 0) {
+				t.Errorf("Expected shared requests only with shared connections, got %d with %d shared connections",
+					sharedRequests, sharedConnections)
+			}
+		}
+	}
+}
+
+// Starts a server that answers GET n with a value of n bytes
+func startLargeValueServer(t testing.TB, sock string) net.Listener {
+	os.Remove(sock)
+	listenSock, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Cannot listen on %s: %s", sock, err)
+	}
+
+	go func() {
+		for {
+			c, err := listenSock.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				scanner := protocol.NewRespScanner(c)
+				for scanner.Scan() {
+					command, err := protocol.ParseCommand(scanner.Bytes())
+					if err != nil {
+						return
+					}
+					length, _ := strconv.Atoi(string(command.GetFirstArg()))
+					c.Write([]byte(largeValue(length)))
+				}
+			}()
+		}
+	}()
+
+	return listenSock
+}
+
+func largeValue(length int) string {
+	return "$" + strconv.Itoa(length) + "\r\n" + strings.Repeat("x", length) + "\r\n"
+}
+
+func TestFlushPipeline_LargeResponses(t *testing.T) {
+	firstServer := startLargeValueServer(t, "/tmp/rmuxLargeFirst.sock")
+	defer firstServer.Close()
+	secondServer := startLargeValueServer(t, "/tmp/rmuxLargeSecond.sock")
+	defer secondServer.Close()
+
+	timeout := 100 * time.Millisecond
+	pools := []*connection.ConnectionPool{
+		connection.NewConnectionPool("unix", "/tmp/rmuxLargeFirst.sock", 2, timeout, timeout, timeout, time.Hour, "", ""),
+		connection.NewConnectionPool("unix", "/tmp/rmuxLargeSecond.sock", 2, timeout, timeout, timeout, time.Hour, "", ""),
+	}
+	for _, pool := range pools {
+		pool.SetIsConnected(true)
+	}
+	hashRing, err := connection.NewHashRing(pools, false)
+	if err != nil {
+		t.Fatalf("Failed to create the hash ring: %s", err)
+	}
+
+	getCommand := func(length int) protocol.Command {
+		key := strconv.Itoa(length)
+		command, err := protocol.ParseCommand([]byte("*2\r\n$3\r\nget\r\n$" + strconv.Itoa(len(key)) + "\r\n" + key + "\r\n"))
+		if err != nil {
+			t.Fatalf("Failed to parse a command: %s", err)
+		}
+		return command
+	}
+	flush := func(lengths ...int) (string, error) {
+		client := NewClient(&net.UnixConn{}, true, hashRing, time.Second)
+		client.OutputLimits = OutputLimits{HardLimit: 2 * writer.BLOCK_SIZE}
+		output := new(bytes.Buffer)
+		client.Writer = writer.NewFlexibleWriter(output)
+		for _, length := range lengths {
+			client.Queue(getCommand(length))
+		}
+		err := client.FlushRedisAndRespond()
+		return output.String(), err
+	}
+
+	// A value larger than the client may hold, and small ones on either pool
+	large := 10 * writer.BLOCK_SIZE
+	largePool, _ := hashRing.GetConnectionPool(getCommand(large))
+	smallOn := func(samePool bool) int {
+		for length := 1; ; length++ {
+			if pool, _ := hashRing.GetConnectionPool(getCommand(length)); (pool == largePool) == samePool {
+				return length
+			}
+		}
+	}
+	small, sameSmall := smallOn(false), smallOn(true)
+
+	// Responses of a pipeline to a single pool are passed on as they arrive, instead of being held
+	if output, err := flush(large, large); err != nil || output != largeValue(large)+largeValue(large) {
+		t.Fatalf("Expected the large values to be passed on, got %d bytes: %v", len(output), err)
+	}
+
+	// Responses of a pipeline over several pools are held, so the large one disconnects the client instead
+	if _, err := flush(large, small); err != ERR_OUTPUT_LIMIT {
+		t.Errorf("Expected the client to be disconnected for its output, got: %v", err)
+	}
+
+	// As does one read over a shared connection
+	largePool.SharedConnections = 1
+	if _, err := flush(large); err != ERR_OUTPUT_LIMIT {
+		t.Errorf("Expected the client to be disconnected for its output, got: %v", err)
+	}
+
+	// The connections stay in sync, since the large responses were read without being held
+	if output, err := flush(sameSmall, small); err != nil || output != largeValue(sameSmall)+largeValue(small) {
+		t.Errorf("Expected the small values, got %q: %v", output, err)
+	}
+	for _, pool := range pools {
+		if checkouts := pool.Checkouts(); len(checkouts) != 0 {
+			t.Errorf("Expected all connections to be recycled, got %v", checkouts)
+		}
+		if pool.Desyncs != 0 {
+			t.Errorf("Expected no connection to get out of sync, got %d", pool.Desyncs)
+		}
+	}
+	if largePool.SharedRequests != 2 {
+		t.Errorf("Expected 2 shared requests, got %d", largePool.SharedRequests)
+	}
+}
+
+func TestSharedConnectionFor(t *testing.T) {
+	timeout := 100 * time.Millisecond
+	pool := connection.NewConnectionPool("unix", "/tmp/rmuxSharedTest.sock", 2, timeout, timeout, timeout, time.Hour, "", "")
+	pool.SharedConnections = 1
+	client := NewClient(&net.UnixConn{}, false, nil, time.Second)
+
+	testCases := []struct {
+		input      string
+		databaseId int
+		shared     bool
+	}{
+		{"*2\r\n$3\r\nget\r\n$1\r\na\r\n", connection.DEFAULT_DATABASE, true},
+		{"*2\r\n$3\r\nget\r\n$1\r\na\r\n", 0, true},
+		{"*2\r\n$3\r\nget\r\n$1\r\na\r\n", 3, false},
+		{"*1\r\n$5\r\nmulti\r\n", connection.DEFAULT_DATABASE, false},
+		{"*3\r\n$5\r\nblpop\r\n$1\r\na\r\n$1\r\n0\r\n", connection.DEFAULT_DATABASE, false},
+		{"*2\r\n$5\r\nhello\r\n$1\r\n3\r\n", connection.DEFAULT_DATABASE, false},
+		{"*1\r\n$5\r\nreset\r\n", connection.DEFAULT_DATABASE, false},
+		{"*1\r\n$8\r\nreadonly\r\n", connection.DEFAULT_DATABASE, false},
+		{"*1\r\n$9\r\nreadwrite\r\n", connection.DEFAULT_DATABASE, false},
+		{"*2\r\n$10\r\nssubscribe\r\n$1\r\na\r\n", connection.DEFAULT_DATABASE, false},
+		{"*1\r\n$12\r\nsunsubscribe\r\n", connection.DEFAULT_DATABASE, false},
+		{"*3\r\n$5\r\npsync\r\n$1\r\n?\r\n$2\r\n-1\r\n", connection.DEFAULT_DATABASE, false},
+		{"*3\r\n$8\r\nreplconf\r\n$3\r\nack\r\n$1\r\n0\r\n", connection.DEFAULT_DATABASE, false},
+		{"*3\r\n$7\r\nwaitaof\r\n$1\r\n1\r\n$1\r\n0\r\n", connection.DEFAULT_DATABASE, false},
+	}
+
+	for _, testCase := range testCases {
+		command, err := protocol.ParseCommand([]byte(testCase.input))
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %s", testCase.input, err)
+		}
+		client.DatabaseId = testCase.databaseId
+		if shared := client.sharedConnectionFor(pool, []protocol.Command{command}) != nil; shared != testCase.shared {
+			t.Errorf("Expected %q on database %d to be shared: %t", testCase.input, testCase.databaseId, testCase.shared)
+		}
+	}
+}
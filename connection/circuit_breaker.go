@@ -0,0 +1,218 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"rmux/graphite"
+	"rmux/log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The state of a circuit breaker
+type CircuitState int32
+
+const (
+	// Requests pass through, failures are counted
+	CIRCUIT_CLOSED CircuitState = iota
+	// Requests are rejected until the open timeout has passed
+	CIRCUIT_OPEN
+	// A limited amount of requests probe whether the endpoint recovered
+	CIRCUIT_HALF_OPEN
+)
+
+const (
+	//Default time a circuit stays open before probing the endpoint again
+	EXTERN_CIRCUIT_OPEN_TIMEOUT = 2 * time.Second
+	//Default amount of concurrent probe requests while a circuit is half-open
+	EXTERN_CIRCUIT_HALF_OPEN_REQUESTS = 1
+	//Default amount of consecutive successful probes that close a half-open circuit
+	EXTERN_CIRCUIT_SUCCESS_THRESHOLD = 3
+)
+
+func (state CircuitState) String() string {
+	switch state {
+	case CIRCUIT_CLOSED:
+		return "closed"
+	case CIRCUIT_OPEN:
+		return "open"
+	case CIRCUIT_HALF_OPEN:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// A circuit breaker that is fed with the outcome of real requests against an endpoint
+// After FailureThreshold consecutive failures the circuit opens and rejects all requests for OpenTimeout. It then lets
+// up to HalfOpenRequests concurrent requests through, and closes again after SuccessThreshold consecutive successes.
+// Any failure while half-open opens the circuit again.
+// All methods can be called on a nil CircuitBreaker, which always allows requests.
+type CircuitBreaker struct {
+	// Name used when logging and reporting state changes
+	Name string
+	// Consecutive failures that open the circuit
+	FailureThreshold int
+	// How long the circuit stays open before probing
+	OpenTimeout time.Duration
+	// Concurrent requests allowed while half-open
+	HalfOpenRequests int
+	// Consecutive successes that close a half-open circuit
+	SuccessThreshold int
+
+	// Read without the lock, so that closed circuits can allow requests cheaply
+	state     int32
+	lock      sync.Mutex
+	failures  int
+	successes int
+	probes    int
+	openedAt  time.Time
+}
+
+// Initializes a new, closed circuit breaker
+func NewCircuitBreaker(name string, failureThreshold int, openTimeout time.Duration, halfOpenRequests int,
+	successThreshold int) *CircuitBreaker {
+	return &CircuitBreaker{
+		Name:             name,
+		FailureThreshold: failureThreshold,
+		OpenTimeout:      openTimeout,
+		HalfOpenRequests: halfOpenRequests,
+		SuccessThreshold: successThreshold,
+	}
+}
+
+// Returns the current state of the circuit
+func (cb *CircuitBreaker) State() CircuitState {
+	if cb == nil {
+		return CIRCUIT_CLOSED
+	}
+	return CircuitState(atomic.LoadInt32(&cb.state))
+}
+
+// Whether or not a request may be sent
+// Every allowed request must be followed by a call to Success, Failure or Cancel once its outcome is known
+func (cb *CircuitBreaker) Allow() bool {
+	if cb.State() == CIRCUIT_CLOSED {
+		return true
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	switch cb.State() {
+	case CIRCUIT_CLOSED:
+		return true
+	case CIRCUIT_OPEN:
+		if time.Since(cb.openedAt) < cb.OpenTimeout {
+			return false
+		}
+		cb.setState(CIRCUIT_HALF_OPEN)
+	}
+
+	if cb.probes >= cb.HalfOpenRequests {
+		return false
+	}
+	cb.probes++
+	return true
+}
+
+// Records a successful request
+func (cb *CircuitBreaker) Success() {
+	if cb == nil {
+		return
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	switch cb.State() {
+	case CIRCUIT_CLOSED:
+		cb.failures = 0
+	case CIRCUIT_HALF_OPEN:
+		cb.releaseProbe()
+		cb.successes++
+		if cb.successes >= cb.SuccessThreshold {
+			cb.setState(CIRCUIT_CLOSED)
+		}
+	}
+}
+
+// Records a failed request
+func (cb *CircuitBreaker) Failure() {
+	if cb == nil {
+		return
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	switch cb.State() {
+	case CIRCUIT_CLOSED:
+		cb.failures++
+		if cb.failures >= cb.FailureThreshold {
+			cb.setState(CIRCUIT_OPEN)
+		}
+	case CIRCUIT_HALF_OPEN:
+		cb.releaseProbe()
+		cb.setState(CIRCUIT_OPEN)
+	}
+}
+
+// Releases an allowed request without recording an outcome for it
+func (cb *CircuitBreaker) Cancel() {
+	if cb == nil {
+		return
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	if cb.State() == CIRCUIT_HALF_OPEN {
+		cb.releaseProbe()
+	}
+}
+
+func (cb *CircuitBreaker) releaseProbe() {
+	if cb.probes > 0 {
+		cb.probes--
+	}
+}
+
+// Moves the circuit into the given state. Needs to be called with the lock held
+func (cb *CircuitBreaker) setState(state CircuitState) {
+	previous := cb.State()
+	atomic.StoreInt32(&cb.state, int32(state))
+	cb.failures = 0
+	cb.successes = 0
+	cb.probes = 0
+	if state == CIRCUIT_OPEN {
+		cb.openedAt = time.Now()
+	}
+
+	log.Warn("Circuit for %s changed from %s to %s", cb.Name, previous, state)
+	graphite.Increment("circuit_" + strings.Replace(state.String(), "-", "_", -1))
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"rmux/protocol"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker_Transitions(test *testing.T) {
+	circuitBreaker := NewCircuitBreaker("test", 3, 20*time.Millisecond, 1, 2)
+
+	circuitBreaker.Failure()
+	circuitBreaker.Failure()
+	circuitBreaker.Success()
+	circuitBreaker.Failure()
+	circuitBreaker.Failure()
+	if circuitBreaker.State() != CIRCUIT_CLOSED {
+		test.Fatalf("A success should reset the failure count, circuit is %s", circuitBreaker.State())
+	}
+
+	circuitBreaker.Failure()
+	if circuitBreaker.State() != CIRCUIT_OPEN {
+		test.Fatalf("Circuit should have opened after 3 consecutive failures, circuit is %s", circuitBreaker.State())
+	}
+	if circuitBreaker.Allow() {
+		test.Fatal("An open circuit should not allow requests")
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	if !circuitBreaker.Allow() {
+		test.Fatal("The circuit should allow a probe after the open timeout")
+	}
+	if circuitBreaker.State() != CIRCUIT_HALF_OPEN {
+		test.Fatalf("Circuit should be half-open, but is %s", circuitBreaker.State())
+	}
+	if circuitBreaker.Allow() {
+		test.Fatal("A half-open circuit should only allow one concurrent probe")
+	}
+
+	circuitBreaker.Failure()
+	if circuitBreaker.State() != CIRCUIT_OPEN || circuitBreaker.Allow() {
+		test.Fatalf("A failed probe should open the circuit again, circuit is %s", circuitBreaker.State())
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if !circuitBreaker.Allow() {
+			test.Fatalf("Probe %d should have been allowed", i)
+		}
+		circuitBreaker.Success()
+	}
+	if circuitBreaker.State() != CIRCUIT_CLOSED {
+		test.Fatalf("Circuit should have closed after 2 successful probes, circuit is %s", circuitBreaker.State())
+	}
+}
+
+func TestCircuitBreaker_Cancel(test *testing.T) {
+	circuitBreaker := NewCircuitBreaker("test", 1, 0, 1, 1)
+	circuitBreaker.Failure()
+
+	if !circuitBreaker.Allow() {
+		test.Fatal("The circuit should allow a probe without an open timeout")
+	}
+	circuitBreaker.Cancel()
+	if !circuitBreaker.Allow() {
+		test.Fatal("A cancelled probe should free up its slot")
+	}
+}
+
+func TestCircuitBreaker_Nil(test *testing.T) {
+	var circuitBreaker *CircuitBreaker
+	circuitBreaker.Failure()
+	if !circuitBreaker.Allow() || circuitBreaker.State() != CIRCUIT_CLOSED {
+		test.Fatal("A nil circuit breaker should always allow requests")
+	}
+}
+
+func TestHashRing_CircuitBreakerFailover(test *testing.T) {
+	first := NewConnectionPool("unix", "/tmp/rmuxFirst.sock", 0, time.Second, time.Second, time.Second, time.Hour, "", "")
+	first.CircuitBreaker = NewCircuitBreaker("first", 1, time.Hour, 1, 1)
+	first.SetIsConnected(true)
+	second := NewConnectionPool("unix", "/tmp/rmuxSecond.sock", 0, time.Second, time.Second, time.Second, time.Hour, "", "")
+	second.SetIsConnected(true)
+
+	hashRing, err := NewHashRing([]*ConnectionPool{first, second}, true)
+	if err != nil {
+		test.Fatalf("Should not have errored creating the hash ring: %s", err)
+	}
+
+	// Find a key that hashes to the first pool
+	var command protocol.Command
+	for i := 0; command == nil; i++ {
+		candidate, _ := protocol.ParseCommand([]byte("get key" + string(rune('a'+i)) + "\r\n"))
+		if connectionPool, _ := hashRing.GetConnectionPool(candidate); connectionPool == first {
+			first.RecordSuccess()
+			command = candidate
+		}
+	}
+
+	first.RecordFailure()
+	if connectionPool, err := hashRing.GetConnectionPool(command); err != nil || connectionPool != second {
+		test.Fatalf("Requests should fail over to the second pool while the first circuit is open (%v)", err)
+	}
+
+	hashRing.Failover = false
+	if _, err := hashRing.GetConnectionPool(command); err != ERR_HASHRING_DOWN {
+		test.Fatalf("Requests should fail without failover while the circuit is open, got %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"rmux/graphite"
+	"rmux/log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//Default factor by which a round trip may exceed the average round trip, before it is taken as a sign of overload
+	EXTERN_CONCURRENCY_TOLERANCE = 2.0
+	//Factor the concurrency limit is multiplied by on overload
+	EXTERN_CONCURRENCY_BACKOFF = 0.9
+	//The amount of round trips the average round trip is smoothed over
+	concurrencySmoothing = 100
+)
+
+// Limits how many requests may be in flight to an endpoint at once, adapting the limit to the round trips of the
+// requests. The limit grows by one for every limit's worth of round trips that were not slower than Tolerance times the
+// average round trip, while at least half of it was in use, and shrinks by Backoff for every slower round trip, and
+// every request that failed. It stays between MinLimit and MaxLimit, and starts at MaxLimit.
+// All methods can be called on a nil ConcurrencyLimiter, which does not limit requests.
+type ConcurrencyLimiter struct {
+	// Name used when logging and reporting changes of the limit
+	Name     string
+	MinLimit int
+	MaxLimit int
+	// Round trips longer than Tolerance times the average round trip are taken as a sign of overload
+	Tolerance float64
+	// The factor the limit is multiplied by on overload
+	Backoff float64
+
+	lock   sync.Mutex
+	limit  float64
+	metric string
+	// The average round trip in nanoseconds, or zero before the first one
+	average float64
+}
+
+// Initializes a new concurrency limiter, that does not limit below maxLimit until round trips slow down
+func NewConcurrencyLimiter(name string, minLimit, maxLimit int, tolerance float64) *ConcurrencyLimiter {
+	if minLimit < 1 {
+		minLimit = 1
+	}
+	if maxLimit < minLimit {
+		maxLimit = minLimit
+	}
+	return &ConcurrencyLimiter{
+		Name:      name,
+		MinLimit:  minLimit,
+		MaxLimit:  maxLimit,
+		Tolerance: tolerance,
+		Backoff:   EXTERN_CONCURRENCY_BACKOFF,
+		limit:     float64(maxLimit),
+		metric:    "concurrency_limit." + strings.NewReplacer(".", "-", ":", "-", "/", "-").Replace(name),
+	}
+}
+
+// The amount of requests that may currently be in flight at once, or zero if there is no limit
+func (cl *ConcurrencyLimiter) Limit() int {
+	if cl == nil {
+		return 0
+	}
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	return int(cl.limit)
+}
+
+// Whether another request may be sent while the given amount of requests is in flight
+func (cl *ConcurrencyLimiter) Allows(inFlight int) bool {
+	return cl == nil || inFlight < cl.Limit()
+}
+
+// Adapts the limit to a request that completed with the given round trip, or failed, while the given amount of
+// requests, including it, was in flight
+func (cl *ConcurrencyLimiter) Sample(roundTrip time.Duration, inFlight int, failed bool) {
+	if cl == nil {
+		return
+	}
+
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	previous := int(cl.limit)
+	if failed {
+		cl.limit *= cl.Backoff
+	} else {
+		sample := float64(roundTrip)
+		if cl.average == 0 {
+			cl.average = sample
+		}
+		if sample > cl.Tolerance*cl.average {
+			cl.limit *= cl.Backoff
+		} else if float64(inFlight) >= cl.limit/2 {
+			// Only a limit that is in use is known to be sustainable
+			cl.limit += 1 / cl.limit
+		}
+		cl.average += (sample - cl.average) / concurrencySmoothing
+	}
+
+	if cl.limit < float64(cl.MinLimit) {
+		cl.limit = float64(cl.MinLimit)
+	} else if cl.limit > float64(cl.MaxLimit) {
+		cl.limit = float64(cl.MaxLimit)
+	}
+
+	if current := int(cl.limit); current != previous {
+		log.Debug("Concurrency limit for %s changed from %d to %d", cl.Name, previous, current)
+		graphite.Gauge(cl.metric, current)
+	}
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"net"
+	"os"
+	"rmux/protocol"
+	"rmux/writer"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiter_Sample(test *testing.T) {
+	var disabled *ConcurrencyLimiter
+	if !disabled.Allows(1000) || disabled.Limit() != 0 {
+		test.Fatal("A nil limiter should not limit requests")
+	}
+
+	limiter := NewConcurrencyLimiter("test", 2, 10, 2)
+	if limiter.Limit() != 10 || !limiter.Allows(9) || limiter.Allows(10) {
+		test.Fatalf("Expected the limit to start at its maximum, got %d", limiter.Limit())
+	}
+
+	// Round trips within the tolerance keep the limit at its maximum
+	for i := 0; i < 100; i++ {
+		limiter.Sample(time.Millisecond, 10, false)
+	}
+	if limiter.Limit() != 10 {
+		test.Fatalf("Expected the limit to stay at its maximum, got %d", limiter.Limit())
+	}
+
+	limiter.Sample(5*time.Millisecond, 10, false)
+	if limiter.Limit() != 9 {
+		test.Errorf("Expected a slow round trip to lower the limit, got %d", limiter.Limit())
+	}
+	for i := 0; i < 20; i++ {
+		limiter.Sample(0, 5, true)
+	}
+	if limiter.Limit() != 2 {
+		test.Errorf("Expected failures to lower the limit down to its minimum, got %d", limiter.Limit())
+	}
+
+	// The limit only grows while it is in use
+	for i := 0; i < 10; i++ {
+		limiter.Sample(time.Millisecond, 0, false)
+	}
+	if limiter.Limit() != 2 {
+		test.Errorf("Expected an unused limit to stay, got %d", limiter.Limit())
+	}
+	for i := 0; i < 10; i++ {
+		limiter.Sample(time.Millisecond, 2, false)
+	}
+	if limiter.Limit() <= 2 {
+		test.Errorf("Expected fast round trips to raise the limit, got %d", limiter.Limit())
+	}
+}
+
+func TestGetConnection_ConcurrencyLimit(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, _ := _listenPongSocket(test, testSocket)
+	defer listenSock.Close()
+
+	timeout := 100 * time.Millisecond
+	connectionPool := NewConnectionPool("unix", testSocket, 2, timeout, timeout, timeout, time.Hour, "", "")
+	connectionPool.WaitTimeout = time.Second
+	connectionPool.ConcurrencyLimiter = NewConcurrencyLimiter("test", 1, 2, 2)
+	for i := 0; i < 2; i++ {
+		connectionPool.ConcurrencyLimiter.Sample(0, 2, true)
+	}
+
+	connection, err := connectionPool.GetConnection()
+	if err != nil {
+		test.Fatalf("Failed to get a connection: %s", err)
+	}
+
+	// A connection is idle, but the limit makes the next client wait
+	served := make(chan *Connection)
+	go func() {
+		waitingConnection, _ := connectionPool.GetConnection()
+		served <- waitingConnection
+	}()
+	for connectionPool.Waiting() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if connectionPool.IdleCount() != 1 {
+		test.Errorf("Expected a connection to stay idle, got %d", connectionPool.IdleCount())
+	}
+
+	connectionPool.RecycleRemoteConnection(connection)
+	if waitingConnection := <-served; waitingConnection == nil {
+		test.Fatal("Expected the waiting client to be served once the connection was recycled")
+	} else {
+		connectionPool.RecycleRemoteConnection(waitingConnection)
+	}
+}
+
+func TestConnection_TakeRoundTrip(test *testing.T) {
+	connection := NewConnection("unix", "/tmp/rmuxConnectionTest", time.Second, time.Second, time.Second, time.Hour, "", "")
+
+	connection.ExpectResponses(2)
+	time.Sleep(5 * time.Millisecond)
+	connection.ResponsesRead(1)
+	if roundTrip, _ := connection.takeRoundTrip(); roundTrip != 0 {
+		test.Errorf("Expected no round trip while responses are pending, got %s", roundTrip)
+	}
+	connection.ResponsesRead(1)
+	if roundTrip, failed := connection.takeRoundTrip(); roundTrip < 5*time.Millisecond || failed {
+		test.Errorf("Expected a round trip of at least 5ms, got %s, %v", roundTrip, failed)
+	}
+
+	connection.ExpectResponses(1)
+	connection.Disconnect()
+	if roundTrip, failed := connection.takeRoundTrip(); roundTrip != 0 || !failed {
+		test.Errorf("Expected the disconnected request to have failed, got %s, %v", roundTrip, failed)
+	}
+}
+
+// A writer that takes a millisecond for every write, like a slow client
+type slowWriter struct{}
+
+func (slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return len(p), nil
+}
+
+func TestGetConnection_ConcurrencyLimitLargeResponses(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	os.Remove(testSocket)
+	listenSock, err := net.Listen("unix", testSocket)
+	if err != nil {
+		test.Fatalf("Failed to listen on test socket %s: %s", testSocket, err)
+	}
+	defer listenSock.Close()
+
+	// Answers "get large" with a large bulk string, and any other command with a short status, after 2ms like a server
+	// under some load
+	large := []byte("$1000000\r\n" + strings.Repeat("a", 1000000) + "\r\n")
+	go func() {
+		for {
+			fd, err := listenSock.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer fd.Close()
+				scanner := protocol.NewRespScanner(fd)
+				for scanner.Scan() {
+					command, err := protocol.ParseCommand(scanner.Bytes())
+					if err != nil {
+						return
+					}
+					time.Sleep(2 * time.Millisecond)
+					if string(command.GetFirstArg()) == "large" {
+						fd.Write(large)
+					} else {
+						fd.Write([]byte("+small\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+
+	timeout := time.Second
+	connectionPool := NewConnectionPool("unix", testSocket, 4, timeout, timeout, timeout, time.Hour, "", "")
+	// A generous tolerance keeps the noise of sleeping from lowering the limit
+	connectionPool.ConcurrencyLimiter = NewConcurrencyLimiter("test", 1, 4, 4)
+
+	// The large responses take the slow client much longer to receive than the small ones, but not the server to send
+	for i := 0; i < 25; i++ {
+		key := "small"
+		if i%5 == 4 {
+			key = "large"
+		}
+		connection, err := connectionPool.GetConnection()
+		if err != nil {
+			test.Fatalf("Failed to get a connection: %s", err)
+		}
+		connection.Writer.Write([]byte("*2\r\n$3\r\nget\r\n$" + string(rune('0'+len(key))) + "\r\n" + key + "\r\n"))
+		connection.ExpectResponses(1)
+		connection.Writer.Flush()
+		if _, err := protocol.CopyServerResponsesWithStatus(connection.Reader, writer.NewFlexibleWriter(slowWriter{}), 1); err != nil {
+			test.Fatalf("Failed to copy the response: %s", err)
+		}
+		connection.ResponsesRead(1)
+		connectionPool.RecycleRemoteConnection(connection)
+	}
+
+	if limit := connectionPool.ConcurrencyLimiter.Limit(); limit != 4 {
+		test.Errorf("Expected large responses to a slow client to keep the limit at 4, got %d", limit)
+	}
+}
@@ -28,8 +28,11 @@ package connection
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"net"
 	"rmux/graphite"
 	"rmux/log"
@@ -51,13 +54,27 @@ type Connection struct {
 
 	protocol          string
 	endpoint          string
-	authUser          string
-	authPassword      string
+	credentials       *Credentials
+	authGeneration    uint64
 	connectTimeout    time.Duration
 	readTimeout       time.Duration
 	writeTimeout      time.Duration
 	reconnectInterval time.Duration
+	reconnectJitter   time.Duration
 	nextReconnect     time.Time
+	tlsConfig         *tls.Config
+	// When the connection was last known to be working, by connecting, a PING or being recycled after a request
+	lastUsed time.Time
+	// Responses that were requested from the server, but not read yet
+	pendingResponses int
+	// When the pending responses were requested, when the first of them arrived, the round trip of the last requests
+	// whose responses were all read, and whether requests were disconnected before their responses were read
+	requestedAt     time.Time
+	firstResponseAt time.Time
+	roundTrip       time.Duration
+	requestsFailed  bool
+	// Why the connection is known to be out of sync with its server, if it is
+	outOfSync error
 }
 
 // Initializes a new connection, of the given protocol and endpoint, with the given connection timeout
@@ -67,8 +84,7 @@ func NewConnection(Protocol, Endpoint string, ConnectTimeout, ReadTimeout, Write
 	c := &Connection{}
 	c.protocol = Protocol
 	c.endpoint = Endpoint
-	c.authUser = authUser
-	c.authPassword = authPassword
+	c.credentials = NewCredentials(authUser, authPassword)
 	c.connectTimeout = ConnectTimeout
 	c.readTimeout = ReadTimeout
 	c.writeTimeout = WriteTimeout
@@ -86,32 +102,155 @@ func (c *Connection) Disconnect() {
 	c.DatabaseId = 0
 	c.Reader = nil
 	c.Writer = nil
+	if c.pendingResponses > 0 {
+		c.requestsFailed = true
+	}
+	c.pendingResponses = 0
+	c.requestedAt = time.Time{}
+	c.firstResponseAt = time.Time{}
+	c.outOfSync = nil
+}
+
+// Records that the given amount of responses was requested from the server
+// They have to be read, and recorded with ResponsesRead, before the connection can be reused
+func (c *Connection) ExpectResponses(count int) {
+	if c.pendingResponses == 0 {
+		c.requestedAt = time.Now()
+	}
+	c.pendingResponses += count
+}
+
+// Records that the given amount of requested responses was read from the server
+// The round trip lasts until the first response arrived, since the responses are copied to the client while they are
+// read, and neither a slow client nor a large response says anything about the load of the server
+func (c *Connection) ResponsesRead(count int) {
+	c.pendingResponses -= count
+	if c.pendingResponses == 0 && !c.requestedAt.IsZero() {
+		if c.firstResponseAt.IsZero() {
+			c.roundTrip = time.Since(c.requestedAt)
+		} else {
+			c.roundTrip = c.firstResponseAt.Sub(c.requestedAt)
+		}
+		c.requestedAt = time.Time{}
+		c.firstResponseAt = time.Time{}
+	}
+}
+
+// An error dialing the server, as opposed to one of a server that answered, like a rejected AUTH
+type dialError struct {
+	error
+}
+
+func (this dialError) Unwrap() error {
+	return this.error
+}
+
+// Whether the given error, returned while connecting, came from dialing the server
+func isDialError(err error) bool {
+	return errors.As(err, &dialError{})
+}
+
+// Notes when the first data arrives from the server after responses were requested
+type responseTimer struct {
+	reader     io.Reader
+	connection *Connection
+}
+
+func (this *responseTimer) Read(p []byte) (n int, err error) {
+	n, err = this.reader.Read(p)
+	if n > 0 && !this.connection.requestedAt.IsZero() && this.connection.firstResponseAt.IsZero() {
+		this.connection.firstResponseAt = time.Now()
+	}
+	return
+}
+
+// Returns and clears the round trip of the last requests whose responses were all read, and whether requests were
+// disconnected before their responses were read
+func (c *Connection) takeRoundTrip() (roundTrip time.Duration, failed bool) {
+	roundTrip, failed = c.roundTrip, c.requestsFailed
+	c.roundTrip, c.requestsFailed = 0, false
+	return
+}
+
+// Marks the connection as out of sync with its server, so that it is discarded instead of reused
+func (c *Connection) MarkOutOfSync(err error) {
+	c.outOfSync = err
+}
+
+// Describes why the connection can not be reused without handing someone else's responses to the next client, or
+// returns an empty string if it can be reused
+func (c *Connection) outOfSyncReason() string {
+	if c.connection == nil {
+		return ""
+	} else if c.outOfSync != nil {
+		return c.outOfSync.Error()
+	} else if c.pendingResponses != 0 {
+		return fmt.Sprintf("%d requested responses were not read", c.pendingResponses)
+	} else if buffered := c.Reader.Buffered(); buffered > 0 {
+		if buffered > protocol.UNEXPECTED_DATA_SAMPLE_SIZE {
+			buffered = protocol.UNEXPECTED_DATA_SAMPLE_SIZE
+		}
+		sample, _ := c.Reader.Peek(buffered)
+		return fmt.Sprintf("%d bytes were not read: %q", c.Reader.Buffered(), sample)
+	}
+	return ""
 }
 
+// Makes sure the connection is connected and authenticated with the current credentials, probing it first
 func (c *Connection) ReconnectIfNecessary() (err error) {
-	if c.IsConnected() && time.Now().Before(c.nextReconnect) {
-		return nil
+	return c.reconnectIfNecessary(0)
+}
+
+// Makes sure the connection is connected and authenticated with the current credentials
+// Connections that were used within idleValidationThreshold are trusted to still be up; only the ones idle for longer
+// are probed, which keeps the probe's syscall off the path of busy connections
+func (c *Connection) reconnectIfNecessary(idleValidationThreshold time.Duration) (err error) {
+	if c.connection != nil && time.Now().Before(c.nextReconnect) &&
+		(!c.isIdle(idleValidationThreshold) || c.IsConnected()) {
+		if c.authGeneration == c.credentials.Generation() {
+			return nil
+		}
+
+		// The credentials were rotated since this connection authenticated, so authenticate again
+		if err = c.authenticate(); err == nil {
+			log.Info("Re-authenticated a connection to %s after a credential change", c.endpoint)
+			graphite.Increment("reauthenticate")
+			return nil
+		}
+		log.Error("Re-authentication against %s failed, reconnecting: %s", c.endpoint, err)
 	}
 
 	// If it's not connected, manually disconnect the connection for sanity's sake
 	c.Disconnect()
 
-	c.connection, err = net.DialTimeout(c.protocol, c.endpoint, c.connectTimeout)
+	// TCP keepalive lets the kernel detect dead peers of idle connections, without probing them on checkout
+	dialer := &net.Dialer{Timeout: c.connectTimeout, KeepAlive: EXTERN_KEEPALIVE_PERIOD}
+	if c.tlsConfig != nil {
+		c.connection, err = tls.DialWithDialer(dialer, c.protocol, c.endpoint, c.tlsConfig)
+	} else {
+		c.connection, err = dialer.Dial(c.protocol, c.endpoint)
+	}
 	if err != nil {
 		c.connection = nil
-		return err
+		return dialError{err}
 	}
 
 	netReadWriter := protocol.NewTimedNetReadWriter(c.connection, c.readTimeout, c.writeTimeout)
 	c.DatabaseId = 0
 	c.Writer = writer.NewFlexibleWriter(netReadWriter)
-	c.Reader = bufio.NewReader(netReadWriter)
+	c.Reader = bufio.NewReader(&responseTimer{reader: netReadWriter, connection: c})
 
 	if err = c.authenticate(); err != nil {
 		return fmt.Errorf("authentication failed: %w", err)
 	}
 
-	c.nextReconnect = time.Now().Add(c.reconnectInterval)
+	c.lastUsed = time.Now()
+	// Connections dialed at the same time, like at startup, should not all reconnect at the same time again
+	lifetime := c.reconnectInterval
+	if c.reconnectJitter > 0 {
+		lifetime -= time.Duration(rand.Int63n(int64(c.reconnectJitter)))
+	}
+	c.nextReconnect = c.lastUsed.Add(lifetime)
 	log.Debug("Connected a connection")
 
 	return nil
@@ -150,17 +289,23 @@ func (this *Connection) authenticate() error {
 		return errors.New("authenticating against an invalid connection")
 	}
 
-	if this.authPassword == "" {
+	authUser, authPassword, generation, err := this.credentials.Get()
+	if err != nil {
+		return err
+	}
+
+	if authPassword == "" {
+		this.authGeneration = generation
 		return nil
 	}
 
-	authCommand := fmt.Sprintf("AUTH %s", this.authPassword)
+	authCommand := fmt.Sprintf("AUTH %s", authPassword)
 
-	if this.authUser != "" {
-		authCommand = fmt.Sprintf("AUTH %s %s", this.authUser, this.authPassword)
+	if authUser != "" {
+		authCommand = fmt.Sprintf("AUTH %s %s", authUser, authPassword)
 	}
 
-	err := protocol.WriteLine([]byte(authCommand), this.Writer, true)
+	err = protocol.WriteLine([]byte(authCommand), this.Writer, true)
 	if err != nil {
 		return fmt.Errorf("flush line failed: %w", err)
 	}
@@ -174,6 +319,8 @@ func (this *Connection) authenticate() error {
 		this.Disconnect()
 		return fmt.Errorf("invalid authentication response: err:%q Response:%q isPrefix:%t", err, line, isPrefix)
 	}
+
+	this.authGeneration = generation
 	return nil
 }
 
@@ -203,6 +350,7 @@ func (myConnection *Connection) CheckConnection() bool {
 	line, isPrefix, err := myConnection.Reader.ReadLine()
 
 	if err == nil && !isPrefix && bytes.Equal(line, protocol.PONG_RESPONSE) {
+		myConnection.lastUsed = time.Now()
 		return true
 	} else {
 		if err != nil {
@@ -218,6 +366,24 @@ func (myConnection *Connection) CheckConnection() bool {
 	}
 }
 
+// Whether the connection is connected, but has outlived its reconnect interval, or authenticated with credentials that
+// were rotated since
+func (c *Connection) isStale() bool {
+	return c.isExpired() || (c.connection != nil && c.authGeneration != c.credentials.Generation())
+}
+
+// Whether the connection is connected, but has outlived its reconnect interval
+func (c *Connection) isExpired() bool {
+	return c.connection != nil && !time.Now().Before(c.nextReconnect)
+}
+
+// Whether the connection has not been known to work for longer than the given threshold
+func (c *Connection) isIdle(threshold time.Duration) bool {
+	return time.Since(c.lastUsed) >= threshold
+}
+
+// Probes whether the connection is still up, by reading from it with a very short deadline
+// This costs a syscall, so it is only used for connections that have been idle for a while
 func (c *Connection) IsConnected() bool {
 	if c.connection == nil {
 		return false
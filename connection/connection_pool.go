@@ -26,9 +26,13 @@
 package connection
 
 import (
+	"container/list"
+	"crypto/tls"
 	"errors"
+	"math/rand"
 	"rmux/graphite"
 	"rmux/log"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -44,6 +48,73 @@ const (
 	EXTERN_WRITE_TIMEOUT = time.Millisecond * 500
 	// Default reconnect interval, for connection pools. Can be adjusted on individual pools after initialization
 	EXTERN_RECONNECT_INTERVAL = time.Hour * 24
+	// Default interval between the health checks of a connection pool
+	EXTERN_HEALTH_CHECK_INTERVAL = time.Second
+	// Default amount of consecutive failed health checks that mark a connection pool down
+	EXTERN_HEALTH_FAILURE_THRESHOLD = 1
+	// Default amount of consecutive successful health checks that mark a connection pool up again
+	EXTERN_HEALTH_SUCCESS_THRESHOLD = 1
+	// Default idle time after which a pooled connection is probed before it is handed out
+	EXTERN_IDLE_VALIDATION_THRESHOLD = 5 * time.Second
+	// Default interval in which idle pooled connections are pinged in the background
+	EXTERN_IDLE_PING_INTERVAL = 30 * time.Second
+	// TCP keepalive period of connections to redis servers
+	EXTERN_KEEPALIVE_PERIOD = 30 * time.Second
+	// Unless configured otherwise, connections reconnect up to a tenth of the reconnect interval early
+	EXTERN_RECONNECT_JITTER_DIVISOR = 10
+	// Default time a client waits for a free connection
+	EXTERN_POOL_WAIT_TIMEOUT = time.Second
+	// Default delay before a pool whose server could not be dialed is probed for the first time
+	EXTERN_DIAL_BACKOFF_MIN = 100 * time.Millisecond
+	// Default maximum delay between the probes of a pool whose server could not be dialed
+	EXTERN_DIAL_BACKOFF_MAX = 10 * time.Second
+	// Default time after which a checkout is reported as too long
+	EXTERN_LONG_CHECKOUT_THRESHOLD = 5 * time.Second
+)
+
+// Who asks for a connection from a pool, and for which database
+type ConnectionRequest struct {
+	//The database the connection should have selected, or DEFAULT_DATABASE for any database
+	DatabaseId int
+	//Describes the client that will hold the connection, for diagnostics
+	Owner string
+	//The priority class of the client.  Waiting clients of higher classes are served first, and lower classes are shed
+	//first when too many clients are waiting
+	Priority int
+}
+
+// A connection that is currently checked out of a pool
+type Checkout struct {
+	//The client holding the connection
+	Owner string
+	//The database the connection had selected when it was checked out
+	DatabaseId int
+	//When the connection was checked out
+	Since time.Time
+}
+
+// The pool's own record of a checked out connection, since the fields of the connection belong to its holder
+type checkoutRecord struct {
+	Checkout
+	//Whether the checkout has been reported as too long
+	reported bool
+}
+
+// A client waiting for a connection
+type poolWaiter struct {
+	ready    chan *Connection
+	owner    string
+	priority int
+	// The database the waiter is going to use, which it preferably gets a connection for
+	databaseId int
+	// Whether the waiter was turned away to make room for a client of a higher priority class.  Guarded by the pool's lock
+	shed bool
+}
+
+var (
+	ERR_POOL_TIMEOUT    = errors.New("timeout while waiting for a new connection")
+	ERR_POOL_QUEUE_FULL = errors.New("too many clients waiting for a connection")
+	ERR_POOL_BACKOFF    = errors.New("backing off from a server that could not be dialed")
 )
 
 // A pool of connections to a single outbound redis server
@@ -56,6 +127,8 @@ type ConnectionPool struct {
 	AuthUser string
 	//Password to use for authentication against the upstream redis server(s).
 	AuthPassword string
+	//The resolved AuthUser and AuthPassword, shared by all connections of this pool
+	credentials *Credentials
 	//And overridable connect timeout.  Defaults to EXTERN_CONNECT_TIMEOUT
 	ConnectTimeout time.Duration
 	//An overridable read timeout.  Defaults to EXTERN_READ_TIMEOUT
@@ -64,8 +137,72 @@ type ConnectionPool struct {
 	WriteTimeout time.Duration
 	//An overridable reconnection interval. Defaults to EXTERN_RECONNECT_INTERVAL
 	ReconnectInterval time.Duration
-	//channel of recycled connections, for re-use
-	connectionPool chan *Connection
+	//Up to how much earlier than ReconnectInterval a connection is reconnected.  Defaults to a tenth of ReconnectInterval
+	ReconnectJitter time.Duration
+	//The amount of idle connections that are dialed ahead of time, and kept connected while idle
+	MinIdle int
+	//Idle time after which connections beyond MinIdle are closed.  Zero keeps idle connections connected
+	MaxIdleTime time.Duration
+	//Connections dialed ahead of time to keep MinIdle connections connected.  Updated atomically
+	WarmUpDials uint64
+	//Connections closed for being idle for longer than MaxIdleTime.  Updated atomically
+	IdleCloses uint64
+	//Connections closed for outliving their ReconnectInterval.  Updated atomically
+	Expirations uint64
+	//The database that clients use until they select another one
+	Database int
+	//The share of the hash ring this pool receives, relative to the other pools
+	Weight int
+	//TLS settings, or nil for plain text connections
+	TLSConfig *tls.Config
+	//Guards idle and waiters
+	lock sync.Mutex
+	//Connections that are not checked out, by the database they have selected
+	idle *idleConnections
+	//The clients waiting for a connection, in order of arrival
+	waiters list.List
+	//The connections that are currently checked out
+	checkedOut map[*Connection]*checkoutRecord
+	//Time after which a checkout is reported as too long.  Zero disables the reports
+	LongCheckoutThreshold time.Duration
+	//Checkouts that were held for longer than LongCheckoutThreshold.  Updated atomically
+	LongCheckouts uint64
+	//The amount of connections shared by all clients for stateless requests.  Zero gives every request a connection of
+	//its own.  Has to be set before the first request
+	SharedConnections int
+	shared            []*SharedConnection
+	sharedOnce        sync.Once
+	sharedNext        uint32
+	//Requests that were sent over shared connections.  Updated atomically
+	SharedRequests uint64
+	//Time a client waits for a free connection.  Defaults to EXTERN_POOL_WAIT_TIMEOUT
+	WaitTimeout time.Duration
+	//The amount of clients that may wait for a free connection at once.  Zero lets any amount of clients wait
+	MaxWaiters int
+	//Checkouts that got a connection on the requested database, where any connection would have needed a SELECT.
+	//Updated atomically
+	SelectsSaved uint64
+	//Connections that were discarded instead of reused, because they were out of sync with their server.
+	//Updated atomically
+	Desyncs uint64
+	//Checkouts that had to wait for a free connection.  Updated atomically
+	Waits uint64
+	//Checkouts that timed out waiting for a free connection.  Updated atomically
+	WaitTimeouts uint64
+	//Checkouts that failed right away, because MaxWaiters clients were already waiting.  Updated atomically
+	QueueRejections uint64
+	//Waiting checkouts that were turned away for a checkout of a higher priority class.  Updated atomically
+	Sheds uint64
+	//Delay before the first probe after a failed dial.  Doubles with every failed probe.  Defaults to EXTERN_DIAL_BACKOFF_MIN
+	DialBackoffMin time.Duration
+	//Maximum delay between probes after failed dials.  Defaults to EXTERN_DIAL_BACKOFF_MAX
+	DialBackoffMax time.Duration
+	//Consecutive failed dials.  While non-zero, checkouts fail right away and a single prober dials the server
+	dialFailures int32
+	//Whether a prober is running
+	probing int32
+	//Checkouts that failed right away, because the pool was backing off.  Updated atomically
+	BackoffRejections uint64
 	// The connection used for diagnostics (like checking that the pool is up)
 	diagnosticConnection     *Connection
 	diagnosticConnectionLock sync.Mutex
@@ -74,58 +211,323 @@ type ConnectionPool struct {
 	connectedLock sync.RWMutex
 	// Whether or not the connction pool is up or down
 	isConnected bool
+	//Interval between the health checks of this pool
+	HealthCheckInterval time.Duration
+	//Consecutive failed health checks that mark this pool down.  Defaults to EXTERN_HEALTH_FAILURE_THRESHOLD
+	HealthFailureThreshold int
+	//Consecutive successful health checks that mark this pool up again.  Defaults to EXTERN_HEALTH_SUCCESS_THRESHOLD
+	HealthSuccessThreshold int
+	//Idle time after which a pooled connection is probed before it is handed out.  Defaults to EXTERN_IDLE_VALIDATION_THRESHOLD
+	IdleValidationThreshold time.Duration
+	//Interval in which idle connections are pinged in the background.  Defaults to EXTERN_IDLE_PING_INTERVAL
+	IdlePingInterval time.Duration
+	// Whether a health check has completed yet.  Until then the first result decides the state of the pool
+	healthChecked bool
+	// Consecutive health check results that disagree with the current state of the pool
+	healthStreak int
+	// Circuit breaker fed by the outcome of client requests, or nil if disabled
+	CircuitBreaker *CircuitBreaker
+	// Limits how many connections may be checked out at once by the round trips of their requests, or nil if disabled.
+	// Clients beyond the limit wait for a connection like they do when all connections are checked out
+	ConcurrencyLimiter *ConcurrencyLimiter
 }
 
 // Initialize a new connection pool, for the given protocol/endpoint, with a given pool capacity
 // ex: "unix", "/tmp/myAwesomeSocket", 5
-func NewConnectionPool(Protocol, Endpoint string, poolCapacity int, connectTimeout time.Duration,
+func NewConnectionPool(Protocol, Address string, poolCapacity int, connectTimeout time.Duration,
 	readTimeout time.Duration, writeTimeout time.Duration, reconnectInterval time.Duration, authUser string,
 	authPassword string) (newConnectionPool *ConnectionPool) {
+	return NewEndpointConnectionPool(&Endpoint{
+		Protocol:          Protocol,
+		Address:           Address,
+		AuthUser:          authUser,
+		AuthPassword:      authPassword,
+		PoolSize:          poolCapacity,
+		ConnectTimeout:    connectTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		ReconnectInterval: reconnectInterval,
+	})
+}
+
+// Initialize a new connection pool for the given endpoint. All of the endpoint's settings are used as they are, so
+// defaults need to be filled in by the caller
+func NewEndpointConnectionPool(endpoint *Endpoint) (newConnectionPool *ConnectionPool) {
 	newConnectionPool = &ConnectionPool{}
-	newConnectionPool.Protocol = Protocol
-	newConnectionPool.Endpoint = Endpoint
-	newConnectionPool.AuthUser = authUser
-	newConnectionPool.AuthPassword = authPassword
-	newConnectionPool.connectionPool = make(chan *Connection, poolCapacity)
-	newConnectionPool.ConnectTimeout = connectTimeout
-	newConnectionPool.ReadTimeout = readTimeout
-	newConnectionPool.WriteTimeout = writeTimeout
-	newConnectionPool.ReconnectInterval = reconnectInterval
+	newConnectionPool.Protocol = endpoint.Protocol
+	newConnectionPool.Endpoint = endpoint.Address
+	newConnectionPool.AuthUser = endpoint.AuthUser
+	newConnectionPool.AuthPassword = endpoint.AuthPassword
+	newConnectionPool.credentials = NewCredentials(endpoint.AuthUser, endpoint.AuthPassword)
+	newConnectionPool.idle = newIdleConnections()
+	newConnectionPool.checkedOut = make(map[*Connection]*checkoutRecord)
+	newConnectionPool.LongCheckoutThreshold = EXTERN_LONG_CHECKOUT_THRESHOLD
+	newConnectionPool.WaitTimeout = EXTERN_POOL_WAIT_TIMEOUT
+	newConnectionPool.DialBackoffMin = EXTERN_DIAL_BACKOFF_MIN
+	newConnectionPool.DialBackoffMax = EXTERN_DIAL_BACKOFF_MAX
+	newConnectionPool.ConnectTimeout = endpoint.ConnectTimeout
+	newConnectionPool.ReadTimeout = endpoint.ReadTimeout
+	newConnectionPool.WriteTimeout = endpoint.WriteTimeout
+	newConnectionPool.ReconnectInterval = endpoint.ReconnectInterval
+	newConnectionPool.ReconnectJitter = endpoint.ReconnectJitter
+	if newConnectionPool.ReconnectJitter == 0 {
+		newConnectionPool.ReconnectJitter = endpoint.ReconnectInterval / EXTERN_RECONNECT_JITTER_DIVISOR
+	} else if newConnectionPool.ReconnectJitter > endpoint.ReconnectInterval {
+		newConnectionPool.ReconnectJitter = endpoint.ReconnectInterval
+	}
+	newConnectionPool.MinIdle = endpoint.MinIdle
+	if newConnectionPool.MinIdle > endpoint.PoolSize {
+		newConnectionPool.MinIdle = endpoint.PoolSize
+	}
+	newConnectionPool.Database = endpoint.Database
+	newConnectionPool.Weight = endpoint.Weight
+	newConnectionPool.TLSConfig = endpoint.TLSConfig
+	newConnectionPool.HealthCheckInterval = endpoint.HealthCheckInterval
+	if newConnectionPool.HealthCheckInterval <= 0 {
+		newConnectionPool.HealthCheckInterval = EXTERN_HEALTH_CHECK_INTERVAL
+	}
+	newConnectionPool.IdleValidationThreshold = EXTERN_IDLE_VALIDATION_THRESHOLD
+	newConnectionPool.IdlePingInterval = EXTERN_IDLE_PING_INTERVAL
+	newConnectionPool.HealthFailureThreshold = EXTERN_HEALTH_FAILURE_THRESHOLD
+	newConnectionPool.HealthSuccessThreshold = EXTERN_HEALTH_SUCCESS_THRESHOLD
 	newConnectionPool.Count = 0
 
 	// Fill the pool with as many handlers as it asks for
-	for i := 0; i < poolCapacity; i++ {
-		newConnectionPool.connectionPool <- newConnectionPool.CreateConnection()
+	for i := 0; i < endpoint.PoolSize; i++ {
+		newConnectionPool.idle.push(newConnectionPool.CreateConnection())
 	}
 
 	newConnectionPool.diagnosticConnection = newConnectionPool.CreateConnection()
+	if endpoint.HealthCheckTimeout > 0 {
+		// Health checks use their own timeout, so that a hung server is detected independently of the request timeouts
+		newConnectionPool.diagnosticConnection.connectTimeout = endpoint.HealthCheckTimeout
+		newConnectionPool.diagnosticConnection.readTimeout = endpoint.HealthCheckTimeout
+		newConnectionPool.diagnosticConnection.writeTimeout = endpoint.HealthCheckTimeout
+	}
 
 	return
 }
 
-// Gets a connection from the connection pool
+// Gets a connection from the connection pool, on any database
 func (cp *ConnectionPool) GetConnection() (connection *Connection, err error) {
-	select {
-	case connection = <-cp.connectionPool:
-		atomic.AddInt32(&cp.Count, 1)
+	return cp.GetConnectionFor(ConnectionRequest{DatabaseId: DEFAULT_DATABASE})
+}
+
+// Gets a connection from the connection pool, preferring one that has the given database selected already, so that
+// clients using several databases do not pay for a SELECT on every request
+// If no connection is free, waits up to WaitTimeout for one, behind the clients of the same or a higher priority class
+// that are already waiting. If MaxWaiters clients are already waiting, the newest waiter of the lowest priority class is
+// turned away with ERR_POOL_QUEUE_FULL if its class is lower than the request's, and the request fails right away with
+// ERR_POOL_QUEUE_FULL otherwise.
+// After a connection could not be dialed, fails right away with ERR_POOL_BACKOFF, until the prober dialed the server.
+// A connection that was used recently is handed out as it is; liveness of idle connections is tracked in the background
+// by CheckIdleConnections, and on checkout only for connections that have been idle for longer than
+// IdleValidationThreshold
+func (cp *ConnectionPool) GetConnectionFor(request ConnectionRequest) (connection *Connection, err error) {
+	if cp.InBackoff() {
+		atomic.AddUint64(&cp.BackoffRejections, 1)
+		return nil, ERR_POOL_BACKOFF
+	}
+
+	cp.lock.Lock()
+	if cp.idle.len() > 0 && cp.waiters.Len() == 0 && cp.ConcurrencyLimiter.Allows(len(cp.checkedOut)) {
+		var selectSaved bool
+		connection, selectSaved = cp.idle.pop(request.DatabaseId)
+		cp.checkOutLocked(connection, request.Owner)
+		cp.lock.Unlock()
+		if selectSaved {
+			atomic.AddUint64(&cp.SelectsSaved, 1)
+			graphite.Increment("select_saved")
+		}
+	} else if cp.MaxWaiters > 0 && cp.waiters.Len() >= cp.MaxWaiters && !cp.shedWaiterLocked(request.Priority) {
+		cp.lock.Unlock()
+		atomic.AddUint64(&cp.QueueRejections, 1)
+		graphite.Increment("pool_queue_full")
+		return nil, ERR_POOL_QUEUE_FULL
+	} else {
+		waiter := &poolWaiter{
+			ready:      make(chan *Connection, 1),
+			owner:      request.Owner,
+			priority:   request.Priority,
+			databaseId: request.DatabaseId,
+		}
+		element := cp.enqueueWaiterLocked(waiter)
+		cp.lock.Unlock()
+
+		if connection = cp.waitForConnection(waiter, element); connection == nil {
+			if waiter.shed {
+				return nil, ERR_POOL_QUEUE_FULL
+			}
+			return nil, ERR_POOL_TIMEOUT
+		}
+	}
+
+	atomic.AddInt32(&cp.Count, 1)
+
+	if connection.isExpired() {
+		cp.expireConnection(connection)
+	}
+
+	if err := connection.reconnectIfNecessary(cp.IdleValidationThreshold); err != nil {
+		// Recycle the holder, return an error
+		cp.RecycleRemoteConnection(connection)
+		log.Error("Received a nil connection in pool.GetConnection: %s", err)
+		graphite.Increment("reconnect_error")
+		// Only an unreachable server is backed off from; rejected credentials are left to the credential refresh
+		if isDialError(err) {
+			cp.recordDialFailure(err)
+		}
+		return nil, err
+	}
+
+	return connection, nil
+}
+
+// Whether the pool is backing off from a server that could not be dialed
+func (cp *ConnectionPool) InBackoff() bool {
+	return atomic.LoadInt32(&cp.dialFailures) > 0
+}
+
+// Puts the pool into backoff after a failed dial, and starts the prober unless it is running already
+func (cp *ConnectionPool) recordDialFailure(err error) {
+	if atomic.AddInt32(&cp.dialFailures, 1) == 1 {
+		log.Warn("Backing off from %s:%s after a failed dial: %s", cp.Protocol, cp.Endpoint, err)
+		graphite.Increment("dial_backoff")
+	}
+
+	if atomic.CompareAndSwapInt32(&cp.probing, 0, 1) {
+		go cp.probeUntilReachable()
+	}
+}
+
+// The delay before the next probe, after the given amount of consecutive failed dials
+// The delay grows exponentially up to DialBackoffMax, and a random half of it is jitter, so that pools of several
+// rmux instances do not probe a recovering server in lockstep
+func (cp *ConnectionPool) backoffDelay(failures int32) time.Duration {
+	delay := cp.DialBackoffMin
+	for i := int32(1); i < failures && delay < cp.DialBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > cp.DialBackoffMax {
+		delay = cp.DialBackoffMax
+	}
+	if delay < 2 {
+		return delay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+// Dials the server of this pool with backoff until a dial succeeds, which ends the backoff of the pool
+// This is the only dialing that happens while the pool is backing off
+func (cp *ConnectionPool) probeUntilReachable() {
+	defer atomic.StoreInt32(&cp.probing, 0)
+
+	probe := cp.CreateConnection()
+	for {
+		time.Sleep(cp.backoffDelay(atomic.LoadInt32(&cp.dialFailures)))
+
+		// A server that answers ends the backoff, even if it rejects the credentials
+		err := probe.ReconnectIfNecessary()
+		if err == nil || !isDialError(err) {
+			probe.Disconnect()
+			failures := atomic.SwapInt32(&cp.dialFailures, 0)
+			log.Info("Dialed %s:%s again after %d failed dials, ending the backoff", cp.Protocol, cp.Endpoint, failures)
+			graphite.Increment("dial_recovered")
+			return
+		}
 
-		if err := connection.ReconnectIfNecessary(); err != nil {
-			// Recycle the holder, return an error
-			cp.RecycleRemoteConnection(connection)
-			log.Error("Received a nil connection in pool.GetConnection: %s", err)
-			graphite.Increment("reconnect_error")
-			return nil, err
+		log.Debug("Probing %s:%s failed: %s", cp.Protocol, cp.Endpoint, err)
+		atomic.AddInt32(&cp.dialFailures, 1)
+	}
+}
+
+// Queues a waiter behind the waiters of its own and higher priority classes.  The pool's lock has to be held
+func (cp *ConnectionPool) enqueueWaiterLocked(waiter *poolWaiter) *list.Element {
+	for element := cp.waiters.Back(); element != nil; element = element.Prev() {
+		if element.Value.(*poolWaiter).priority >= waiter.priority {
+			return cp.waiters.InsertAfter(waiter, element)
 		}
+	}
+	return cp.waiters.PushFront(waiter)
+}
 
-		return connection, nil
-	case <-time.After(1 * time.Second):
-		return nil, errors.New("timeout while waiting for a new connection")
+// Turns away the newest waiter of the lowest priority class, if its class is lower than the given one, and returns
+// whether it did.  The pool's lock has to be held
+func (cp *ConnectionPool) shedWaiterLocked(priority int) bool {
+	last := cp.waiters.Back()
+	if last == nil || last.Value.(*poolWaiter).priority >= priority {
+		return false
 	}
+
+	waiter := cp.waiters.Remove(last).(*poolWaiter)
+	waiter.shed = true
+	waiter.ready <- nil
+	atomic.AddUint64(&cp.Sheds, 1)
+	graphite.Increment("pool_shed")
+	return true
+}
+
+// Waits for a connection to be handed to the given waiter, returning nil if none was handed to it within WaitTimeout, or
+// if it was shed
+func (cp *ConnectionPool) waitForConnection(waiter *poolWaiter, element *list.Element) (connection *Connection) {
+	atomic.AddUint64(&cp.Waits, 1)
+	start := time.Now()
+	timer := time.NewTimer(cp.WaitTimeout)
+
+	select {
+	case connection = <-waiter.ready:
+		timer.Stop()
+	case <-timer.C:
+		cp.lock.Lock()
+		select {
+		case connection = <-waiter.ready:
+			// A connection was handed over just as the timer fired
+		default:
+			cp.waiters.Remove(element)
+		}
+		cp.lock.Unlock()
+	}
+
+	graphite.Timing("pool_wait", time.Now().Sub(start))
+	if connection == nil && !waiter.shed {
+		atomic.AddUint64(&cp.WaitTimeouts, 1)
+		graphite.Increment("pool_wait_timeout")
+	}
+	return
+}
+
+// Picks one of the pool's shared connections, in turn, or returns nil if the pool does not share connections
+func (cp *ConnectionPool) SharedConnection() *SharedConnection {
+	if cp.SharedConnections <= 0 {
+		return nil
+	}
+
+	cp.sharedOnce.Do(func() {
+		cp.shared = make([]*SharedConnection, cp.SharedConnections)
+		for i := range cp.shared {
+			cp.shared[i] = newSharedConnection(cp)
+		}
+	})
+	return cp.shared[atomic.AddUint32(&cp.sharedNext, 1)%uint32(len(cp.shared))]
+}
+
+// The amount of clients currently waiting for a free connection
+func (cp *ConnectionPool) Waiting() int {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	return cp.waiters.Len()
+}
+
+// The amount of connections that are currently not checked out
+func (cp *ConnectionPool) IdleCount() int {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	return cp.idle.len()
 }
 
 // Creates a new Connection basead on the pool's configuration
 func (cp *ConnectionPool) CreateConnection() *Connection {
-	return NewConnection(
+	connection := NewConnection(
 		cp.Protocol,
 		cp.Endpoint,
 		cp.ConnectTimeout,
@@ -135,6 +537,36 @@ func (cp *ConnectionPool) CreateConnection() *Connection {
 		cp.AuthUser,
 		cp.AuthPassword,
 	)
+	connection.credentials = cp.credentials
+	connection.tlsConfig = cp.TLSConfig
+	connection.reconnectJitter = cp.ReconnectJitter
+	return connection
+}
+
+// Re-reads the credentials of this pool, if they are read from files or the environment
+// When they changed, connections authenticate again with the new credentials the next time they are checked out
+func (cp *ConnectionPool) RefreshCredentials() {
+	if !cp.credentials.IsDynamic() {
+		return
+	}
+
+	changed, err := cp.credentials.Refresh()
+	if err != nil {
+		log.Error("Could not refresh the credentials for %s:%s, keeping the current ones: %s", cp.Protocol, cp.Endpoint, err)
+		graphite.Increment("credentials_refresh_error")
+	} else if changed {
+		log.Info("The credentials for %s:%s changed", cp.Protocol, cp.Endpoint)
+		graphite.Increment("credentials_rotated")
+	}
+}
+
+// Resolves the database a client asked for into the database to select on this pool's connections
+// DEFAULT_DATABASE resolves to the pool's own default database
+func (cp *ConnectionPool) ResolveDatabase(databaseId int) int {
+	if databaseId == DEFAULT_DATABASE {
+		return cp.Database
+	}
+	return databaseId
 }
 
 func (cp *ConnectionPool) getDiagnosticConnection() (connection *Connection, err error) {
@@ -154,12 +586,96 @@ func (cp *ConnectionPool) releaseDiagnosticConnection() {
 }
 
 // Recycles a connection back into our connection pool
-// If the pool is full, throws it away
+// A connection that is out of sync with its server, because responses were not read or more data than expected was
+// received, is disconnected first, so that the next client does not receive someone else's responses
 func (myConnectionPool *ConnectionPool) RecycleRemoteConnection(remoteConnection *Connection) {
-	myConnectionPool.connectionPool <- remoteConnection
+	if reason := remoteConnection.outOfSyncReason(); reason != "" {
+		log.Error("Discarding a connection to %s:%s on database %d that is out of sync: %s", myConnectionPool.Protocol,
+			myConnectionPool.Endpoint, remoteConnection.DatabaseId, reason)
+		remoteConnection.Disconnect()
+		atomic.AddUint64(&myConnectionPool.Desyncs, 1)
+		graphite.Increment("upstream_desync")
+	}
+	if roundTrip, failed := remoteConnection.takeRoundTrip(); roundTrip > 0 || failed {
+		myConnectionPool.ConcurrencyLimiter.Sample(roundTrip, int(atomic.LoadInt32(&myConnectionPool.Count)), failed)
+	}
+
+	remoteConnection.lastUsed = time.Now()
+	myConnectionPool.putIdleConnection(remoteConnection)
 	atomic.AddInt32(&myConnectionPool.Count, -1)
 }
 
+// Hands a connection to the longest waiting client, or puts it back with the idle connections if nobody is waiting
+func (cp *ConnectionPool) putIdleConnection(connection *Connection) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	delete(cp.checkedOut, connection)
+	cp.idle.push(connection)
+	cp.serveWaitersLocked()
+}
+
+// Hands idle connections to the longest waiting clients, as far as the concurrency limit allows, preferring ones that
+// have the database of the waiter selected already.  The pool's lock has to be held
+func (cp *ConnectionPool) serveWaitersLocked() {
+	for cp.waiters.Len() > 0 && cp.idle.len() > 0 && cp.ConcurrencyLimiter.Allows(len(cp.checkedOut)) {
+		waiter := cp.waiters.Remove(cp.waiters.Front()).(*poolWaiter)
+		connection, selectSaved := cp.idle.pop(waiter.databaseId)
+		if selectSaved {
+			atomic.AddUint64(&cp.SelectsSaved, 1)
+			graphite.Increment("select_saved")
+		}
+		cp.checkOutLocked(connection, waiter.owner)
+		waiter.ready <- connection
+	}
+}
+
+// Records that a connection was checked out by the given owner.  The pool's lock has to be held
+func (cp *ConnectionPool) checkOutLocked(connection *Connection, owner string) {
+	// The connection is not held by anyone yet, so its database can still be read
+	cp.checkedOut[connection] = &checkoutRecord{Checkout: Checkout{owner, connection.DatabaseId, time.Now()}}
+}
+
+// Returns the connections that are currently checked out, the longest held one first
+func (cp *ConnectionPool) Checkouts() (checkouts []Checkout) {
+	cp.lock.Lock()
+	for _, record := range cp.checkedOut {
+		checkouts = append(checkouts, record.Checkout)
+	}
+	cp.lock.Unlock()
+
+	sort.Slice(checkouts, func(i, j int) bool {
+		return checkouts[i].Since.Before(checkouts[j].Since)
+	})
+	return
+}
+
+// Reports every checkout that has been held for longer than LongCheckoutThreshold, once per checkout
+// Long checkouts point to stuck transactions or slow clients, and are what eventually exhausts a pool
+func (cp *ConnectionPool) CheckLongCheckouts() (reported int) {
+	if cp.LongCheckoutThreshold <= 0 {
+		return
+	}
+
+	var long []Checkout
+	cp.lock.Lock()
+	for _, record := range cp.checkedOut {
+		if !record.reported && time.Since(record.Since) > cp.LongCheckoutThreshold {
+			record.reported = true
+			long = append(long, record.Checkout)
+		}
+	}
+	cp.lock.Unlock()
+
+	for _, checkout := range long {
+		log.Warn("A connection to %s:%s on database %d has been checked out by %s for %s", cp.Protocol, cp.Endpoint,
+			checkout.DatabaseId, checkout.Owner, time.Since(checkout.Since))
+		atomic.AddUint64(&cp.LongCheckouts, 1)
+		graphite.Increment("long_checkout")
+	}
+	return len(long)
+}
+
 func (cp *ConnectionPool) SetIsConnected(isConnected bool) {
 	cp.connectedLock.Lock()
 	defer cp.connectedLock.Unlock()
@@ -172,34 +688,242 @@ func (cp *ConnectionPool) IsConnected() bool {
 	return cp.isConnected
 }
 
+// Whether or not a client request may be sent to this pool
+// The pool has to be up according to its diagnostic connection, must not be backing off from failed dials, and its
+// circuit breaker has to allow the request.
+// Every allowed request must be followed by a call to RecordSuccess or RecordFailure, or be released with
+// CircuitBreaker.Cancel.
+func (cp *ConnectionPool) AllowRequest() bool {
+	return cp.IsConnected() && !cp.InBackoff() && cp.CircuitBreaker.Allow()
+}
+
+// Records a client request against this pool that succeeded
+func (cp *ConnectionPool) RecordSuccess() {
+	cp.CircuitBreaker.Success()
+}
+
+// Records a client request against this pool that failed, either with a network error or with a response signalling
+// that the server is unable to serve requests right now
+func (cp *ConnectionPool) RecordFailure() {
+	cp.CircuitBreaker.Failure()
+}
+
 // Checks the state of connections in this connection pool
-// If a remote server has severe lag, mysteriously goes away, or stops responding all-together, returns false
+// If a remote server has severe lag, mysteriously goes away, or stops responding all-together, the check fails.
+// The pool is only marked down after HealthFailureThreshold consecutive failed checks, and only marked up again after
+// HealthSuccessThreshold consecutive successful checks, so that single lost pings do not flap the pool.
+// Returns whether the pool is up after this check.
 // This is only used for diagnostic connections!
 func (cp *ConnectionPool) CheckConnectionState() (isUp bool) {
-	isUp = true
-	defer func() {
-		cp.SetIsConnected(isUp)
-	}()
+	return cp.recordHealthCheck(cp.checkDiagnosticConnection())
+}
 
+// Checks the diagnostic connection once, returning whether the server answered in time
+func (cp *ConnectionPool) checkDiagnosticConnection() bool {
 	connection, err := cp.getDiagnosticConnection()
 	if err != nil {
-		isUp = false
-		return
+		return false
 	}
 	defer cp.releaseDiagnosticConnection()
 
 	if !connection.CheckConnection() {
 		connection.Disconnect()
-		isUp = false
+		return false
+	}
+
+	return true
+}
+
+// Applies the result of a health check to the state of the pool, logging and counting state transitions
+func (cp *ConnectionPool) recordHealthCheck(checkPassed bool) (isUp bool) {
+	cp.connectedLock.Lock()
+	defer cp.connectedLock.Unlock()
+
+	if !cp.healthChecked {
+		cp.healthChecked = true
+		cp.isConnected = checkPassed
+		return cp.isConnected
+	}
+
+	if checkPassed == cp.isConnected {
+		cp.healthStreak = 0
+		return cp.isConnected
+	}
+
+	cp.healthStreak++
+	threshold := cp.HealthFailureThreshold
+	if checkPassed {
+		threshold = cp.HealthSuccessThreshold
+	}
+	if cp.healthStreak < threshold {
+		return cp.isConnected
+	}
+
+	cp.healthStreak = 0
+	cp.isConnected = checkPassed
+	if checkPassed {
+		log.Info("Connection pool %s:%s is up after %d successful health checks", cp.Protocol, cp.Endpoint, threshold)
+		graphite.Increment("pool_up")
+	} else {
+		log.Warn("Connection pool %s:%s is down after %d failed health checks", cp.Protocol, cp.Endpoint, threshold)
+		graphite.Increment("pool_down")
+	}
+	return cp.isConnected
+}
+
+// Checks the state of this pool every HealthCheckInterval, for as long as isActive returns true
+// Every pool runs its own loop, so that a hung server does not delay the checks of the other pools
+func (cp *ConnectionPool) MaintainConnectionState(isActive func() bool) {
+	for isActive() {
+		time.Sleep(cp.HealthCheckInterval)
+		cp.CheckConnectionState()
+	}
+}
+
+// Pings the pooled connections that have been idle for longer than IdleValidationThreshold, and disconnects the ones
+// that do not answer, so that checkouts rarely have to validate a connection themselves
+// The connections that are not pinged are handed back right away, so that they stay available to clients meanwhile
+func (cp *ConnectionPool) CheckIdleConnections() (checked, failed int) {
+	// Only the stale connections are taken out, so that the others can still be checked out during the sweep
+	cp.lock.Lock()
+	stale := cp.idle.popWhere(func(connection *Connection) bool {
+		return connection.connection != nil && connection.isIdle(cp.IdleValidationThreshold)
+	})
+	cp.lock.Unlock()
+
+	for _, connection := range stale {
+		checked++
+		if !connection.CheckConnection() {
+			failed++
+			graphite.Increment("idle_ping_error")
+		}
+		cp.putIdleConnection(connection)
+	}
+
+	if failed > 0 {
+		log.Warn("%d of %d idle connections to %s:%s did not answer a PING", failed, checked, cp.Protocol, cp.Endpoint)
+	}
+	return
+}
+
+// Disconnects a connection that outlived its reconnect interval, so that it is dialed again on its next use
+func (cp *ConnectionPool) expireConnection(connection *Connection) {
+	connection.Disconnect()
+	atomic.AddUint64(&cp.Expirations, 1)
+	graphite.Increment("connection_expired")
+}
+
+// Takes all connections that are currently idle out of the pool
+// They have to be handed back with returnIdleConnections
+func (cp *ConnectionPool) takeIdleConnections() (idle []*Connection) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	return cp.idle.popAll()
+}
+
+// Hands idle connections taken with takeIdleConnections back to the pool, keeping their order
+func (cp *ConnectionPool) returnIdleConnections(idle []*Connection) {
+	for _, connection := range idle {
+		cp.putIdleConnection(connection)
+	}
+}
+
+// Closes the idle connections that outlived their reconnect interval, and the ones beyond MinIdle that have been idle
+// for longer than MaxIdleTime
+func (cp *ConnectionPool) CloseIdleConnections() (expired, closed int) {
+	idle := cp.takeIdleConnections()
+	defer cp.returnIdleConnections(idle)
+
+	connected := 0
+	for _, connection := range idle {
+		if connection.connection != nil {
+			connected++
+		}
+	}
+
+	for _, connection := range idle {
+		if connection.isExpired() {
+			cp.expireConnection(connection)
+			expired++
+			connected--
+		} else if cp.MaxIdleTime > 0 && connected > cp.MinIdle && connection.connection != nil &&
+			connection.isIdle(cp.MaxIdleTime) {
+			connection.Disconnect()
+			atomic.AddUint64(&cp.IdleCloses, 1)
+			graphite.Increment("connection_idle_closed")
+			closed++
+			connected--
+		}
+	}
+
+	if expired > 0 || closed > 0 {
+		log.Debug("Closed %d expired and %d idle connections to %s:%s", expired, closed, cp.Protocol, cp.Endpoint)
+	}
+	return
+}
+
+// Dials idle connections until at least MinIdle of them are connected, so that clients do not have to wait for dials
+// Connections are dialed one at a time, while the others stay available to clients
+func (cp *ConnectionPool) WarmUp() (dialed int) {
+	if cp.MinIdle < 1 {
 		return
 	}
 
+	idle := cp.takeIdleConnections()
+	missing := cp.MinIdle
+	var shells []*Connection
+	for i, connection := range idle {
+		if connection.connection != nil {
+			missing--
+		} else if len(shells) < cp.MinIdle {
+			shells = append(shells, connection)
+			idle[i] = nil
+		}
+	}
+	for _, connection := range idle {
+		if connection != nil {
+			cp.putIdleConnection(connection)
+		}
+	}
+
+	for _, connection := range shells {
+		if missing > 0 {
+			if err := connection.ReconnectIfNecessary(); err != nil {
+				log.Warn("Could not dial an idle connection to %s:%s ahead of time: %s", cp.Protocol, cp.Endpoint, err)
+				missing = 0
+			} else {
+				atomic.AddUint64(&cp.WarmUpDials, 1)
+				graphite.Increment("connection_warmup")
+				dialed++
+				missing--
+			}
+		}
+		cp.putIdleConnection(connection)
+	}
+
 	return
 }
 
+// Maintains the idle connections of this pool for as long as isActive returns true
+// Connections are dialed ahead of time right away, and every IdlePingInterval expired and surplus idle connections are
+// closed, the remaining idle ones are pinged, and connections are dialed to keep MinIdle of them connected.
+func (cp *ConnectionPool) MaintainIdleConnections(isActive func() bool) {
+	cp.WarmUp()
+	for isActive() {
+		time.Sleep(cp.IdlePingInterval)
+		cp.CloseIdleConnections()
+		cp.CheckIdleConnections()
+		cp.WarmUp()
+	}
+}
+
 func (cp *ConnectionPool) ReportGraphite() {
-	endpoint := strings.Replace(cp.Endpoint, ".", "-", -1)
-	endpoint = strings.Replace(cp.Endpoint, ":", "-", -1)
+	endpoint := strings.NewReplacer(".", "-", ":", "-", "/", "-").Replace(cp.Endpoint)
 
 	graphite.Gauge("pools."+endpoint, int(cp.Count))
+	graphite.Gauge("pools."+endpoint+".waiting", cp.Waiting())
+	if cp.ConcurrencyLimiter != nil {
+		graphite.Gauge("pools."+endpoint+".concurrency_limit", cp.ConcurrencyLimiter.Limit())
+	}
 }
@@ -26,6 +26,7 @@
 package connection
 
 import (
+	"bufio"
 	"bytes"
 	"net"
 	"os"
@@ -47,6 +48,8 @@ func TestRecycleConnection(test *testing.T) {
 	//Setting the channel at size 2 makes this more interesting
 	timeout := 500 * time.Millisecond
 	connectionPool := NewConnectionPool("unix", testSocket, 2, timeout, timeout, timeout, time.Hour, "", "")
+	// Validate every checkout, so that the closed socket is noticed without waiting for the connections to idle
+	connectionPool.IdleValidationThreshold = 0
 
 	connection, err := connectionPool.GetConnection()
 	if err != nil {
@@ -162,3 +165,667 @@ func TestCheckConnectionState(test *testing.T) {
 
 	wg.Wait()
 }
+
+func TestCheckConnectionState_Hysteresis(test *testing.T) {
+	timeout := 10 * time.Millisecond
+	connectionPool := NewConnectionPool("unix", "/tmp/rmuxConnectionTest", 0, timeout, timeout, timeout, time.Hour, "", "")
+	connectionPool.HealthFailureThreshold = 3
+	connectionPool.HealthSuccessThreshold = 2
+
+	// The first check decides the state by itself
+	if !connectionPool.recordHealthCheck(true) {
+		test.Fatal("The first successful check should have marked the pool up")
+	}
+
+	// Failures below the threshold keep the pool up, and a success in between resets them
+	checks := []struct {
+		passed   bool
+		expectUp bool
+	}{
+		{false, true},
+		{false, true},
+		{true, true},
+		{false, true},
+		{false, true},
+		{false, false},
+		{true, false},
+		{false, false},
+		{true, false},
+		{true, true},
+	}
+
+	for i, check := range checks {
+		if isUp := connectionPool.recordHealthCheck(check.passed); isUp != check.expectUp {
+			test.Fatalf("Check %d (passed: %t) left the pool up=%t, expected %t", i, check.passed, isUp, check.expectUp)
+		}
+		if connectionPool.IsConnected() != check.expectUp {
+			test.Fatalf("Check %d did not update the state of the pool", i)
+		}
+	}
+}
+
+// Listens on the given socket, and answers every line received on an accepted connection with a PONG
+// Returns the listener, and a function that closes all accepted connections
+func _listenPongSocket(t testing.TB, socketPath string) (net.Listener, func()) {
+	os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to listen on test socket %s: %s", socketPath, err)
+	}
+
+	var lock sync.Mutex
+	var accepted []net.Conn
+	go func() {
+		for {
+			fd, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			accepted = append(accepted, fd)
+			lock.Unlock()
+
+			go func() {
+				reader := bufio.NewReader(fd)
+				for {
+					if _, err := reader.ReadString('\n'); err != nil {
+						return
+					}
+					fd.Write([]byte("+PONG\r\n"))
+				}
+			}()
+		}
+	}()
+
+	return listener, func() {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, fd := range accepted {
+			fd.Close()
+		}
+	}
+}
+
+func TestCheckIdleConnections(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, closeAccepted := _listenPongSocket(test, testSocket)
+	defer listenSock.Close()
+
+	timeout := 100 * time.Millisecond
+	connectionPool := NewConnectionPool("unix", testSocket, 2, timeout, timeout, timeout, time.Hour, "", "")
+
+	connection, err := connectionPool.GetConnection()
+	if err != nil {
+		test.Fatalf("Failed to get first connection: %s", err)
+	}
+	connection2, err := connectionPool.GetConnection()
+	if err != nil {
+		test.Fatalf("Failed to get second connection: %s", err)
+	}
+	connectionPool.RecycleRemoteConnection(connection)
+	connectionPool.RecycleRemoteConnection(connection2)
+
+	// The connections were just used, so they are not pinged
+	if checked, _ := connectionPool.CheckIdleConnections(); checked != 0 {
+		test.Errorf("Pinged %d connections that were not idle", checked)
+	}
+
+	connectionPool.IdleValidationThreshold = 0
+	if checked, failed := connectionPool.CheckIdleConnections(); checked != 2 || failed != 0 {
+		test.Errorf("Expected 2 successful pings of idle connections, got %d pings with %d failures", checked, failed)
+	}
+
+	closeAccepted()
+	if checked, failed := connectionPool.CheckIdleConnections(); checked != 2 || failed != 2 {
+		test.Errorf("Expected 2 failed pings of closed connections, got %d pings with %d failures", checked, failed)
+	}
+
+	// The failed connections were disconnected, and are not pinged again
+	if checked, _ := connectionPool.CheckIdleConnections(); checked != 0 {
+		test.Errorf("Pinged %d connections that were disconnected", checked)
+	}
+
+	if connectionPool.IdleCount() != 2 {
+		test.Errorf("Checking idle connections should have left both connections in the pool")
+	}
+}
+
+func benchmarkGetConnection(bench *testing.B, idleValidationThreshold time.Duration) {
+	testSocket := "/tmp/rmuxConnectionBench"
+	listenSock, _ := _listenPongSocket(bench, testSocket)
+	defer listenSock.Close()
+
+	timeout := 500 * time.Millisecond
+	connectionPool := NewConnectionPool("unix", testSocket, 1, timeout, timeout, timeout, time.Hour, "", "")
+	connectionPool.IdleValidationThreshold = idleValidationThreshold
+
+	bench.ResetTimer()
+	for i := 0; i < bench.N; i++ {
+		connection, err := connectionPool.GetConnection()
+		if err != nil {
+			bench.Fatalf("Failed to get a connection: %s", err)
+		}
+		connectionPool.RecycleRemoteConnection(connection)
+	}
+}
+
+func BenchmarkGetConnection(bench *testing.B) {
+	benchmarkGetConnection(bench, EXTERN_IDLE_VALIDATION_THRESHOLD)
+}
+
+// Probes the connection on every checkout, like checkouts did before liveness was tracked in the background
+func BenchmarkGetConnection_ProbeEveryCheckout(bench *testing.B) {
+	benchmarkGetConnection(bench, 0)
+}
+
+func TestWarmUp(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, _ := _listenPongSocket(test, testSocket)
+	defer listenSock.Close()
+
+	timeout := 100 * time.Millisecond
+	connectionPool := NewEndpointConnectionPool(&Endpoint{Protocol: "unix", Address: testSocket, PoolSize: 4,
+		MinIdle: 2, ConnectTimeout: timeout, ReadTimeout: timeout, WriteTimeout: timeout, ReconnectInterval: time.Hour})
+
+	if dialed := connectionPool.WarmUp(); dialed != 2 {
+		test.Errorf("Expected 2 connections to be dialed ahead of time, got %d", dialed)
+	}
+	if dialed := connectionPool.WarmUp(); dialed != 0 {
+		test.Errorf("Dialed %d connections when MinIdle connections were already connected", dialed)
+	}
+	if connectionPool.WarmUpDials != 2 {
+		test.Errorf("Expected 2 counted warm-up dials, got %d", connectionPool.WarmUpDials)
+	}
+
+	connected := 0
+	idle := connectionPool.takeIdleConnections()
+	for _, connection := range idle {
+		if connection.connection != nil {
+			connected++
+		}
+	}
+	connectionPool.returnIdleConnections(idle)
+	if connected != 2 {
+		test.Errorf("Expected 2 connected idle connections, got %d", connected)
+	}
+}
+
+func TestCloseIdleConnections(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, _ := _listenPongSocket(test, testSocket)
+	defer listenSock.Close()
+
+	timeout := 100 * time.Millisecond
+	connectionPool := NewEndpointConnectionPool(&Endpoint{Protocol: "unix", Address: testSocket, PoolSize: 3,
+		MinIdle: 1, ConnectTimeout: timeout, ReadTimeout: timeout, WriteTimeout: timeout, ReconnectInterval: time.Hour})
+	connectionPool.MinIdle = 3
+	connectionPool.WarmUp()
+	connectionPool.MinIdle = 1
+
+	idle := connectionPool.takeIdleConnections()
+	// One connection outlived its reconnect interval, and the other two have been idle for a minute
+	idle[0].nextReconnect = time.Now()
+	idle[1].lastUsed = time.Now().Add(-time.Minute)
+	idle[2].lastUsed = time.Now().Add(-time.Minute)
+	connectionPool.returnIdleConnections(idle)
+
+	// Without a max idle time, only the expired connection is closed
+	if expired, closed := connectionPool.CloseIdleConnections(); expired != 1 || closed != 0 {
+		test.Errorf("Expected 1 expired and 0 closed connections, got %d and %d", expired, closed)
+	}
+
+	// The last connected one is kept for MinIdle
+	connectionPool.MaxIdleTime = time.Second
+	if expired, closed := connectionPool.CloseIdleConnections(); expired != 0 || closed != 1 {
+		test.Errorf("Expected 0 expired and 1 closed connections, got %d and %d", expired, closed)
+	}
+
+	if connectionPool.Expirations != 1 || connectionPool.IdleCloses != 1 {
+		test.Errorf("Expected 1 counted expiration and idle close, got %d and %d", connectionPool.Expirations,
+			connectionPool.IdleCloses)
+	}
+}
+
+func TestReconnectJitter(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, _ := _listenPongSocket(test, testSocket)
+	defer listenSock.Close()
+
+	timeout := 100 * time.Millisecond
+	connectionPool := NewConnectionPool("unix", testSocket, 20, timeout, timeout, timeout, time.Hour, "", "")
+	if connectionPool.ReconnectJitter != 6*time.Minute {
+		test.Fatalf("Expected a default jitter of a tenth of the reconnect interval, got %s", connectionPool.ReconnectJitter)
+	}
+
+	reconnects := make(map[time.Duration]bool)
+	for _, connection := range connectionPool.takeIdleConnections() {
+		if err := connection.ReconnectIfNecessary(); err != nil {
+			test.Fatalf("Failed to connect: %s", err)
+		}
+
+		lifetime := connection.nextReconnect.Sub(connection.lastUsed)
+		if lifetime > time.Hour || lifetime <= 54*time.Minute {
+			test.Errorf("Connection will reconnect after %s, outside of the jitter", lifetime)
+		}
+		reconnects[lifetime] = true
+	}
+
+	if len(reconnects) < 2 {
+		test.Errorf("All connections will reconnect at the same moment")
+	}
+}
+
+func TestGetConnection_WaitQueue(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, _ := _listenPongSocket(test, testSocket)
+	defer listenSock.Close()
+
+	timeout := 100 * time.Millisecond
+	connectionPool := NewConnectionPool("unix", testSocket, 1, timeout, timeout, timeout, time.Hour, "", "")
+	connectionPool.WaitTimeout = time.Second
+	connectionPool.MaxWaiters = 2
+
+	connection, err := connectionPool.GetConnection()
+	if err != nil {
+		test.Fatalf("Failed to get a connection: %s", err)
+	}
+
+	// Two clients queue up one after the other
+	served := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func(waiter int) {
+			waitingConnection, err := connectionPool.GetConnection()
+			if err != nil {
+				served <- -1
+				return
+			}
+			served <- waiter
+			connectionPool.RecycleRemoteConnection(waitingConnection)
+		}(i)
+
+		for connectionPool.Waiting() != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// The queue is full, so the next client is turned away right away
+	if _, err := connectionPool.GetConnection(); err != ERR_POOL_QUEUE_FULL {
+		test.Errorf("Expected the full queue to turn away a client, got: %v", err)
+	}
+
+	connectionPool.RecycleRemoteConnection(connection)
+	for i := 0; i < 2; i++ {
+		if waiter := <-served; waiter != i {
+			test.Errorf("Expected waiter %d to be served next, got %d", i, waiter)
+		}
+	}
+
+	if connectionPool.Waits != 2 || connectionPool.QueueRejections != 1 {
+		test.Errorf("Expected 2 counted waits and 1 rejection, got %d and %d", connectionPool.Waits,
+			connectionPool.QueueRejections)
+	}
+}
+
+func TestGetConnection_WaitPriority(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, _ := _listenPongSocket(test, testSocket)
+	defer listenSock.Close()
+
+	timeout := 100 * time.Millisecond
+	connectionPool := NewConnectionPool("unix", testSocket, 1, timeout, timeout, timeout, time.Hour, "", "")
+	connectionPool.WaitTimeout = time.Second
+	connectionPool.MaxWaiters = 2
+
+	connection, err := connectionPool.GetConnection()
+	if err != nil {
+		test.Fatalf("Failed to get a connection: %s", err)
+	}
+
+	served := make(chan int, 3)
+	shed := make(chan int, 3)
+	wait := func(priority int) {
+		waitingConnection, err := connectionPool.GetConnectionFor(ConnectionRequest{
+			DatabaseId: DEFAULT_DATABASE,
+			Priority:   priority,
+		})
+		if err == ERR_POOL_QUEUE_FULL {
+			shed <- priority
+			return
+		} else if err != nil {
+			served <- -2
+			return
+		}
+		served <- priority
+		connectionPool.RecycleRemoteConnection(waitingConnection)
+	}
+
+	// A batch client and a regular client queue up one after the other, and then an urgent client
+	go wait(-1)
+	for connectionPool.Waiting() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	go wait(0)
+	for connectionPool.Waiting() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	go wait(1)
+
+	// The full queue makes room for the urgent client by turning away the batch client
+	if priority := <-shed; priority != -1 {
+		test.Errorf("Expected the batch client to be turned away, got the client of priority %d", priority)
+	}
+
+	// A client of the lowest waiting priority is turned away itself
+	if _, err := connectionPool.GetConnectionFor(ConnectionRequest{DatabaseId: DEFAULT_DATABASE}); err != ERR_POOL_QUEUE_FULL {
+		test.Errorf("Expected the full queue to turn away a client, got: %v", err)
+	}
+
+	connectionPool.RecycleRemoteConnection(connection)
+	for _, priority := range []int{1, 0} {
+		if waiter := <-served; waiter != priority {
+			test.Errorf("Expected the client of priority %d to be served next, got %d", priority, waiter)
+		}
+	}
+
+	if connectionPool.Sheds != 1 || connectionPool.WaitTimeouts != 0 || connectionPool.QueueRejections != 1 {
+		test.Errorf("Expected 1 shed waiter, no wait timeouts and 1 rejection, got %d, %d and %d", connectionPool.Sheds,
+			connectionPool.WaitTimeouts, connectionPool.QueueRejections)
+	}
+}
+
+func TestGetConnection_WaitTimeout(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, _ := _listenPongSocket(test, testSocket)
+	defer listenSock.Close()
+
+	timeout := 100 * time.Millisecond
+	connectionPool := NewConnectionPool("unix", testSocket, 1, timeout, timeout, timeout, time.Hour, "", "")
+	connectionPool.WaitTimeout = 20 * time.Millisecond
+
+	connection, err := connectionPool.GetConnection()
+	if err != nil {
+		test.Fatalf("Failed to get a connection: %s", err)
+	}
+
+	start := time.Now()
+	if _, err := connectionPool.GetConnection(); err != ERR_POOL_TIMEOUT {
+		test.Errorf("Expected to time out waiting for a connection, got: %v", err)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond || waited > 500*time.Millisecond {
+		test.Errorf("Waited %s instead of the configured wait timeout", waited)
+	}
+
+	// The timed out client left the queue, so the recycled connection goes back to the idle connections
+	if connectionPool.Waiting() != 0 {
+		test.Errorf("The timed out client is still waiting")
+	}
+	connectionPool.RecycleRemoteConnection(connection)
+	if connectionPool.IdleCount() != 1 || connectionPool.WaitTimeouts != 1 {
+		test.Errorf("Expected 1 idle connection and 1 counted wait timeout, got %d and %d", connectionPool.IdleCount(),
+			connectionPool.WaitTimeouts)
+	}
+}
+
+func TestGetConnection_DialBackoff(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	os.Remove(testSocket)
+
+	timeout := 100 * time.Millisecond
+	connectionPool := NewConnectionPool("unix", testSocket, 2, timeout, timeout, timeout, time.Hour, "", "")
+	connectionPool.DialBackoffMin = 20 * time.Millisecond
+	connectionPool.SetIsConnected(true)
+
+	if _, err := connectionPool.GetConnection(); err == nil || err == ERR_POOL_BACKOFF {
+		test.Fatalf("Expected the dial to fail, got: %v", err)
+	}
+
+	// Until the prober reaches the server, checkouts fail right away and the pool does not take requests
+	if _, err := connectionPool.GetConnection(); err != ERR_POOL_BACKOFF {
+		test.Errorf("Expected the pool to back off, got: %v", err)
+	}
+	if connectionPool.AllowRequest() {
+		test.Errorf("A backing off pool should not allow requests")
+	}
+
+	listenSock, _ := _listenPongSocket(test, testSocket)
+	defer listenSock.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for connectionPool.InBackoff() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	connection, err := connectionPool.GetConnection()
+	if err != nil {
+		test.Fatalf("The prober should have ended the backoff, got: %s", err)
+	}
+	connectionPool.RecycleRemoteConnection(connection)
+
+	if connectionPool.BackoffRejections != 1 {
+		test.Errorf("Expected 1 counted backoff rejection, got %d", connectionPool.BackoffRejections)
+	}
+}
+
+func TestBackoffDelay(test *testing.T) {
+	connectionPool := &ConnectionPool{DialBackoffMin: 100 * time.Millisecond, DialBackoffMax: time.Second}
+
+	testCases := []struct {
+		failures int32
+		maxDelay time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{50, time.Second},
+	}
+
+	for _, testCase := range testCases {
+		for i := 0; i < 20; i++ {
+			delay := connectionPool.backoffDelay(testCase.failures)
+			if delay < testCase.maxDelay/2 || delay > testCase.maxDelay {
+				test.Errorf("Delay after %d failures should be between %s and %s, got %s", testCase.failures,
+					testCase.maxDelay/2, testCase.maxDelay, delay)
+			}
+		}
+	}
+}
+
+func TestGetConnectionFor(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, _ := _listenPongSocket(test, testSocket)
+	defer listenSock.Close()
+
+	timeout := 100 * time.Millisecond
+	connectionPool := NewConnectionPool("unix", testSocket, 2, timeout, timeout, timeout, time.Hour, "", "")
+
+	first, err := connectionPool.GetConnection()
+	if err != nil {
+		test.Fatalf("Failed to get a connection: %s", err)
+	}
+	second, err := connectionPool.GetConnection()
+	if err != nil {
+		test.Fatalf("Failed to get a connection: %s", err)
+	}
+
+	// The first connection has database 3 selected, the second one is recycled last
+	first.DatabaseId = 3
+	connectionPool.RecycleRemoteConnection(first)
+	time.Sleep(time.Millisecond)
+	connectionPool.RecycleRemoteConnection(second)
+
+	connection, err := connectionPool.GetConnectionFor(ConnectionRequest{DatabaseId: 3})
+	if err != nil {
+		test.Fatalf("Failed to get a connection: %s", err)
+	}
+	if connection != first {
+		test.Errorf("Expected the connection that has database 3 selected")
+	}
+	if connectionPool.SelectsSaved != 1 {
+		test.Errorf("Expected 1 counted saved select, got %d", connectionPool.SelectsSaved)
+	}
+	connectionPool.RecycleRemoteConnection(connection)
+}
+
+func TestServeWaiters_Database(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	timeout := 100 * time.Millisecond
+	connectionPool := NewConnectionPool("unix", testSocket, 2, timeout, timeout, timeout, time.Hour, "", "")
+
+	// The first connection has database 3 selected, the second one became idle last
+	first := connectionPool.CreateConnection()
+	first.DatabaseId = 3
+	first.lastUsed = time.Now().Add(-time.Second)
+	second := connectionPool.CreateConnection()
+	second.lastUsed = time.Now()
+
+	connectionPool.lock.Lock()
+	connectionPool.idle.push(first)
+	connectionPool.idle.push(second)
+	waiter := &poolWaiter{ready: make(chan *Connection, 1), databaseId: 3}
+	connectionPool.waiters.PushBack(waiter)
+	connectionPool.serveWaitersLocked()
+	connectionPool.lock.Unlock()
+
+	if connection := <-waiter.ready; connection != first {
+		test.Errorf("Expected the waiter to get the connection that has database 3 selected")
+	}
+	if connectionPool.SelectsSaved != 1 {
+		test.Errorf("Expected 1 counted saved select, got %d", connectionPool.SelectsSaved)
+	}
+}
+
+func TestRecycleRemoteConnection_OutOfSync(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, _ := _listenPongSocket(test, testSocket)
+	defer listenSock.Close()
+
+	timeout := 100 * time.Millisecond
+	connectionPool := NewConnectionPool("unix", testSocket, 1, timeout, timeout, timeout, time.Hour, "", "")
+
+	// A connection whose response was never read
+	connection, err := connectionPool.GetConnection()
+	if err != nil {
+		test.Fatalf("Failed to get a connection: %s", err)
+	}
+	connection.ExpectResponses(1)
+	connectionPool.RecycleRemoteConnection(connection)
+	if connection.connection != nil || connectionPool.Desyncs != 1 {
+		test.Errorf("A connection with a pending response should have been discarded")
+	}
+
+	// A connection that received more responses than were read
+	connection, err = connectionPool.GetConnection()
+	if err != nil {
+		test.Fatalf("Failed to get a connection: %s", err)
+	}
+	connection.Writer.Write([]byte("PING\r\nPING\r\n"))
+	connection.Writer.Flush()
+	time.Sleep(10 * time.Millisecond)
+	if line, _, err := connection.Reader.ReadLine(); err != nil || !bytes.Equal(line, protocol.PONG_RESPONSE) {
+		test.Fatalf("Expected a PONG, got %q (%v)", line, err)
+	}
+	connectionPool.RecycleRemoteConnection(connection)
+	if connection.connection != nil || connectionPool.Desyncs != 2 {
+		test.Errorf("A connection with unread data should have been discarded")
+	}
+
+	// A connection that is in sync is reused as it is
+	connection, err = connectionPool.GetConnection()
+	if err != nil {
+		test.Fatalf("Failed to get a connection: %s", err)
+	}
+	connection.ExpectResponses(1)
+	connection.ResponsesRead(1)
+	connectionPool.RecycleRemoteConnection(connection)
+	if connection.connection == nil || connectionPool.Desyncs != 2 {
+		test.Errorf("A connection that is in sync should have been reused")
+	}
+}
+
+func TestCheckLongCheckouts(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, _ := _listenPongSocket(test, testSocket)
+	defer listenSock.Close()
+
+	timeout := 100 * time.Millisecond
+	connectionPool := NewConnectionPool("unix", testSocket, 1, timeout, timeout, timeout, time.Hour, "", "")
+	connectionPool.LongCheckoutThreshold = 10 * time.Millisecond
+
+	connection, err := connectionPool.GetConnectionFor(ConnectionRequest{DatabaseId: DEFAULT_DATABASE, Owner: "first"})
+	if err != nil {
+		test.Fatalf("Failed to get a connection: %s", err)
+	}
+	if checkouts := connectionPool.Checkouts(); len(checkouts) != 1 || checkouts[0].Owner != "first" {
+		test.Fatalf("Expected a checkout by first, got %v", checkouts)
+	}
+	if reported := connectionPool.CheckLongCheckouts(); reported != 0 {
+		test.Errorf("Expected no long checkouts yet, got %d", reported)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if reported := connectionPool.CheckLongCheckouts(); reported != 1 {
+		test.Errorf("Expected 1 long checkout, got %d", reported)
+	}
+	if reported := connectionPool.CheckLongCheckouts(); reported != 0 {
+		test.Errorf("Expected a long checkout to be reported once, got %d more", reported)
+	}
+	if connectionPool.LongCheckouts != 1 {
+		test.Errorf("Expected 1 counted long checkout, got %d", connectionPool.LongCheckouts)
+	}
+
+	// A connection that is handed to a waiting client is checked out by that client
+	handedOver := make(chan *Connection)
+	go func() {
+		connection, _ := connectionPool.GetConnectionFor(ConnectionRequest{DatabaseId: DEFAULT_DATABASE, Owner: "second"})
+		handedOver <- connection
+	}()
+	for connectionPool.Waiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	connectionPool.RecycleRemoteConnection(connection)
+	if connection = <-handedOver; connection == nil {
+		test.Fatalf("Expected the waiting client to get the connection")
+	}
+	if checkouts := connectionPool.Checkouts(); len(checkouts) != 1 || checkouts[0].Owner != "second" {
+		test.Errorf("Expected a checkout by second, got %v", checkouts)
+	}
+
+	connectionPool.RecycleRemoteConnection(connection)
+	if checkouts := connectionPool.Checkouts(); len(checkouts) != 0 {
+		test.Errorf("Expected no checkouts, got %v", checkouts)
+	}
+}
+
+func TestCheckouts_HeldConnectionChanges(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, _ := _listenPongSocket(test, testSocket)
+	defer listenSock.Close()
+
+	timeout := 100 * time.Millisecond
+	connectionPool := NewConnectionPool("unix", testSocket, 1, timeout, timeout, timeout, time.Hour, "", "")
+	connectionPool.LongCheckoutThreshold = time.Nanosecond
+
+	connection, err := connectionPool.GetConnectionFor(ConnectionRequest{DatabaseId: DEFAULT_DATABASE, Owner: "holder"})
+	if err != nil {
+		test.Fatalf("Failed to get a connection: %s", err)
+	}
+
+	// The holder changes its connection while the pool reports the checkout, which must not race
+	done := make(chan bool)
+	go func() {
+		connection.DatabaseId = 3
+		connection.Disconnect()
+		close(done)
+	}()
+	for i := 0; i < 10; i++ {
+		connectionPool.Checkouts()
+		connectionPool.CheckLongCheckouts()
+	}
+	<-done
+
+	if checkouts := connectionPool.Checkouts(); len(checkouts) != 1 || checkouts[0].DatabaseId != 0 {
+		test.Errorf("Expected the checkout to keep the database it was checked out with, got %v", checkouts)
+	}
+	connectionPool.RecycleRemoteConnection(connection)
+}
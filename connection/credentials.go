@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// Prefix of secret references that are read from a file
+	SECRET_FILE_PREFIX = "file:"
+	// Prefix of secret references that are read from an environment variable
+	SECRET_ENV_PREFIX = "env:"
+)
+
+// Resolves a secret reference into its value
+// "file:/path/to/secret" reads the file (without its trailing newline), "env:NAME" reads the environment variable NAME,
+// anything else is a literal value
+func ResolveSecret(reference string) (string, error) {
+	if strings.HasPrefix(reference, SECRET_FILE_PREFIX) {
+		contents, err := ioutil.ReadFile(reference[len(SECRET_FILE_PREFIX):])
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(contents), "\r\n"), nil
+	} else if strings.HasPrefix(reference, SECRET_ENV_PREFIX) {
+		name := reference[len(SECRET_ENV_PREFIX):]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+	}
+
+	return reference, nil
+}
+
+// Whether or not the given value is a reference to a secret, rather than a literal value
+func IsSecretReference(reference string) bool {
+	return strings.HasPrefix(reference, SECRET_FILE_PREFIX) || strings.HasPrefix(reference, SECRET_ENV_PREFIX)
+}
+
+// The user and password used to authenticate against an endpoint
+// Both can be given as secret references, which are resolved on first use and re-read whenever Refresh is called
+type Credentials struct {
+	userReference     string
+	passwordReference string
+
+	lock     sync.RWMutex
+	user     string
+	password string
+	resolved bool
+	// Incremented every time the resolved user or password change
+	generation uint64
+}
+
+// Initializes new credentials for the given user and password references
+func NewCredentials(userReference, passwordReference string) *Credentials {
+	return &Credentials{
+		userReference:     userReference,
+		passwordReference: passwordReference,
+	}
+}
+
+// Returns the current user and password, along with the generation they belong to
+func (c *Credentials) Get() (user, password string, generation uint64, err error) {
+	c.lock.RLock()
+	if c.resolved {
+		defer c.lock.RUnlock()
+		return c.user, c.password, c.generation, nil
+	}
+	c.lock.RUnlock()
+
+	if _, err = c.Refresh(); err != nil {
+		return "", "", 0, err
+	}
+	return c.Get()
+}
+
+// Returns the generation of the current user and password, without resolving them
+func (c *Credentials) Generation() uint64 {
+	return atomic.LoadUint64(&c.generation)
+}
+
+// Whether or not any of the credentials are read from a file or the environment, and may therefore change
+func (c *Credentials) IsDynamic() bool {
+	return IsSecretReference(c.userReference) || IsSecretReference(c.passwordReference)
+}
+
+// Re-reads the user and password references
+// If either can not be read, the previous credentials are kept and the error is returned
+func (c *Credentials) Refresh() (changed bool, err error) {
+	user, err := ResolveSecret(c.userReference)
+	if err != nil {
+		return false, fmt.Errorf("resolving auth user: %w", err)
+	}
+
+	password, err := ResolveSecret(c.passwordReference)
+	if err != nil {
+		return false, fmt.Errorf("resolving auth password: %w", err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.resolved && c.user == user && c.password == password {
+		return false, nil
+	}
+
+	changed = c.resolved
+	c.user = user
+	c.password = password
+	c.resolved = true
+	atomic.AddUint64(&c.generation, 1)
+	return changed, nil
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResolveSecret(test *testing.T) {
+	secretFile := filepath.Join(test.TempDir(), "secret")
+	if err := ioutil.WriteFile(secretFile, []byte("from-file\n"), 0600); err != nil {
+		test.Fatalf("Could not write secret file: %s", err)
+	}
+	os.Setenv("RMUX_TEST_SECRET", "from-env")
+	defer os.Unsetenv("RMUX_TEST_SECRET")
+
+	testCases := []struct {
+		reference string
+		value     string
+	}{
+		{"literal", "literal"},
+		{"", ""},
+		{"file:" + secretFile, "from-file"},
+		{"env:RMUX_TEST_SECRET", "from-env"},
+	}
+
+	for _, testCase := range testCases {
+		value, err := ResolveSecret(testCase.reference)
+		if err != nil {
+			test.Errorf("Should not have errored resolving %q: %s", testCase.reference, err)
+		} else if value != testCase.value {
+			test.Errorf("Resolved %q into %q instead of %q", testCase.reference, value, testCase.value)
+		}
+	}
+
+	if _, err := ResolveSecret("file:/tmp/rmux-this-does-not-exist"); err == nil {
+		test.Errorf("Should have errored resolving a missing file")
+	}
+	if _, err := ResolveSecret("env:RMUX_TEST_SECRET_UNSET"); err == nil {
+		test.Errorf("Should have errored resolving an unset environment variable")
+	}
+}
+
+func TestCredentials_Refresh(test *testing.T) {
+	secretFile := filepath.Join(test.TempDir(), "secret")
+	if err := ioutil.WriteFile(secretFile, []byte("first"), 0600); err != nil {
+		test.Fatalf("Could not write secret file: %s", err)
+	}
+
+	credentials := NewCredentials("user", "file:"+secretFile)
+	if !credentials.IsDynamic() {
+		test.Errorf("Credentials read from a file should be dynamic")
+	}
+
+	_, password, generation, err := credentials.Get()
+	if err != nil || password != "first" {
+		test.Fatalf("Expected password %q, got %q (%v)", "first", password, err)
+	}
+
+	if changed, err := credentials.Refresh(); changed || err != nil {
+		test.Errorf("Refreshing unchanged credentials should not report a change (%v)", err)
+	}
+
+	ioutil.WriteFile(secretFile, []byte("second"), 0600)
+	if changed, err := credentials.Refresh(); !changed || err != nil {
+		test.Errorf("Refreshing rotated credentials should report a change (%v)", err)
+	}
+
+	_, password, newGeneration, _ := credentials.Get()
+	if password != "second" || newGeneration == generation {
+		test.Errorf("Expected password %q in a new generation, got %q in generation %d", "second", password, newGeneration)
+	}
+
+	os.Remove(secretFile)
+	if _, err := credentials.Refresh(); err == nil {
+		test.Errorf("Refreshing a missing secret file should error")
+	}
+	if _, password, _, _ := credentials.Get(); password != "second" {
+		test.Errorf("A failed refresh should keep the previous password, got %q", password)
+	}
+}
+
+func TestReconnectIfNecessary_Reauthenticate(test *testing.T) {
+	secretFile := filepath.Join(test.TempDir(), "secret")
+	ioutil.WriteFile(secretFile, []byte("first"), 0600)
+
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock := _listenSocket(test, testSocket)
+	defer listenSock.Close()
+
+	received := make(chan string, 2)
+	go func() {
+		fd, err := listenSock.Accept()
+		if err != nil {
+			return
+		}
+		defer fd.Close()
+
+		reader := bufio.NewReader(fd)
+		for {
+			line, _, err := reader.ReadLine()
+			if err != nil {
+				return
+			}
+			received <- string(line)
+			fd.Write([]byte("+OK\r\n"))
+		}
+	}()
+
+	timeout := 100 * time.Millisecond
+	connectionPool := NewConnectionPool("unix", testSocket, 1, timeout, timeout, timeout, time.Hour, "", "file:"+secretFile)
+	connection, err := connectionPool.GetConnection()
+	if err != nil {
+		test.Fatalf("Failed to get a connection: %s", err)
+	}
+	if auth := <-received; auth != "AUTH first" {
+		test.Fatalf("Expected %q, got %q", "AUTH first", auth)
+	}
+	connectionPool.RecycleRemoteConnection(connection)
+
+	ioutil.WriteFile(secretFile, []byte("second"), 0600)
+	connectionPool.RefreshCredentials()
+
+	connection, err = connectionPool.GetConnection()
+	if err != nil {
+		test.Fatalf("Failed to get a connection after rotating the password: %s", err)
+	}
+	defer connectionPool.RecycleRemoteConnection(connection)
+
+	select {
+	case auth := <-received:
+		if auth != "AUTH second" {
+			test.Fatalf("Expected %q, got %q", "AUTH second", auth)
+		}
+	case <-time.After(time.Second):
+		test.Fatal("The connection did not re-authenticate after the password was rotated")
+	}
+}
+
+func TestGetConnection_AuthFailureNoBackoff(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock := _listenSocket(test, testSocket)
+	defer listenSock.Close()
+
+	go func() {
+		for {
+			fd, err := listenSock.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer fd.Close()
+				reader := bufio.NewReader(fd)
+				for {
+					if _, _, err := reader.ReadLine(); err != nil {
+						return
+					}
+					fd.Write([]byte("-WRONGPASS invalid username-password pair\r\n"))
+				}
+			}()
+		}
+	}()
+
+	timeout := 100 * time.Millisecond
+	connectionPool := NewConnectionPool("unix", testSocket, 1, timeout, timeout, timeout, time.Hour, "", "stale")
+	connectionPool.SetIsConnected(true)
+
+	// The server is reachable, so a rejected AUTH fails the checkout without backing off from the server
+	for i := 0; i < 2; i++ {
+		if _, err := connectionPool.GetConnection(); err == nil || err == ERR_POOL_BACKOFF {
+			test.Fatalf("Expected the authentication to fail, got: %v", err)
+		}
+	}
+	if connectionPool.InBackoff() || !connectionPool.AllowRequest() {
+		test.Errorf("A failed authentication should not put the pool into backoff")
+	}
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// Port used for redis:// and rediss:// endpoints that do not specify one
+	DEFAULT_REDIS_PORT = "6379"
+	// Database id that refers to the default database of an endpoint
+	DEFAULT_DATABASE = -1
+)
+
+var ERR_ENDPOINT_ADDRESS_MISSING = errors.New("endpoint address is missing")
+
+// A single upstream redis server, along with the settings that apply to its connection pool
+// Zero values are replaced with the multiplexer's defaults when the endpoint is added to it
+type Endpoint struct {
+	//The protocol to use for our connections (unix/tcp)
+	Protocol string
+	//The address (host:port or socket path) to connect to
+	Address string
+	//User to use for authentication against this endpoint
+	AuthUser string
+	//Password to use for authentication against this endpoint
+	AuthPassword string
+	//The database that clients use until they select another one
+	Database int
+	//The amount of connections to keep in this endpoint's pool
+	PoolSize int
+	//Connect timeout for this endpoint
+	ConnectTimeout time.Duration
+	//Read timeout for this endpoint
+	ReadTimeout time.Duration
+	//Write timeout for this endpoint
+	WriteTimeout time.Duration
+	//Interval in which connections to this endpoint are forced to reconnect
+	ReconnectInterval time.Duration
+	//Up to how much earlier than ReconnectInterval a connection is reconnected, chosen randomly per connection
+	ReconnectJitter time.Duration
+	//The amount of connections to this endpoint that are kept connected while idle
+	MinIdle int
+	//Interval in which the health of this endpoint is checked
+	HealthCheckInterval time.Duration
+	//Connect, read and write timeout of the health checks of this endpoint
+	HealthCheckTimeout time.Duration
+	//The share of the hash ring this endpoint receives, relative to the other endpoints
+	Weight int
+	//TLS settings, or nil for a plain text connection
+	TLSConfig *tls.Config
+}
+
+// Parses an endpoint URI in one of the following forms:
+//
+//	redis://[user[:password]@]host[:port][/database][?options]
+//	rediss://[user[:password]@]host[:port][/database][?options]
+//	unix://[user[:password]@]/path/to/socket[?options]
+//
+// Supported options are db, poolSize, minIdle, weight, connectTimeout, readTimeout, writeTimeout, timeout,
+// healthCheckInterval and healthCheckTimeout (all durations in milliseconds), and insecureSkipVerify for rediss://
+// endpoints.
+func ParseEndpointURI(uri string) (*Endpoint, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := &Endpoint{}
+
+	switch parsed.Scheme {
+	case "redis", "rediss":
+		if parsed.Hostname() == "" {
+			return nil, ERR_ENDPOINT_ADDRESS_MISSING
+		}
+		port := parsed.Port()
+		if port == "" {
+			port = DEFAULT_REDIS_PORT
+		}
+		endpoint.Protocol = "tcp"
+		endpoint.Address = net.JoinHostPort(parsed.Hostname(), port)
+
+		if database := parsed.Path; len(database) > 1 {
+			if endpoint.Database, err = strconv.Atoi(database[1:]); err != nil || endpoint.Database < 0 {
+				return nil, fmt.Errorf("invalid database %q in endpoint %q", database[1:], uri)
+			}
+		}
+
+		if parsed.Scheme == "rediss" {
+			endpoint.TLSConfig = &tls.Config{ServerName: parsed.Hostname()}
+		}
+	case "unix":
+		if parsed.Path == "" {
+			return nil, ERR_ENDPOINT_ADDRESS_MISSING
+		}
+		endpoint.Protocol = "unix"
+		endpoint.Address = parsed.Path
+	default:
+		return nil, fmt.Errorf("unsupported endpoint scheme %q in endpoint %q", parsed.Scheme, uri)
+	}
+
+	if parsed.User != nil {
+		endpoint.AuthUser = parsed.User.Username()
+		endpoint.AuthPassword, _ = parsed.User.Password()
+	}
+
+	// The generic timeout is applied first, so that the specific timeouts override it regardless of their order
+	options := parsed.Query()
+	if timeout := options.Get("timeout"); timeout != "" {
+		if err = endpoint.setOption("timeout", timeout); err != nil {
+			return nil, fmt.Errorf("invalid option %q in endpoint %q: %w", "timeout", uri, err)
+		}
+	}
+	for option, values := range options {
+		if option == "timeout" || len(values) == 0 {
+			continue
+		}
+		if err = endpoint.setOption(option, values[len(values)-1]); err != nil {
+			return nil, fmt.Errorf("invalid option %q in endpoint %q: %w", option, uri, err)
+		}
+	}
+
+	return endpoint, nil
+}
+
+// Applies a single URI query option to the endpoint
+func (endpoint *Endpoint) setOption(option, value string) error {
+	if option == "insecureSkipVerify" {
+		if endpoint.TLSConfig == nil {
+			return errors.New("only supported for rediss:// endpoints")
+		}
+		skip, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		endpoint.TLSConfig.InsecureSkipVerify = skip
+		return nil
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	} else if number < 0 {
+		return errors.New("must not be negative")
+	}
+	milliseconds := time.Duration(number) * time.Millisecond
+
+	switch option {
+	case "db":
+		endpoint.Database = number
+	case "poolSize":
+		endpoint.PoolSize = number
+	case "weight":
+		endpoint.Weight = number
+	case "minIdle":
+		endpoint.MinIdle = number
+	case "connectTimeout":
+		endpoint.ConnectTimeout = milliseconds
+	case "readTimeout":
+		endpoint.ReadTimeout = milliseconds
+	case "writeTimeout":
+		endpoint.WriteTimeout = milliseconds
+	case "healthCheckInterval":
+		endpoint.HealthCheckInterval = milliseconds
+	case "healthCheckTimeout":
+		endpoint.HealthCheckTimeout = milliseconds
+	case "timeout":
+		endpoint.ConnectTimeout = milliseconds
+		endpoint.ReadTimeout = milliseconds
+		endpoint.WriteTimeout = milliseconds
+	default:
+		return errors.New("unknown option")
+	}
+
+	return nil
+}
+
+// Returns a printable description of the endpoint, without its credentials
+func (endpoint *Endpoint) String() string {
+	if endpoint.Protocol == "unix" {
+		return fmt.Sprintf("unix://%s?db=%d", endpoint.Address, endpoint.Database)
+	} else if endpoint.TLSConfig != nil {
+		return fmt.Sprintf("rediss://%s/%d", endpoint.Address, endpoint.Database)
+	}
+	return fmt.Sprintf("redis://%s/%d", endpoint.Address, endpoint.Database)
+}
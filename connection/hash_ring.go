@@ -45,11 +45,15 @@ type HashRing struct {
 	Failover bool
 }
 
+// The most connection pools a hash ring can hold, counting every pool as often as its weight
+const MAX_HASH_RING_WEIGHT = 101
+
 func NewHashRing(connectionPools []*ConnectionPool, failover bool) (newHashRing *HashRing, err error) {
 	newHashRing = &HashRing{}
 	//The goal here is to have an even distribution of connection pools for a hash,
 	//AND ensuring that the distribution stays balanced when a pool goes down
 	//start out by rounding up to the nearest prime p
+	connectionPools = weightConnectionPools(connectionPools)
 	poolLength := len(connectionPools)
 	prime, err := newHashRing.getNextPrime(poolLength)
 	if err != nil {
@@ -65,6 +69,19 @@ func NewHashRing(connectionPools []*ConnectionPool, failover bool) (newHashRing
 	return
 }
 
+// Repeats every connection pool according to its weight, so that heavier pools receive a larger share of the ring
+// Pools without a weight count once, which keeps the distribution of unweighted rings unchanged
+func weightConnectionPools(connectionPools []*ConnectionPool) []*ConnectionPool {
+	weighted := make([]*ConnectionPool, 0, len(connectionPools))
+	for _, connectionPool := range connectionPools {
+		weighted = append(weighted, connectionPool)
+		for i := 1; i < connectionPool.Weight; i++ {
+			weighted = append(weighted, connectionPool)
+		}
+	}
+	return weighted
+}
+
 func (myHashRing *HashRing) distributeConnectionPools(prime int, connectionPools []*ConnectionPool) {
 	lastTarget := 0
 	for multiplier := 1; multiplier < prime; multiplier++ {
@@ -86,7 +103,7 @@ func (myHashRing *HashRing) getNextPrime(poolLength int) (int, error) {
 	if poolLength == 0 {
 		return -1, errors.New("At least one connection pool is required")
 	}
-	primes := []int{2, 3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41, 43, 47, 53, 59, 61, 67, 71, 73, 79, 83, 89, 97, 101}
+	primes := []int{2, 3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41, 43, 47, 53, 59, 61, 67, 71, 73, 79, 83, 89, 97, MAX_HASH_RING_WEIGHT}
 	for _, curPrime := range primes {
 		if poolLength <= curPrime {
 			return curPrime, nil
@@ -106,7 +123,15 @@ func (myHashRing *HashRing) setBitMask(prime int) {
 
 // Gets the connectionKey, for a to-be-multiplexed command
 // Uses the bernstein hash, which is one of the fastest key-distribution algorithms out there
+// The returned pool has allowed the request, so its outcome must be recorded with RecordSuccess or RecordFailure
 func (myHashRing *HashRing) GetConnectionPool(command protocol.Command) (connectionPool *ConnectionPool, err error) {
+	return myHashRing.GetBatchConnectionPool(command, nil)
+}
+
+// Gets the connection pool for a command that is sent in a batch with other commands
+// Pools that are in admitted already allowed a request of this batch, and are not asked again, so that the whole batch
+// counts as one request against each of its pools
+func (myHashRing *HashRing) GetBatchConnectionPool(command protocol.Command, admitted map[*ConnectionPool]bool) (connectionPool *ConnectionPool, err error) {
 	var hash uint32 = 0
 	if command.GetArgCount() > 0 {
 		//The bernstein hash is one of the faster key-distribution algorithms out there, for small character keys
@@ -120,7 +145,11 @@ func (myHashRing *HashRing) GetConnectionPool(command protocol.Command) (connect
 	targetHash := hash
 	connectionPool = myHashRing.ConnectionPools[hash]
 
-	for myHashRing.Failover && !connectionPool.IsConnected() {
+	for !admitted[connectionPool] && !connectionPool.AllowRequest() {
+		if !myHashRing.Failover {
+			return nil, ERR_HASHRING_DOWN
+		}
+
 		if hash == myHashRing.BitMask {
 			hash = 0
 		} else {
@@ -129,15 +158,11 @@ func (myHashRing *HashRing) GetConnectionPool(command protocol.Command) (connect
 
 		// If we've cycled through everything, break out
 		if hash == targetHash {
-			break
+			return nil, ERR_HASHRING_DOWN
 		}
 
 		connectionPool = myHashRing.ConnectionPools[hash]
 	}
 
-	if !connectionPool.IsConnected() {
-		return nil, ERR_HASHRING_DOWN
-	} else {
-		return connectionPool, nil
-	}
+	return connectionPool, nil
 }
@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"sort"
+)
+
+// The connections of a pool that are not checked out, in one list per selected database
+// All lists share the capacity of the pool, since connections only move between them.  Every list holds the most
+// recently used connection last.  Not safe for concurrent use; the pool guards it with its lock.
+type idleConnections struct {
+	byDatabase map[int][]*Connection
+	count      int
+}
+
+func newIdleConnections() *idleConnections {
+	return &idleConnections{byDatabase: make(map[int][]*Connection)}
+}
+
+// The amount of idle connections, on any database
+func (this *idleConnections) len() int {
+	return this.count
+}
+
+// Adds a connection as the most recently used one of its database
+func (this *idleConnections) push(connection *Connection) {
+	this.byDatabase[connection.DatabaseId] = append(this.byDatabase[connection.DatabaseId], connection)
+	this.count++
+}
+
+// Takes the most recently used connection that has the given database selected
+// Falls back to the most recently used connection on any database, in which case selectSaved is false.  selectSaved is
+// true if the connection on the given database was preferred over a more recently used one that would have needed a
+// SELECT.  Pass DEFAULT_DATABASE to take the most recently used connection regardless of its database.
+func (this *idleConnections) pop(databaseId int) (connection *Connection, selectSaved bool) {
+	newest := this.newestDatabase()
+	if databaseId != DEFAULT_DATABASE && len(this.byDatabase[databaseId]) > 0 {
+		selectSaved = newest != databaseId
+		return this.popNewest(databaseId), selectSaved
+	}
+
+	if newest == DEFAULT_DATABASE {
+		return nil, false
+	}
+	return this.popNewest(newest), false
+}
+
+// Takes all idle connections, the least recently used one first
+func (this *idleConnections) popAll() (all []*Connection) {
+	all = make([]*Connection, 0, this.count)
+	for _, connections := range this.byDatabase {
+		all = append(all, connections...)
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].lastUsed.Before(all[j].lastUsed)
+	})
+
+	this.byDatabase = make(map[int][]*Connection)
+	this.count = 0
+	return all
+}
+
+// Takes the idle connections the given function selects, the least recently used one first, and keeps the others
+func (this *idleConnections) popWhere(selected func(*Connection) bool) (taken []*Connection) {
+	for databaseId, connections := range this.byDatabase {
+		kept := connections[:0]
+		for _, connection := range connections {
+			if selected(connection) {
+				taken = append(taken, connection)
+			} else {
+				kept = append(kept, connection)
+			}
+		}
+		for i := len(kept); i < len(connections); i++ {
+			connections[i] = nil
+		}
+		this.byDatabase[databaseId] = kept
+	}
+	this.count -= len(taken)
+
+	sort.SliceStable(taken, func(i, j int) bool {
+		return taken[i].lastUsed.Before(taken[j].lastUsed)
+	})
+	return taken
+}
+
+// The database whose most recently used connection is the most recently used one overall, or DEFAULT_DATABASE if
+// there are no idle connections
+func (this *idleConnections) newestDatabase() int {
+	newest := DEFAULT_DATABASE
+	for databaseId, connections := range this.byDatabase {
+		if len(connections) > 0 && (newest == DEFAULT_DATABASE ||
+			connections[len(connections)-1].lastUsed.After(this.newestOf(newest).lastUsed)) {
+			newest = databaseId
+		}
+	}
+	return newest
+}
+
+func (this *idleConnections) newestOf(databaseId int) *Connection {
+	connections := this.byDatabase[databaseId]
+	return connections[len(connections)-1]
+}
+
+// Removes the most recently used connection from the list of the given database
+func (this *idleConnections) popNewest(databaseId int) (connection *Connection) {
+	connections := this.byDatabase[databaseId]
+	last := len(connections) - 1
+	connection = connections[last]
+	connections[last] = nil
+	this.byDatabase[databaseId] = connections[:last]
+	this.count--
+	return connection
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdleConnections_Pop(test *testing.T) {
+	idle := newIdleConnections()
+	now := time.Now()
+	onZero := &Connection{DatabaseId: 0, lastUsed: now.Add(-3 * time.Second)}
+	onTwo := &Connection{DatabaseId: 2, lastUsed: now.Add(-2 * time.Second)}
+	newest := &Connection{DatabaseId: 0, lastUsed: now.Add(-1 * time.Second)}
+	idle.push(onZero)
+	idle.push(onTwo)
+	idle.push(newest)
+
+	// A connection on database 2 is preferred over the more recently used one on database 0
+	if connection, selectSaved := idle.pop(2); connection != onTwo || !selectSaved {
+		test.Errorf("Expected the connection on database 2 with a saved select, got %+v (%t)", connection, selectSaved)
+	}
+
+	// Without a connection on database 2, the most recently used one is handed out
+	if connection, selectSaved := idle.pop(2); connection != newest || selectSaved {
+		test.Errorf("Expected the most recently used connection, got %+v (%t)", connection, selectSaved)
+	}
+
+	// Taking the connection on the newest database does not count as a saved select
+	if connection, selectSaved := idle.pop(0); connection != onZero || selectSaved {
+		test.Errorf("Expected the last connection without a saved select, got %+v (%t)", connection, selectSaved)
+	}
+
+	if connection, _ := idle.pop(DEFAULT_DATABASE); connection != nil || idle.len() != 0 {
+		test.Errorf("Expected no connections to be left, got %+v", connection)
+	}
+}
+
+func TestIdleConnections_PopAll(test *testing.T) {
+	idle := newIdleConnections()
+	now := time.Now()
+	connections := []*Connection{
+		{DatabaseId: 1, lastUsed: now.Add(-3 * time.Second)},
+		{DatabaseId: 0, lastUsed: now.Add(-2 * time.Second)},
+		{DatabaseId: 1, lastUsed: now.Add(-1 * time.Second)},
+	}
+	for _, connection := range connections {
+		idle.push(connection)
+	}
+
+	all := idle.popAll()
+	if len(all) != 3 || idle.len() != 0 {
+		test.Fatalf("Expected all 3 connections to be taken, got %d with %d left", len(all), idle.len())
+	}
+	for i, connection := range all {
+		if connection != connections[i] {
+			test.Errorf("Expected the least recently used connection first, got %+v at %d", connection, i)
+		}
+	}
+}
+
+func TestIdleConnections_PopWhere(test *testing.T) {
+	idle := newIdleConnections()
+	now := time.Now()
+	connections := []*Connection{
+		{DatabaseId: 1, lastUsed: now.Add(-3 * time.Second)},
+		{DatabaseId: 0, lastUsed: now.Add(-2 * time.Second)},
+		{DatabaseId: 1, lastUsed: now.Add(-1 * time.Second)},
+	}
+	for _, connection := range connections {
+		idle.push(connection)
+	}
+
+	stale := idle.popWhere(func(connection *Connection) bool {
+		return connection.isIdle(1500 * time.Millisecond)
+	})
+	if len(stale) != 2 || stale[0] != connections[0] || stale[1] != connections[1] {
+		test.Fatalf("Expected the 2 stale connections, the least recently used one first, got %+v", stale)
+	}
+
+	// The connection that was used recently stays idle
+	if idle.len() != 1 {
+		test.Fatalf("Expected 1 connection to be left, got %d", idle.len())
+	}
+	if connection, _ := idle.pop(DEFAULT_DATABASE); connection != connections[2] {
+		test.Errorf("Expected the recently used connection to be left, got %+v", connection)
+	}
+}
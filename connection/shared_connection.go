@@ -0,0 +1,208 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"errors"
+	"rmux/graphite"
+	"rmux/log"
+	"rmux/protocol"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// Default amount of requests that may wait for their responses on a shared connection
+	EXTERN_SHARED_MAX_PENDING = 1024
+)
+
+var (
+	// Returned when too many requests are waiting for their responses on a shared connection
+	ERR_SHARED_CONNECTION_BUSY = errors.New("shared connection busy")
+	// Returned to the requests that were waiting for their responses when a shared connection failed
+	ERR_SHARED_CONNECTION_FAILED = errors.New("shared connection failed")
+)
+
+// A connection to a redis server that is shared by many clients
+// Requests of all clients are written to the connection as they come in, and their responses are read back in the order
+// the requests were written.  Only requests that neither depend on nor change the state of the connection may be sent
+// over it; it always has the default database of its pool selected.  When the connection fails, all requests waiting
+// for their responses fail with it, and the next request dials it again.  Once the connection outlived its reconnect
+// interval, or the credentials of the pool were rotated, the next request is sent over a newly dialed connection, and
+// the old one is closed once the responses of its requests were read.
+type SharedConnection struct {
+	pool *ConnectionPool
+	// Guards writes to the connection, and the queue of requests waiting for their responses
+	lock       sync.Mutex
+	connection *Connection
+	// The requests waiting for their responses, in the order they were written.  Replaced whenever the connection is
+	// dialed, and nil while it is not connected
+	pending chan *sharedRequest
+}
+
+// A request that was written to a shared connection, and waits for its responses
+type sharedRequest struct {
+	numResponses int
+	// Responses longer than this are dropped instead of being held
+	maxLength   int
+	responses   [][]byte
+	unavailable bool
+	err         error
+	done        chan struct{}
+}
+
+func newSharedConnection(pool *ConnectionPool) *SharedConnection {
+	return &SharedConnection{pool: pool, connection: pool.CreateConnection()}
+}
+
+// Sends the given commands over the shared connection, and waits for their responses
+// unavailable reports whether any response signalled that the server is unable to serve requests right now
+// Responses longer than maxLength are dropped as they are read, failing the request with
+// protocol.ERR_RESPONSE_TOO_LONG, while the connection stays usable.  Zero disables the limit.
+func (sc *SharedConnection) Do(commands []protocol.Command, maxLength int) (responses [][]byte, unavailable bool, err error) {
+	request := &sharedRequest{numResponses: len(commands), maxLength: maxLength, done: make(chan struct{})}
+
+	sc.lock.Lock()
+	if sc.pending != nil && sc.connection.isStale() {
+		sc.retire()
+	}
+	if sc.pending == nil {
+		if err = sc.connect(); err != nil {
+			sc.lock.Unlock()
+			return nil, false, err
+		}
+	}
+	if len(sc.pending) == cap(sc.pending) {
+		sc.lock.Unlock()
+		return nil, false, ERR_SHARED_CONNECTION_BUSY
+	}
+
+	for _, command := range commands {
+		if _, err = sc.connection.Writer.Write(command.GetBuffer()); err != nil {
+			break
+		}
+	}
+	for err == nil && sc.connection.Writer.Buffered() > 0 {
+		err = sc.connection.Writer.Flush()
+	}
+	if err != nil {
+		log.Error("Error when writing to shared connection to %s: %s. Disconnecting the connection.", sc.pool.Endpoint, err)
+		sc.disconnect(sc.pending)
+		sc.lock.Unlock()
+		return nil, false, err
+	}
+	// Queued while holding the lock, so that the requests are queued in the order they were written
+	sc.pending <- request
+	sc.lock.Unlock()
+
+	<-request.done
+	atomic.AddUint64(&sc.pool.SharedRequests, 1)
+	return request.responses, request.unavailable, request.err
+}
+
+// Dials the connection, and starts reading its responses.  The lock has to be held
+func (sc *SharedConnection) connect() (err error) {
+	if sc.pool.InBackoff() {
+		return ERR_POOL_BACKOFF
+	}
+
+	if err = sc.connection.ReconnectIfNecessary(); err != nil {
+		log.Error("Failed to connect a shared connection to %s: %s", sc.pool.Endpoint, err)
+		if isDialError(err) {
+			sc.pool.recordDialFailure(err)
+		}
+		return err
+	}
+	if databaseId := sc.pool.ResolveDatabase(DEFAULT_DATABASE); sc.connection.DatabaseId != databaseId {
+		if err = sc.connection.SelectDatabase(databaseId); err != nil {
+			log.Error("Failed to select database %d on a shared connection to %s: %s", databaseId, sc.pool.Endpoint, err)
+			return err
+		}
+	}
+
+	sc.pending = make(chan *sharedRequest, EXTERN_SHARED_MAX_PENDING)
+	go sc.readResponses(sc.connection, protocol.NewRespScanner(sc.connection.Reader), sc.pending)
+	return nil
+}
+
+// Replaces a connection that outlived its reconnect interval, or authenticated with rotated credentials, with one that
+// is dialed by the next request.  The old connection is closed by its reader, once the responses of its requests were
+// read.  The lock has to be held
+func (sc *SharedConnection) retire() {
+	if sc.connection.isExpired() {
+		atomic.AddUint64(&sc.pool.Expirations, 1)
+		graphite.Increment("connection_expired")
+	} else {
+		log.Info("Reconnecting a shared connection to %s after a credential change", sc.pool.Endpoint)
+	}
+
+	close(sc.pending)
+	sc.pending = nil
+	sc.connection = sc.pool.CreateConnection()
+}
+
+// Reads the responses of the given pending requests, in order, until the connection fails or was retired
+func (sc *SharedConnection) readResponses(connection *Connection, scanner *protocol.RespScanner, pending chan *sharedRequest) {
+	for request := range pending {
+		request.responses, request.unavailable, request.err = protocol.ScanServerResponses(scanner, request.numResponses,
+			request.maxLength)
+		close(request.done)
+
+		if request.err != nil && request.err != protocol.ERR_RESPONSE_TOO_LONG {
+			log.Error("Error when reading from shared connection to %s: %s. Disconnecting the connection.",
+				sc.pool.Endpoint, request.err)
+			sc.lock.Lock()
+			sc.disconnect(pending)
+			sc.lock.Unlock()
+			break
+		}
+	}
+
+	// Fail the requests that were written before the connection failed
+	for request := range pending {
+		request.err = ERR_SHARED_CONNECTION_FAILED
+		close(request.done)
+	}
+
+	sc.lock.Lock()
+	if sc.connection != connection {
+		// The connection was retired, and nobody else uses it anymore
+		connection.Disconnect()
+	}
+	sc.lock.Unlock()
+}
+
+// Disconnects the connection, if the given pending requests are still the current ones.  The lock has to be held
+func (sc *SharedConnection) disconnect(pending chan *sharedRequest) {
+	if sc.pending != pending {
+		return
+	}
+
+	sc.connection.Disconnect()
+	sc.pending = nil
+	close(pending)
+	graphite.Increment("shared_connection_failed")
+}
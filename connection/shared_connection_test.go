@@ -0,0 +1,194 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package connection
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"rmux/protocol"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Answers every command with the first argument of the command, or closes the connection instead if echo is false
+// Returns the listener and the amount of accepted connections
+func _listenKeyEchoSocket(t testing.TB, socketPath string, echo bool) (net.Listener, *int32) {
+	os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to listen on test socket %s: %s", socketPath, err)
+	}
+
+	var accepted int32
+	go func() {
+		for {
+			fd, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+
+			go func() {
+				defer fd.Close()
+				scanner := protocol.NewRespScanner(fd)
+				for scanner.Scan() {
+					command, err := protocol.ParseCommand(scanner.Bytes())
+					if err != nil || !echo {
+						return
+					}
+					fd.Write([]byte("+" + string(command.GetFirstArg()) + "\r\n"))
+				}
+			}()
+		}
+	}()
+
+	return listener, &accepted
+}
+
+func _getCommand(t testing.TB, key string) protocol.Command {
+	command, err := protocol.ParseCommand([]byte(fmt.Sprintf("*2\r\n$3\r\nget\r\n$%d\r\n%s\r\n", len(key), key)))
+	if err != nil {
+		t.Fatalf("Failed to parse a command: %s", err)
+	}
+	return command
+}
+
+func TestSharedConnection_Do(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, accepted := _listenKeyEchoSocket(test, testSocket, true)
+	defer listenSock.Close()
+
+	timeout := 500 * time.Millisecond
+	connectionPool := NewConnectionPool("unix", testSocket, 1, timeout, timeout, timeout, time.Hour, "", "")
+	connectionPool.SharedConnections = 1
+
+	// Requests of many clients are pipelined over the same connection, and each gets its own responses back
+	var waitGroup sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		keys := []string{fmt.Sprintf("a%d", i), fmt.Sprintf("b%d", i)}
+		commands := []protocol.Command{_getCommand(test, keys[0]), _getCommand(test, keys[1])}
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			responses, _, err := connectionPool.SharedConnection().Do(commands, 0)
+			if err != nil {
+				test.Errorf("Request %d failed: %s", i, err)
+				return
+			}
+			for j, key := range keys {
+				if j >= len(responses) || string(responses[j]) != "+"+key+"\r\n" {
+					test.Errorf("Request %d expected the responses for %v, got %q", i, keys, responses)
+					return
+				}
+			}
+		}(i)
+	}
+	waitGroup.Wait()
+
+	if n := atomic.LoadInt32(accepted); n != 1 {
+		test.Errorf("Expected all requests to share 1 connection, got %d connections", n)
+	}
+	if connectionPool.SharedRequests != 50 {
+		test.Errorf("Expected 50 shared requests, got %d", connectionPool.SharedRequests)
+	}
+}
+
+func TestSharedConnection_Failure(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, accepted := _listenKeyEchoSocket(test, testSocket, false)
+	defer listenSock.Close()
+
+	timeout := 500 * time.Millisecond
+	connectionPool := NewConnectionPool("unix", testSocket, 1, timeout, timeout, timeout, time.Hour, "", "")
+	connectionPool.SharedConnections = 1
+	sharedConnection := connectionPool.SharedConnection()
+
+	if _, _, err := sharedConnection.Do([]protocol.Command{_getCommand(test, "a")}, 0); err == nil {
+		test.Fatalf("Expected the request to fail when the server closes the connection")
+	}
+
+	// The next request dials the connection again
+	if _, _, err := sharedConnection.Do([]protocol.Command{_getCommand(test, "a")}, 0); err == nil {
+		test.Fatalf("Expected the request to fail when the server closes the connection")
+	}
+	if n := atomic.LoadInt32(accepted); n != 2 {
+		test.Errorf("Expected the failed connection to be dialed again, got %d connections", n)
+	}
+}
+
+func TestSharedConnection_Renew(test *testing.T) {
+	testSocket := "/tmp/rmuxConnectionTest"
+	listenSock, accepted := _listenKeyEchoSocket(test, testSocket, true)
+	defer listenSock.Close()
+
+	timeout := 500 * time.Millisecond
+	connectionPool := NewConnectionPool("unix", testSocket, 1, timeout, timeout, timeout, time.Hour, "", "")
+	connectionPool.SharedConnections = 1
+	sharedConnection := connectionPool.SharedConnection()
+
+	expectResponse := func(key string) {
+		responses, _, err := sharedConnection.Do([]protocol.Command{_getCommand(test, key)}, 0)
+		if err != nil || len(responses) != 1 || string(responses[0]) != "+"+key+"\r\n" {
+			test.Fatalf("Expected the response for %s, got %q: %v", key, responses, err)
+		}
+	}
+	expectResponse("a")
+
+	// A connection that outlived its reconnect interval is replaced
+	sharedConnection.lock.Lock()
+	expired := sharedConnection.connection
+	expired.nextReconnect = time.Now()
+	sharedConnection.lock.Unlock()
+	expectResponse("b")
+	if n := atomic.LoadInt32(accepted); n != 2 || connectionPool.Expirations != 1 {
+		test.Errorf("Expected the expired connection to be replaced, got %d connections and %d expirations", n,
+			connectionPool.Expirations)
+	}
+
+	// So is a connection that authenticated with credentials that were rotated since
+	sharedConnection.lock.Lock()
+	sharedConnection.connection.authGeneration--
+	sharedConnection.lock.Unlock()
+	expectResponse("c")
+	if n := atomic.LoadInt32(accepted); n != 3 {
+		test.Errorf("Expected the connection with rotated credentials to be replaced, got %d connections", n)
+	}
+
+	// The retired connections are closed once their responses were read
+	for i := 0; i < 100; i++ {
+		sharedConnection.lock.Lock()
+		closed := expired.connection == nil
+		sharedConnection.lock.Unlock()
+		if closed {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	test.Errorf("Expected the expired connection to be closed")
+}
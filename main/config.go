@@ -26,31 +26,267 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
+	"rmux/connection"
+	"time"
 )
 
 type PoolConfig struct {
-	Host                          string   `json:"host"`
-	Port                          int      `json:"port"`
-	Socket                        string   `json:"socket"`
-	MaxProcesses                  int      `json:"maxProcesses"`
-	PoolSize                      int      `json:"poolSize"`
-	TcpConnections                []string `json:"tcpConnections"`
-	UnixConnections               []string `json:"unixConnections"`
-	AuthUser                      string   `json:"authUser"`
-	AuthPassword                  string   `json:"authPassword"`
-	LocalTimeout                  int64    `json:"localTimeout"`
-	LocalReadTimeout              int64    `json:"localReadTimeout"`
-	LocalWriteTimeout             int64    `json:"localWriteTimeout"`
-	LocalTransactionTimeout       int64    `json:"localTransactionTimeout"`
-	RemoteTimeout                 int64    `json:"remoteTimeout"`
-	RemoteReadTimeout             int64    `json:"remoteReadTimeout"`
-	RemoteWriteTimeout            int64    `json:"remoteWriteTimeout"`
-	RemoteReconnectInterval       int64    `json:"remoteReconnectInterval"`
-	RemoteDiagnosticCheckInterval int64    `json:"remoteDiagnosticCheckInterval"`
-	RemoteConnectTimeout          int64    `json:"remoteConnectTimeout"`
-	Failover                      bool     `json:"failover"`
+	Host                          string           `json:"host"`
+	Port                          int              `json:"port"`
+	Socket                        string           `json:"socket"`
+	Priority                      int              `json:"priority"`
+	Listeners                     []ListenerConfig `json:"listeners"`
+	MaxProcesses                  int              `json:"maxProcesses"`
+	PoolSize                      int              `json:"poolSize"`
+	TcpConnections                []string         `json:"tcpConnections"`
+	UnixConnections               []string         `json:"unixConnections"`
+	Endpoints                     []EndpointConfig `json:"endpoints"`
+	AuthUser                      string           `json:"authUser"`
+	AuthPassword                  string           `json:"authPassword"`
+	LocalTimeout                  int64            `json:"localTimeout"`
+	LocalReadTimeout              int64            `json:"localReadTimeout"`
+	LocalWriteTimeout             int64            `json:"localWriteTimeout"`
+	LocalIdleTimeout              int64            `json:"localIdleTimeout"`
+	LocalTransactionTimeout       int64            `json:"localTransactionTimeout"`
+	LocalMaxInFlight              int              `json:"localMaxInFlight"`
+	LocalWriteHighWaterMark       int              `json:"localWriteHighWaterMark"`
+	LocalMaxBulkLength            int              `json:"localMaxBulkLength"`
+	LocalMaxArguments             int              `json:"localMaxArguments"`
+	LocalMaxInlineLength          int              `json:"localMaxInlineLength"`
+	LocalMaxPipelineDepth         int              `json:"localMaxPipelineDepth"`
+	LocalOutputHardLimit          int64            `json:"localOutputHardLimit"`
+	LocalOutputSoftLimit          int64            `json:"localOutputSoftLimit"`
+	LocalOutputSoftLimitDuration  int64            `json:"localOutputSoftLimitDuration"`
+	LocalOutputBudget             int64            `json:"localOutputBudget"`
+	MaxClients                    int              `json:"maxClients"`
+	MaxClientsPerSource           int              `json:"maxClientsPerSource"`
+	RateLimit                     int              `json:"rateLimit"`
+	ClientRateLimit               int              `json:"clientRateLimit"`
+	WriteRateLimit                int              `json:"writeRateLimit"`
+	HeavyRateLimit                int              `json:"heavyRateLimit"`
+	RateLimitDelay                int64            `json:"rateLimitDelay"`
+	RemoteTimeout                 int64            `json:"remoteTimeout"`
+	RemoteReadTimeout             int64            `json:"remoteReadTimeout"`
+	RemoteWriteTimeout            int64            `json:"remoteWriteTimeout"`
+	RemoteReconnectInterval       int64            `json:"remoteReconnectInterval"`
+	RemoteReconnectJitter         int64            `json:"remoteReconnectJitter"`
+	RemoteMinIdle                 int              `json:"remoteMinIdle"`
+	RemoteMaxIdleTime             int64            `json:"remoteMaxIdleTime"`
+	RemoteDiagnosticCheckInterval int64            `json:"remoteDiagnosticCheckInterval"`
+	RemoteDiagnosticCheckTimeout  int64            `json:"remoteDiagnosticCheckTimeout"`
+	RemoteWaitTimeout             int64            `json:"remoteWaitTimeout"`
+	RemoteMaxWaiters              int              `json:"remoteMaxWaiters"`
+	RemoteSharedConnections       int              `json:"remoteSharedConnections"`
+	RemoteConcurrencyMinLimit     int              `json:"remoteConcurrencyMinLimit"`
+	RemoteConcurrencyTolerance    float64          `json:"remoteConcurrencyTolerance"`
+	RemoteDialBackoffMin          int64            `json:"remoteDialBackoffMin"`
+	RemoteDialBackoffMax          int64            `json:"remoteDialBackoffMax"`
+	RemoteIdleValidationThreshold int64            `json:"remoteIdleValidationThreshold"`
+	RemoteIdlePingInterval        int64            `json:"remoteIdlePingInterval"`
+	RemoteLongCheckoutThreshold   int64            `json:"remoteLongCheckoutThreshold"`
+	RemoteHealthFailureThreshold  int              `json:"remoteHealthFailureThreshold"`
+	RemoteHealthSuccessThreshold  int              `json:"remoteHealthSuccessThreshold"`
+	RemoteConnectTimeout          int64            `json:"remoteConnectTimeout"`
+	CredentialRefreshInterval     int64            `json:"credentialRefreshInterval"`
+	CircuitFailureThreshold       int              `json:"circuitFailureThreshold"`
+	CircuitOpenTimeout            int64            `json:"circuitOpenTimeout"`
+	CircuitHalfOpenRequests       int              `json:"circuitHalfOpenRequests"`
+	CircuitSuccessThreshold       int              `json:"circuitSuccessThreshold"`
+	Failover                      bool             `json:"failover"`
+	AdminAddress                  string           `json:"adminAddress"`
+}
+
+// Configuration of an additional address to listen for clients on, whose clients belong to their own priority class
+type ListenerConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Socket   string `json:"socket"`
+	Priority int    `json:"priority"`
+}
+
+// Configuration of a single upstream redis server
+// Can either be given as an endpoint URI string, or as an object. An object may also contain a uri, in which case the
+// remaining fields of the object override the settings taken from the uri. Database and Weight are pointers, so that an
+// explicit 0 overrides the uri as well.
+type EndpointConfig struct {
+	Uri                 string     `json:"uri"`
+	Protocol            string     `json:"protocol"`
+	Address             string     `json:"address"`
+	AuthUser            string     `json:"authUser"`
+	AuthPassword        string     `json:"authPassword"`
+	Database            *int       `json:"database"`
+	PoolSize            int        `json:"poolSize"`
+	MinIdle             int        `json:"minIdle"`
+	Timeout             int64      `json:"timeout"`
+	ConnectTimeout      int64      `json:"connectTimeout"`
+	ReadTimeout         int64      `json:"readTimeout"`
+	WriteTimeout        int64      `json:"writeTimeout"`
+	HealthCheckInterval int64      `json:"healthCheckInterval"`
+	HealthCheckTimeout  int64      `json:"healthCheckTimeout"`
+	Weight              *int       `json:"weight"`
+	Tls                 *TlsConfig `json:"tls"`
+}
+
+// TLS settings of an endpoint
+type TlsConfig struct {
+	CaFile             string `json:"caFile"`
+	CertFile           string `json:"certFile"`
+	KeyFile            string `json:"keyFile"`
+	ServerName         string `json:"serverName"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+}
+
+func (this *EndpointConfig) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*this = EndpointConfig{}
+		return json.Unmarshal(data, &this.Uri)
+	}
+
+	// A distinct type without the UnmarshalJSON method, to avoid recursing back into this function
+	type plainEndpointConfig EndpointConfig
+	return json.Unmarshal(data, (*plainEndpointConfig)(this))
+}
+
+// Creates the connection endpoints of this configuration, and verifies that the hash ring can hold all connections
+// with their weights
+func (this *PoolConfig) EndpointList() (endpoints []*connection.Endpoint, err error) {
+	totalWeight := len(this.TcpConnections) + len(this.UnixConnections)
+	for _, endpointConfig := range this.Endpoints {
+		endpoint, err := endpointConfig.Endpoint()
+		if err != nil {
+			return nil, err
+		}
+		// Connections without a weight count once
+		if endpoint.Weight > 0 {
+			totalWeight += endpoint.Weight
+		} else {
+			totalWeight++
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+
+	if totalWeight > connection.MAX_HASH_RING_WEIGHT {
+		return nil, fmt.Errorf("the weights of all connections add up to %d, but may not exceed %d", totalWeight,
+			connection.MAX_HASH_RING_WEIGHT)
+	}
+	return endpoints, nil
+}
+
+// Creates the connection endpoint described by this configuration
+func (this *EndpointConfig) Endpoint() (endpoint *connection.Endpoint, err error) {
+	if this.Uri != "" {
+		if endpoint, err = connection.ParseEndpointURI(this.Uri); err != nil {
+			return nil, err
+		}
+	} else {
+		endpoint = &connection.Endpoint{Protocol: "tcp"}
+	}
+
+	if this.Protocol != "" {
+		endpoint.Protocol = this.Protocol
+	}
+	if this.Address != "" {
+		endpoint.Address = this.Address
+	}
+	if this.AuthUser != "" {
+		endpoint.AuthUser = this.AuthUser
+	}
+	if this.AuthPassword != "" {
+		endpoint.AuthPassword = this.AuthPassword
+	}
+	if this.Database != nil {
+		endpoint.Database = *this.Database
+	}
+	if this.PoolSize != 0 {
+		endpoint.PoolSize = this.PoolSize
+	}
+	if this.MinIdle != 0 {
+		endpoint.MinIdle = this.MinIdle
+	}
+	if this.Timeout != 0 {
+		endpoint.ConnectTimeout = time.Duration(this.Timeout) * time.Millisecond
+		endpoint.ReadTimeout = endpoint.ConnectTimeout
+		endpoint.WriteTimeout = endpoint.ConnectTimeout
+	}
+	if this.ConnectTimeout != 0 {
+		endpoint.ConnectTimeout = time.Duration(this.ConnectTimeout) * time.Millisecond
+	}
+	if this.ReadTimeout != 0 {
+		endpoint.ReadTimeout = time.Duration(this.ReadTimeout) * time.Millisecond
+	}
+	if this.WriteTimeout != 0 {
+		endpoint.WriteTimeout = time.Duration(this.WriteTimeout) * time.Millisecond
+	}
+	if this.HealthCheckInterval != 0 {
+		endpoint.HealthCheckInterval = time.Duration(this.HealthCheckInterval) * time.Millisecond
+	}
+	if this.HealthCheckTimeout != 0 {
+		endpoint.HealthCheckTimeout = time.Duration(this.HealthCheckTimeout) * time.Millisecond
+	}
+	if this.Weight != nil {
+		endpoint.Weight = *this.Weight
+	}
+
+	if endpoint.Address == "" {
+		return nil, connection.ERR_ENDPOINT_ADDRESS_MISSING
+	} else if endpoint.Protocol != "tcp" && endpoint.Protocol != "unix" {
+		return nil, fmt.Errorf("unsupported protocol %q for endpoint %s", endpoint.Protocol, endpoint.Address)
+	} else if endpoint.Database < 0 || endpoint.PoolSize < 0 || endpoint.MinIdle < 0 || endpoint.Weight < 0 {
+		return nil, fmt.Errorf("database, poolSize, minIdle and weight of endpoint %s must not be negative", endpoint.Address)
+	}
+
+	if this.Tls != nil {
+		if endpoint.TLSConfig, err = this.Tls.tlsConfig(endpoint); err != nil {
+			return nil, err
+		}
+	}
+
+	return endpoint, nil
+}
+
+// Builds the tls.Config for the given endpoint, loading any referenced certificate files
+func (this *TlsConfig) tlsConfig(endpoint *connection.Endpoint) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         this.ServerName,
+		InsecureSkipVerify: this.InsecureSkipVerify,
+	}
+
+	if tlsConfig.ServerName == "" && endpoint.Protocol == "tcp" {
+		if host, _, err := net.SplitHostPort(endpoint.Address); err == nil {
+			tlsConfig.ServerName = host
+		}
+	}
+
+	if this.CaFile != "" {
+		caPem, err := ioutil.ReadFile(this.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificates found in %s", this.CaFile)
+		}
+	}
+
+	if this.CertFile != "" || this.KeyFile != "" {
+		if this.CertFile == "" || this.KeyFile == "" {
+			return nil, errors.New("tls certFile and keyFile must be given together")
+		}
+		certificate, err := tls.LoadX509KeyPair(this.CertFile, this.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
 }
 
 func ReadConfigFromFile(configFile string) ([]PoolConfig, error) {
@@ -32,6 +32,7 @@ import (
 	"net"
 	"os"
 	"rmux"
+	"rmux/connection"
 	"rmux/graphite"
 	"rmux/log"
 	"runtime"
@@ -52,16 +53,58 @@ var maxProcesses = flag.Int("maxProcesses", 0, "The number of processes to use.
 var poolSize = flag.Int("poolSize", DEFAULT_POOL_SIZE, "The size of the connection pools to use")
 var tcpConnections = flag.String("tcpConnections", "localhost:6380 localhost:6381", "TCP connections (destination redis servers) to multiplex over")
 var unixConnections = flag.String("unixConnections", "", "Unix connections (destination redis servers) to multiplex over")
+var endpoints = flag.String("endpoints", "", "Endpoint URIs (redis://, rediss:// or unix://) of destination redis servers to multiplex over")
 var localTimeout = flag.Int64("localTimeout", 0, "Timeout to set locally in milliseconds (read+write)")
 var localReadTimeout = flag.Int64("localReadTimeout", 0, "Timeout to set locally in milliseconds (read)")
 var localWriteTimeout = flag.Int64("localWriteTimeout", 0, "Timeout to set locally (write)")
+var localIdleTimeout = flag.Int64("localIdleTimeout", 0, "How long a client may wait between commands in milliseconds")
 var localTransactionTimeout = flag.Int64("localTransactionTimeout", 0, "Timeout to set for locally in milliseconds (connect)")
+var localMaxInFlight = flag.Int("localMaxInFlight", 0, "Pipelined commands of a client that are sent to the destination redis servers at once")
+var localWriteHighWaterMark = flag.Int("localWriteHighWaterMark", 0, "Bytes buffered for a client before they are written to it")
+var localMaxBulkLength = flag.Int("localMaxBulkLength", 0, "The longest bulk string a client may send, in bytes")
+var localMaxArguments = flag.Int("localMaxArguments", 0, "The most arguments a client may send with a command")
+var localMaxInlineLength = flag.Int("localMaxInlineLength", 0, "The longest inline command a client may send, in bytes")
+var localMaxPipelineDepth = flag.Int("localMaxPipelineDepth", 0, "The most commands a client may pipeline before waiting for responses")
+var localOutputHardLimit = flag.Int64("localOutputHardLimit", 0, "Bytes of responses held for a client that disconnect it")
+var localOutputSoftLimit = flag.Int64("localOutputSoftLimit", 0, "Bytes of responses held for a client that disconnect it after localOutputSoftLimitDuration")
+var localOutputSoftLimitDuration = flag.Int64("localOutputSoftLimitDuration", 0, "How long a client may hold more than localOutputSoftLimit in milliseconds")
+var localOutputBudget = flag.Int64("localOutputBudget", 0, "Bytes of responses held for all clients together, before the clients holding the most are disconnected")
+var priority = flag.Int("priority", 0, "The priority class of clients waiting for a redis connection.  Higher classes are served first, and lower classes turned away first")
+var maxClients = flag.Int("maxClients", 0, "The most clients connected at once")
+var maxClientsPerSource = flag.Int("maxClientsPerSource", 0, "The most clients connected at once from a single IP address or unix user")
+var rateLimit = flag.Int("rateLimit", 0, "Commands per second all clients together may send")
+var clientRateLimit = flag.Int("clientRateLimit", 0, "Commands per second the clients of a single AUTH user, client name, IP address or unix user may send")
+var writeRateLimit = flag.Int("writeRateLimit", 0, "Write commands per second all clients together may send")
+var heavyRateLimit = flag.Int("heavyRateLimit", 0, "Heavy commands, such as sort or zunionstore, per second all clients together may send")
+var rateLimitDelay = flag.Int64("rateLimitDelay", 0, "How long a command beyond a rate limit may be delayed in milliseconds, instead of being rejected")
 var remoteTimeout = flag.Int64("remoteTimeout", 0, "Timeout to set for remote redises (connect+read+write)")
 var remoteReadTimeout = flag.Int64("remoteReadTimeout", 0, "Timeout to set for remote redises (read)")
 var remoteWriteTimeout = flag.Int64("remoteWriteTimeout", 0, "Timeout to set for remote redises (write)")
 var remoteConnectTimeout = flag.Int64("remoteConnectTimeout", 0, "Timeout to set for remote redises (connect)")
 var remoteReconnectInterval = flag.Int64("remoteReconnectInterval", 0, "Interval in which connected redis connections will be forced to reconnect in minutes")
+var remoteReconnectJitter = flag.Int64("remoteReconnectJitter", 0, "Up to how much earlier than the reconnect interval redis connections are randomly reconnected in minutes")
+var remoteMinIdle = flag.Int("remoteMinIdle", 0, "Amount of idle redis connections per destination that are dialed ahead of time and kept connected")
+var remoteMaxIdleTime = flag.Int64("remoteMaxIdleTime", 0, "Idle time after which redis connections beyond remoteMinIdle are closed in seconds")
 var remoteDiagnosticCheckInterval = flag.Int64("remoteDiagnosticCheckInterval", 0, "Interval to check the diagnostic connection in seconds")
+var remoteDiagnosticCheckTimeout = flag.Int64("remoteDiagnosticCheckTimeout", 0, "Timeout of the diagnostic connection checks in milliseconds (connect+read+write)")
+var remoteWaitTimeout = flag.Int64("remoteWaitTimeout", 0, "Time clients wait for a free redis connection in milliseconds")
+var remoteMaxWaiters = flag.Int("remoteMaxWaiters", 0, "Clients that may wait for a free redis connection per destination before clients are turned away (0 is unlimited)")
+var remoteSharedConnections = flag.Int("remoteSharedConnections", 0, "Redis connections per destination shared by all clients for stateless commands (0 gives every request a connection of its own)")
+var remoteConcurrencyMinLimit = flag.Int("remoteConcurrencyMinLimit", 0, "The lowest limit on the requests in flight per destination an adaptive concurrency limit may drop to (0 disables adaptive concurrency limits)")
+var remoteConcurrencyTolerance = flag.Float64("remoteConcurrencyTolerance", 0, "Factor by which redis round trips may exceed their average before the concurrency limit of a destination is reduced")
+var remoteDialBackoffMin = flag.Int64("remoteDialBackoffMin", 0, "Delay before probing a redis server that could not be dialed in milliseconds")
+var remoteDialBackoffMax = flag.Int64("remoteDialBackoffMax", 0, "Maximum delay between probes of a redis server that could not be dialed in milliseconds")
+var remoteIdleValidationThreshold = flag.Int64("remoteIdleValidationThreshold", 0, "Idle time after which pooled redis connections are probed before use in milliseconds")
+var remoteIdlePingInterval = flag.Int64("remoteIdlePingInterval", 0, "Interval to ping idle pooled redis connections in seconds")
+var remoteLongCheckoutThreshold = flag.Int64("remoteLongCheckoutThreshold", 0, "Time after which a checked out redis connection is reported in milliseconds (negative disables the reports)")
+var remoteHealthFailureThreshold = flag.Int("remoteHealthFailureThreshold", 0, "Consecutive failed diagnostic checks that mark a destination redis server down")
+var remoteHealthSuccessThreshold = flag.Int("remoteHealthSuccessThreshold", 0, "Consecutive successful diagnostic checks that mark a destination redis server up again")
+var credentialRefreshInterval = flag.Int64("credentialRefreshInterval", 0, "Interval to re-read credentials given as file: or env: references in seconds")
+var circuitFailureThreshold = flag.Int("circuitFailureThreshold", 0, "Consecutive failed requests that open the circuit breaker of a destination redis server (0 disables circuit breakers)")
+var circuitOpenTimeout = flag.Int64("circuitOpenTimeout", 0, "Time an open circuit waits before probing its destination redis server again in milliseconds")
+var circuitHalfOpenRequests = flag.Int("circuitHalfOpenRequests", 0, "Concurrent probe requests allowed while a circuit is half-open")
+var circuitSuccessThreshold = flag.Int("circuitSuccessThreshold", 0, "Consecutive successful probe requests that close a half-open circuit")
+var adminAddress = flag.String("adminAddress", "", "The tcp address to serve the http admin interface on.  If this is not defined, there is no admin interface")
 var cpuProfile = flag.String("cpuProfile", "", "Direct CPU Profile to target file")
 var configFile = flag.String("config", "", "Configuration file (JSON)")
 var doDebug = flag.Bool("debug", false, "Debug mode")
@@ -121,7 +164,10 @@ func main() {
 
 func configureFromArgs() ([]PoolConfig, error) {
 	var arrTcpConnections []string
-	if *tcpConnections != "" {
+	if *endpoints != "" && !isFlagSet("tcpConnections") {
+		// Endpoints replace the default tcp connections, unless those were given explicitly as well
+		arrTcpConnections = []string{}
+	} else if *tcpConnections != "" {
 		arrTcpConnections = strings.Split(*tcpConnections, " ")
 	} else {
 		arrTcpConnections = []string{}
@@ -134,28 +180,80 @@ func configureFromArgs() ([]PoolConfig, error) {
 		arrUnixConnections = []string{}
 	}
 
+	var arrEndpoints []EndpointConfig
+	if *endpoints != "" {
+		for _, uri := range strings.Split(*endpoints, " ") {
+			arrEndpoints = append(arrEndpoints, EndpointConfig{Uri: uri})
+		}
+	}
+
 	config := []PoolConfig{{
 		Host:         *host,
 		Port:         *port,
 		Socket:       *socket,
+		Priority:     *priority,
 		MaxProcesses: *maxProcesses,
 		PoolSize:     *poolSize,
 		Failover:     *failover,
 
 		TcpConnections:  arrTcpConnections,
 		UnixConnections: arrUnixConnections,
-
-		LocalTimeout:            *localTimeout,
-		LocalReadTimeout:        *localReadTimeout,
-		LocalWriteTimeout:       *localWriteTimeout,
-		LocalTransactionTimeout: *localTransactionTimeout,
+		Endpoints:       arrEndpoints,
+
+		LocalTimeout:                 *localTimeout,
+		LocalReadTimeout:             *localReadTimeout,
+		LocalWriteTimeout:            *localWriteTimeout,
+		LocalIdleTimeout:             *localIdleTimeout,
+		LocalTransactionTimeout:      *localTransactionTimeout,
+		LocalMaxInFlight:             *localMaxInFlight,
+		LocalWriteHighWaterMark:      *localWriteHighWaterMark,
+		LocalMaxBulkLength:           *localMaxBulkLength,
+		LocalMaxArguments:            *localMaxArguments,
+		LocalMaxInlineLength:         *localMaxInlineLength,
+		LocalMaxPipelineDepth:        *localMaxPipelineDepth,
+		LocalOutputHardLimit:         *localOutputHardLimit,
+		LocalOutputSoftLimit:         *localOutputSoftLimit,
+		LocalOutputSoftLimitDuration: *localOutputSoftLimitDuration,
+		LocalOutputBudget:            *localOutputBudget,
+		MaxClients:                   *maxClients,
+		MaxClientsPerSource:          *maxClientsPerSource,
+		RateLimit:                    *rateLimit,
+		ClientRateLimit:              *clientRateLimit,
+		WriteRateLimit:               *writeRateLimit,
+		HeavyRateLimit:               *heavyRateLimit,
+		RateLimitDelay:               *rateLimitDelay,
 
 		RemoteTimeout:                 *remoteTimeout,
 		RemoteReadTimeout:             *remoteReadTimeout,
 		RemoteWriteTimeout:            *remoteWriteTimeout,
 		RemoteConnectTimeout:          *remoteConnectTimeout,
 		RemoteReconnectInterval:       *remoteReconnectInterval,
+		RemoteReconnectJitter:         *remoteReconnectJitter,
+		RemoteMinIdle:                 *remoteMinIdle,
+		RemoteMaxIdleTime:             *remoteMaxIdleTime,
 		RemoteDiagnosticCheckInterval: *remoteDiagnosticCheckInterval,
+		RemoteDiagnosticCheckTimeout:  *remoteDiagnosticCheckTimeout,
+		RemoteWaitTimeout:             *remoteWaitTimeout,
+		RemoteMaxWaiters:              *remoteMaxWaiters,
+		RemoteSharedConnections:       *remoteSharedConnections,
+		RemoteConcurrencyMinLimit:     *remoteConcurrencyMinLimit,
+		RemoteConcurrencyTolerance:    *remoteConcurrencyTolerance,
+		RemoteDialBackoffMin:          *remoteDialBackoffMin,
+		RemoteDialBackoffMax:          *remoteDialBackoffMax,
+		RemoteIdleValidationThreshold: *remoteIdleValidationThreshold,
+		RemoteIdlePingInterval:        *remoteIdlePingInterval,
+		RemoteLongCheckoutThreshold:   *remoteLongCheckoutThreshold,
+		RemoteHealthFailureThreshold:  *remoteHealthFailureThreshold,
+		RemoteHealthSuccessThreshold:  *remoteHealthSuccessThreshold,
+
+		CredentialRefreshInterval: *credentialRefreshInterval,
+
+		CircuitFailureThreshold: *circuitFailureThreshold,
+		CircuitOpenTimeout:      *circuitOpenTimeout,
+		CircuitHalfOpenRequests: *circuitHalfOpenRequests,
+		CircuitSuccessThreshold: *circuitSuccessThreshold,
+
+		AdminAddress: *adminAddress,
 	}}
 
 	return config, nil
@@ -171,7 +269,7 @@ func createInstances(configs []PoolConfig) (rmuxInstances []*rmux.RedisMultiplex
 					continue
 				}
 
-				instance.Listener.Close()
+				instance.CloseListeners()
 			}
 
 			rmuxInstances = nil
@@ -210,6 +308,28 @@ func createInstances(configs []PoolConfig) (rmuxInstances []*rmux.RedisMultiplex
 
 		rmuxInstance.Failover = config.Failover
 
+		if config.Priority != 0 {
+			rmuxInstance.ClientPriority = config.Priority
+			log.Info("Setting the priority class of clients to: %d", config.Priority)
+		}
+
+		for _, listener := range config.Listeners {
+			if listener.Socket != "" {
+				syscall.Umask(0111)
+				log.Info("Listening on socket %s with priority class %d", listener.Socket, listener.Priority)
+				if err = os.RemoveAll(listener.Socket); err != nil {
+					return
+				}
+				err = rmuxInstance.AddListener("unix", listener.Socket, listener.Priority)
+			} else {
+				log.Info("Listening on host: %s and port: %d with priority class %d", listener.Host, listener.Port, listener.Priority)
+				err = rmuxInstance.AddListener("tcp", net.JoinHostPort(listener.Host, strconv.Itoa(listener.Port)), listener.Priority)
+			}
+			if err != nil {
+				return
+			}
+		}
+
 		if config.LocalTimeout != 0 {
 			timeout := time.Duration(config.LocalTimeout) * time.Millisecond
 			rmuxInstance.ClientReadTimeout = timeout
@@ -229,12 +349,101 @@ func createInstances(configs []PoolConfig) (rmuxInstances []*rmux.RedisMultiplex
 			log.Info("Setting local client write timeout to: %s", timeout)
 		}
 
+		if config.LocalIdleTimeout > 0 {
+			timeout := time.Duration(config.LocalIdleTimeout) * time.Millisecond
+			rmuxInstance.ClientIdleTimeout = timeout
+			log.Info("Setting local client idle timeout to: %s", timeout)
+		}
+
 		if config.LocalTransactionTimeout != 0 {
 			timeout := time.Duration(config.LocalTransactionTimeout) * time.Millisecond
 			rmuxInstance.ClientTransactionTimeout = timeout
 			log.Info("Setting local client transaction timeout to: %s", timeout)
 		}
 
+		if config.LocalMaxInFlight > 0 {
+			rmuxInstance.ClientMaxInFlight = config.LocalMaxInFlight
+			log.Info("Setting local client max in flight commands to: %d", config.LocalMaxInFlight)
+		}
+
+		if config.LocalWriteHighWaterMark > 0 {
+			rmuxInstance.ClientWriteHighWaterMark = config.LocalWriteHighWaterMark
+			log.Info("Setting local client write high water mark to: %d bytes", config.LocalWriteHighWaterMark)
+		}
+
+		if config.LocalMaxBulkLength > 0 {
+			rmuxInstance.ClientMaxBulkLength = config.LocalMaxBulkLength
+			log.Info("Setting local client max bulk length to: %d bytes", config.LocalMaxBulkLength)
+		}
+
+		if config.LocalMaxArguments > 0 {
+			rmuxInstance.ClientMaxArguments = config.LocalMaxArguments
+			log.Info("Setting local client max arguments to: %d", config.LocalMaxArguments)
+		}
+
+		if config.LocalMaxInlineLength > 0 {
+			rmuxInstance.ClientMaxInlineLength = config.LocalMaxInlineLength
+			log.Info("Setting local client max inline length to: %d bytes", config.LocalMaxInlineLength)
+		}
+
+		if config.LocalMaxPipelineDepth > 0 {
+			rmuxInstance.ClientMaxPipelineDepth = config.LocalMaxPipelineDepth
+			log.Info("Setting local client max pipeline depth to: %d", config.LocalMaxPipelineDepth)
+		}
+
+		if config.LocalOutputHardLimit > 0 {
+			rmuxInstance.ClientOutputHardLimit = config.LocalOutputHardLimit
+			log.Info("Setting local client output hard limit to: %d bytes", config.LocalOutputHardLimit)
+		}
+
+		if config.LocalOutputSoftLimit > 0 {
+			duration := time.Duration(config.LocalOutputSoftLimitDuration) * time.Millisecond
+			rmuxInstance.ClientOutputSoftLimit = config.LocalOutputSoftLimit
+			rmuxInstance.ClientOutputSoftLimitDuration = duration
+			log.Info("Setting local client output soft limit to: %d bytes for %s", config.LocalOutputSoftLimit, duration)
+		}
+
+		if config.LocalOutputBudget > 0 {
+			rmuxInstance.ClientOutputBudget = config.LocalOutputBudget
+			log.Info("Setting the output budget of all clients to: %d bytes", config.LocalOutputBudget)
+		}
+
+		if config.MaxClients > 0 {
+			rmuxInstance.MaxClients = config.MaxClients
+			log.Info("Setting max clients to: %d", config.MaxClients)
+		}
+
+		if config.MaxClientsPerSource > 0 {
+			rmuxInstance.MaxClientsPerSource = config.MaxClientsPerSource
+			log.Info("Setting max clients per source to: %d", config.MaxClientsPerSource)
+		}
+
+		if config.RateLimit > 0 {
+			rmuxInstance.RateLimit = config.RateLimit
+			log.Info("Setting the rate limit of all clients to: %d commands per second", config.RateLimit)
+		}
+
+		if config.ClientRateLimit > 0 {
+			rmuxInstance.ClientRateLimit = config.ClientRateLimit
+			log.Info("Setting the rate limit of each client identity to: %d commands per second", config.ClientRateLimit)
+		}
+
+		if config.WriteRateLimit > 0 {
+			rmuxInstance.WriteRateLimit = config.WriteRateLimit
+			log.Info("Setting the rate limit of write commands to: %d per second", config.WriteRateLimit)
+		}
+
+		if config.HeavyRateLimit > 0 {
+			rmuxInstance.HeavyRateLimit = config.HeavyRateLimit
+			log.Info("Setting the rate limit of heavy commands to: %d per second", config.HeavyRateLimit)
+		}
+
+		if config.RateLimitDelay > 0 {
+			delay := time.Duration(config.RateLimitDelay) * time.Millisecond
+			rmuxInstance.RateLimitDelay = delay
+			log.Info("Setting the longest rate limit delay to: %s", delay)
+		}
+
 		if config.RemoteTimeout != 0 {
 			duration := time.Duration(config.RemoteTimeout) * time.Millisecond
 			rmuxInstance.EndpointConnectTimeout = duration
@@ -267,12 +476,136 @@ func createInstances(configs []PoolConfig) (rmuxInstances []*rmux.RedisMultiplex
 			log.Info("Setting remote reconnect interval to: %s", interval)
 		}
 
+		if config.RemoteReconnectJitter != 0 {
+			jitter := time.Duration(config.RemoteReconnectJitter) * time.Minute
+			rmuxInstance.EndpointReconnectJitter = jitter
+			log.Info("Setting remote reconnect jitter to: %s", jitter)
+		}
+
+		if config.RemoteMinIdle > 0 {
+			rmuxInstance.EndpointMinIdle = config.RemoteMinIdle
+			log.Info("Keeping %d idle remote connections connected", config.RemoteMinIdle)
+		}
+
+		if config.RemoteMaxIdleTime != 0 {
+			idleTime := time.Duration(config.RemoteMaxIdleTime) * time.Second
+			rmuxInstance.EndpointMaxIdleTime = idleTime
+			log.Info("Setting remote max idle time to: %s", idleTime)
+		}
+
 		if config.RemoteDiagnosticCheckInterval != 0 {
 			interval := time.Duration(config.RemoteDiagnosticCheckInterval) * time.Second
 			rmuxInstance.EndpointDiagnosticCheckInterval = interval
 			log.Info("Setting remote diagnostic check interval to: %s", interval)
 		}
 
+		if config.RemoteDiagnosticCheckTimeout != 0 {
+			timeout := time.Duration(config.RemoteDiagnosticCheckTimeout) * time.Millisecond
+			rmuxInstance.EndpointDiagnosticCheckTimeout = timeout
+			log.Info("Setting remote diagnostic check timeout to: %s", timeout)
+		}
+
+		if config.RemoteWaitTimeout != 0 {
+			timeout := time.Duration(config.RemoteWaitTimeout) * time.Millisecond
+			rmuxInstance.EndpointWaitTimeout = timeout
+			log.Info("Setting remote wait timeout to: %s", timeout)
+		}
+
+		if config.RemoteMaxWaiters > 0 {
+			rmuxInstance.EndpointMaxWaiters = config.RemoteMaxWaiters
+			log.Info("Setting remote max waiters to: %d", config.RemoteMaxWaiters)
+		}
+
+		if config.RemoteSharedConnections > 0 {
+			rmuxInstance.EndpointSharedConnections = config.RemoteSharedConnections
+			log.Info("Setting remote shared connections to: %d", config.RemoteSharedConnections)
+		}
+
+		if config.RemoteConcurrencyMinLimit > 0 {
+			rmuxInstance.EndpointConcurrencyMinLimit = config.RemoteConcurrencyMinLimit
+			log.Info("Enabling adaptive concurrency limits down to: %d", config.RemoteConcurrencyMinLimit)
+		}
+
+		if config.RemoteConcurrencyTolerance > 0 {
+			rmuxInstance.EndpointConcurrencyTolerance = config.RemoteConcurrencyTolerance
+			log.Info("Setting remote concurrency tolerance to: %g", config.RemoteConcurrencyTolerance)
+		}
+
+		if config.RemoteDialBackoffMin != 0 {
+			delay := time.Duration(config.RemoteDialBackoffMin) * time.Millisecond
+			rmuxInstance.EndpointDialBackoffMin = delay
+			log.Info("Setting remote dial backoff min to: %s", delay)
+		}
+
+		if config.RemoteDialBackoffMax != 0 {
+			delay := time.Duration(config.RemoteDialBackoffMax) * time.Millisecond
+			rmuxInstance.EndpointDialBackoffMax = delay
+			log.Info("Setting remote dial backoff max to: %s", delay)
+		}
+
+		if config.RemoteIdleValidationThreshold != 0 {
+			threshold := time.Duration(config.RemoteIdleValidationThreshold) * time.Millisecond
+			rmuxInstance.EndpointIdleValidationThreshold = threshold
+			log.Info("Setting remote idle validation threshold to: %s", threshold)
+		}
+
+		if config.RemoteIdlePingInterval != 0 {
+			interval := time.Duration(config.RemoteIdlePingInterval) * time.Second
+			rmuxInstance.EndpointIdlePingInterval = interval
+			log.Info("Setting remote idle ping interval to: %s", interval)
+		}
+
+		if config.RemoteLongCheckoutThreshold != 0 {
+			threshold := time.Duration(config.RemoteLongCheckoutThreshold) * time.Millisecond
+			rmuxInstance.EndpointLongCheckoutThreshold = threshold
+			log.Info("Setting remote long checkout threshold to: %s", threshold)
+		}
+
+		if config.RemoteHealthFailureThreshold > 0 {
+			rmuxInstance.EndpointHealthFailureThreshold = config.RemoteHealthFailureThreshold
+			log.Info("Setting remote health failure threshold to: %d", config.RemoteHealthFailureThreshold)
+		}
+
+		if config.RemoteHealthSuccessThreshold > 0 {
+			rmuxInstance.EndpointHealthSuccessThreshold = config.RemoteHealthSuccessThreshold
+			log.Info("Setting remote health success threshold to: %d", config.RemoteHealthSuccessThreshold)
+		}
+
+		if config.CredentialRefreshInterval != 0 {
+			interval := time.Duration(config.CredentialRefreshInterval) * time.Second
+			rmuxInstance.CredentialRefreshInterval = interval
+			log.Info("Setting credential refresh interval to: %s", interval)
+		}
+
+		if config.CircuitFailureThreshold > 0 {
+			rmuxInstance.CircuitBreakerFailureThreshold = config.CircuitFailureThreshold
+			log.Info("Enabling circuit breakers after %d consecutive failures", config.CircuitFailureThreshold)
+		}
+
+		if config.CircuitOpenTimeout != 0 {
+			timeout := time.Duration(config.CircuitOpenTimeout) * time.Millisecond
+			rmuxInstance.CircuitBreakerOpenTimeout = timeout
+			log.Info("Setting circuit open timeout to: %s", timeout)
+		}
+
+		if config.CircuitHalfOpenRequests > 0 {
+			rmuxInstance.CircuitBreakerHalfOpenRequests = config.CircuitHalfOpenRequests
+			log.Info("Setting circuit half-open requests to: %d", config.CircuitHalfOpenRequests)
+		}
+
+		if config.CircuitSuccessThreshold > 0 {
+			rmuxInstance.CircuitBreakerSuccessThreshold = config.CircuitSuccessThreshold
+			log.Info("Setting circuit success threshold to: %d", config.CircuitSuccessThreshold)
+		}
+
+		if config.AdminAddress != "" {
+			rmuxInstance.AdminAddress = config.AdminAddress
+			log.Info("Setting admin address to: %s", config.AdminAddress)
+		}
+
+		if _, err = connection.NewCredentials(config.AuthUser, config.AuthPassword).Refresh(); err != nil {
+			return
+		}
 		rmuxInstance.AuthUser = config.AuthUser
 		rmuxInstance.AuthPassword = config.AuthPassword
 
@@ -290,6 +623,18 @@ func createInstances(configs []PoolConfig) (rmuxInstances []*rmux.RedisMultiplex
 			}
 		}
 
+		var endpoints []*connection.Endpoint
+		if endpoints, err = config.EndpointList(); err != nil {
+			return
+		}
+		for _, endpoint := range endpoints {
+			if _, err = connection.NewCredentials(endpoint.AuthUser, endpoint.AuthPassword).Refresh(); err != nil {
+				return
+			}
+			log.Info("Adding (destination) endpoint: %s", endpoint)
+			rmuxInstance.AddEndpoint(endpoint)
+		}
+
 		if rmuxInstance.PrimaryConnectionPool == nil {
 			err = errors.New("You must have at least one connection defined")
 			return
@@ -304,7 +649,7 @@ func start(rmuxInstances []*rmux.RedisMultiplexer) {
 
 	defer func() {
 		for _, rmuxInstance := range rmuxInstances {
-			rmuxInstance.Listener.Close()
+			rmuxInstance.CloseListeners()
 		}
 	}()
 
@@ -325,6 +670,16 @@ func start(rmuxInstances []*rmux.RedisMultiplexer) {
 	waitGroup.Wait()
 }
 
+// Returns whether the named flag was given on the command line
+func isFlagSet(name string) (isSet bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			isSet = true
+		}
+	})
+	return
+}
+
 // Terminates the program if the passed in error does not evaluate to nil.
 // err will be the first value of formatted string
 func terminateIfError(err error, format string, a ...interface{}) {
@@ -0,0 +1,210 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package rmux
+
+import (
+	"errors"
+	"rmux/graphite"
+	"rmux/log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Responses that were read for a client but not written to it yet are held in memory. A client that reads its
+// responses slowly, or asks for huge ones, is disconnected once it holds more than its output limits allow, or when the
+// clients of a multiplexer together hold more than its output budget.
+
+var ERR_OUTPUT_LIMIT = errors.New("Client output buffer limit reached")
+
+const (
+	//How often clients are checked for having been over their soft output limit for too long
+	EXTERN_OUTPUT_CHECK_INTERVAL = time.Second
+)
+
+// Limits on the output a single client holds, like the client-output-buffer-limit of redis. Zero disables a limit.
+type OutputLimits struct {
+	// Output beyond this disconnects the client right away
+	HardLimit int64
+	// Output beyond this for longer than SoftLimitDuration disconnects the client
+	SoftLimit         int64
+	SoftLimitDuration time.Duration
+}
+
+// The output held by all clients of a multiplexer together, and the clients holding it
+type OutputBudget struct {
+	// Once all clients together hold more than this, the clients holding the most are disconnected. Zero disables it
+	Limit int64
+	// The output held by all clients
+	total int64
+
+	lock    sync.Mutex
+	clients map[*Client]bool
+}
+
+func NewOutputBudget(limit int64) *OutputBudget {
+	return &OutputBudget{
+		Limit:   limit,
+		clients: make(map[*Client]bool),
+	}
+}
+
+// The output held by all clients
+func (this *OutputBudget) Total() int64 {
+	return atomic.LoadInt64(&this.total)
+}
+
+func (this *OutputBudget) register(client *Client) {
+	this.lock.Lock()
+	this.clients[client] = true
+	this.lock.Unlock()
+}
+
+func (this *OutputBudget) unregister(client *Client) {
+	this.lock.Lock()
+	delete(this.clients, client)
+	this.lock.Unlock()
+}
+
+// Adds n bytes to the output held by all clients, and disconnects the clients holding the most while the total is
+// beyond the limit
+func (this *OutputBudget) hold(n int64) {
+	total := atomic.AddInt64(&this.total, n)
+	if this.Limit <= 0 || total <= this.Limit {
+		return
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	// Clients that were disconnected already still hold their output until they noticed
+	for excess := total - this.Limit; excess > 0; {
+		var worst *Client
+		for client := range this.clients {
+			if !client.outputDisconnected() && (worst == nil || client.Output() > worst.Output()) {
+				worst = client
+			}
+		}
+		if worst == nil || worst.Output() == 0 {
+			return
+		}
+		excess -= worst.Output()
+		log.Warn("Disconnecting %s, which holds %d bytes of output while all clients hold %d", worst.Owner(), worst.Output(), total)
+		worst.disconnectForOutput("output_budget")
+	}
+}
+
+// Disconnects the clients that have been over their soft output limit for too long, such as clients that stopped
+// reading their responses
+func (this *OutputBudget) CheckSoftLimits() {
+	this.lock.Lock()
+	clients := make([]*Client, 0, len(this.clients))
+	for client := range this.clients {
+		clients = append(clients, client)
+	}
+	this.lock.Unlock()
+
+	for _, client := range clients {
+		if client.overSoftLimit(time.Now()) {
+			log.Warn("Disconnecting %s, which has held %d bytes of output for too long", client.Owner(), client.Output())
+			client.disconnectForOutput("output_soft_limit")
+		}
+	}
+}
+
+// The output the client holds
+func (this *Client) Output() int64 {
+	return atomic.LoadInt64(&this.output)
+}
+
+// Accounts for n bytes of responses that are held for the client until they were written to it. Fails with
+// ERR_OUTPUT_LIMIT if the client is beyond its hard limit, or was over its soft limit for too long. Every hold has to be
+// followed by a release of the same amount, whether it failed or not.
+func (this *Client) holdOutput(n int) error {
+	output := atomic.AddInt64(&this.output, int64(n))
+	if this.OutputBudget != nil {
+		this.OutputBudget.hold(int64(n))
+	}
+
+	limits := this.OutputLimits
+	if limits.SoftLimit > 0 && output > limits.SoftLimit {
+		atomic.CompareAndSwapInt64(&this.overSoftLimitSince, 0, time.Now().UnixNano())
+	}
+
+	if limits.HardLimit > 0 && output > limits.HardLimit {
+		log.Warn("Disconnecting %s, which holds %d bytes of output", this.Owner(), output)
+		this.disconnectForOutput("output_hard_limit")
+	} else if this.overSoftLimit(time.Now()) {
+		log.Warn("Disconnecting %s, which has held %d bytes of output for too long", this.Owner(), output)
+		this.disconnectForOutput("output_soft_limit")
+	}
+
+	if this.outputDisconnected() {
+		return ERR_OUTPUT_LIMIT
+	}
+	return nil
+}
+
+// Accounts for output that was written to the client, or dropped
+func (this *Client) releaseOutput(n int) {
+	output := atomic.AddInt64(&this.output, -int64(n))
+	if this.OutputBudget != nil {
+		this.OutputBudget.hold(-int64(n))
+	}
+	if output <= this.OutputLimits.SoftLimit {
+		atomic.StoreInt64(&this.overSoftLimitSince, 0)
+	}
+}
+
+// The longest response that may be held for the client, which is its hard limit.  Zero means any response may be held
+func (this *Client) maxHeldResponseLength() int {
+	return int(this.OutputLimits.HardLimit)
+}
+
+// Whether the client has been over its soft limit for longer than the limit allows
+func (this *Client) overSoftLimit(now time.Time) bool {
+	since := atomic.LoadInt64(&this.overSoftLimitSince)
+	return since != 0 && this.OutputLimits.SoftLimit > 0 && now.Sub(time.Unix(0, since)) > this.OutputLimits.SoftLimitDuration
+}
+
+func (this *Client) outputDisconnected() bool {
+	return atomic.LoadInt32(&this.disconnectedForOutput) != 0
+}
+
+// Closes the client's connection, which fails whatever it is reading or writing, once
+func (this *Client) disconnectForOutput(reason string) {
+	if atomic.CompareAndSwapInt32(&this.disconnectedForOutput, 0, 1) {
+		graphite.Increment(reason)
+		this.Connection.Close()
+	}
+}
+
+// The total size of the given responses
+func responsesSize(responses [][]byte) (size int) {
+	for _, response := range responses {
+		size += len(response)
+	}
+	return
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package rmux
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Creates a client over an in-memory pipe, and returns the other end of the pipe
+func newOutputTestClient(budget *OutputBudget, limits OutputLimits) (*Client, net.Conn) {
+	local, remote := net.Pipe()
+	client := NewClient(local, false, nil, time.Second)
+	client.OutputLimits = limits
+	client.OutputBudget = budget
+	budget.register(client)
+	return client, remote
+}
+
+func TestHoldOutput_HardLimit(t *testing.T) {
+	budget := NewOutputBudget(0)
+	client, remote := newOutputTestClient(budget, OutputLimits{HardLimit: 100})
+	defer remote.Close()
+
+	if err := client.holdOutput(60); err != nil {
+		t.Fatalf("Holding output below the hard limit failed: %s", err)
+	}
+	if err := client.holdOutput(60); err != ERR_OUTPUT_LIMIT {
+		t.Fatalf("Expected holding output beyond the hard limit to fail, got %v", err)
+	}
+	if _, err := remote.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected the client to be disconnected")
+	}
+
+	client.releaseOutput(120)
+	if client.Output() != 0 || budget.Total() != 0 {
+		t.Errorf("Expected all output to be released, the client holds %d and the budget %d", client.Output(), budget.Total())
+	}
+}
+
+func TestHoldOutput_SoftLimit(t *testing.T) {
+	budget := NewOutputBudget(0)
+	limits := OutputLimits{SoftLimit: 100, SoftLimitDuration: 50 * time.Millisecond}
+	client, remote := newOutputTestClient(budget, limits)
+	defer remote.Close()
+	other, otherRemote := newOutputTestClient(budget, limits)
+	defer otherRemote.Close()
+
+	if err := client.holdOutput(150); err != nil {
+		t.Fatalf("Holding output beyond the soft limit failed right away: %s", err)
+	}
+	// Dropping below the soft limit in time keeps the other client connected
+	other.holdOutput(150)
+	other.releaseOutput(100)
+
+	time.Sleep(100 * time.Millisecond)
+	budget.CheckSoftLimits()
+	if !client.outputDisconnected() {
+		t.Error("Expected the client that stayed over its soft limit to be disconnected")
+	}
+	if other.outputDisconnected() {
+		t.Error("Did not expect the client that dropped below its soft limit to be disconnected")
+	}
+}
+
+func TestOutputBudget(t *testing.T) {
+	budget := NewOutputBudget(100)
+	small, smallRemote := newOutputTestClient(budget, OutputLimits{})
+	defer smallRemote.Close()
+	large, largeRemote := newOutputTestClient(budget, OutputLimits{})
+	defer largeRemote.Close()
+
+	if err := large.holdOutput(80); err != nil {
+		t.Fatalf("Holding output within the budget failed: %s", err)
+	}
+	// Exceeding the budget disconnects the client holding the most, rather than the one that exceeded it
+	if err := small.holdOutput(30); err != nil {
+		t.Fatalf("Expected the smaller client to keep its output, got %s", err)
+	}
+	if !large.outputDisconnected() || small.outputDisconnected() {
+		t.Errorf("Expected only the larger client to be disconnected")
+	}
+	if err := large.holdOutput(1); err != ERR_OUTPUT_LIMIT {
+		t.Errorf("Expected a disconnected client to fail holding output, got %v", err)
+	}
+
+	large.releaseOutput(81)
+	small.releaseOutput(30)
+	if budget.Total() != 0 {
+		t.Errorf("Expected all output to be released, the budget holds %d", budget.Total())
+	}
+}
@@ -30,5 +30,7 @@ type Command interface {
 	GetCommand() []byte
 	GetBuffer() []byte
 	GetFirstArg() []byte
+	// Every argument after the command, GetFirstArg being the first
+	GetArgs() [][]byte
 	GetArgCount() int
 }
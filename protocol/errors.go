@@ -25,6 +25,10 @@
 
 package protocol
 
+import (
+	"fmt"
+)
+
 type RecoverableError struct {
 	errMsg string
 }
@@ -32,3 +36,27 @@ type RecoverableError struct {
 func (e *RecoverableError) Error() string {
 	return e.errMsg
 }
+
+// The maximum amount of unexpected data that is kept for diagnostics
+const UNEXPECTED_DATA_SAMPLE_SIZE = 64
+
+// Data that a server sent beyond the responses that were expected from it
+// The responses themselves were complete, but the connection is out of sync and must not be reused
+type UnexpectedDataError struct {
+	// The amount of unexpected bytes that were already received
+	Length int
+	// The first bytes of the unexpected data
+	Sample []byte
+}
+
+func newUnexpectedDataError(data []byte) *UnexpectedDataError {
+	sample := data
+	if len(sample) > UNEXPECTED_DATA_SAMPLE_SIZE {
+		sample = sample[:UNEXPECTED_DATA_SAMPLE_SIZE]
+	}
+	return &UnexpectedDataError{Length: len(data), Sample: append([]byte(nil), sample...)}
+}
+
+func (e *UnexpectedDataError) Error() string {
+	return fmt.Sprintf("received %d bytes beyond the expected responses: %q", e.Length, e.Sample)
+}
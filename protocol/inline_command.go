@@ -34,6 +34,8 @@ type InlineCommand struct {
 	Command []byte
 	// Usually denotes the key
 	FirstArg []byte
+	// Every argument after the command
+	Args     [][]byte
 	ArgCount int
 }
 
@@ -75,6 +77,7 @@ func ParseInlineCommand(b []byte) (*InlineCommand, error) {
 			c.FirstArg = part
 		}
 
+		c.Args = append(c.Args, part)
 		c.ArgCount++
 	}
 
@@ -94,6 +97,10 @@ func (this *InlineCommand) GetFirstArg() []byte {
 	return this.FirstArg
 }
 
+func (this *InlineCommand) GetArgs() [][]byte {
+	return this.Args
+}
+
 func (this *InlineCommand) GetArgCount() int {
 	return this.ArgCount
 }
@@ -27,6 +27,7 @@ package protocol
 
 import (
 	"bytes"
+	"sync"
 )
 
 var NIL_STRING []byte = nil
@@ -36,58 +37,98 @@ type MultibulkCommand struct {
 	Command []byte
 	// Usually denotes the key
 	FirstArg []byte
+	// Every argument after the command, nil for nil bulk strings
+	Args     [][]byte
 	ArgCount int
+
+	// Whether the command came from the pool, and goes back to it on release
+	pooled bool
+}
+
+// Multibulk commands parsed in place are recycled through ReleaseCommand, along with their Args arrays
+var multibulkCommandPool = sync.Pool{
+	New: func() interface{} {
+		return &MultibulkCommand{}
+	},
 }
 
 func ParseMultibulkCommand(b []byte) (*MultibulkCommand, error) {
 	c := &MultibulkCommand{}
-	c.Buffer = make([]byte, len(b))
-	copy(c.Buffer, b)
+	buffer := make([]byte, len(b))
+	copy(buffer, b)
 
-	if c.Buffer[0] != '*' {
-		return nil, ERROR_COMMAND_PARSE
+	if err := c.parse(buffer); err != nil {
+		return nil, err
 	}
+	return c, nil
+}
 
-	newlinePos := bytes.Index(c.Buffer, REDIS_NEWLINE)
+// Parses the command and all of its arguments in one pass, referencing b rather than copying it
+func (c *MultibulkCommand) parse(b []byte) error {
+	c.Buffer = b
+
+	if len(b) == 0 || b[0] != '*' {
+		return ERROR_COMMAND_PARSE
+	}
+
+	newlinePos := bytes.Index(b, REDIS_NEWLINE)
 	if newlinePos < 0 {
-		return nil, ERROR_COMMAND_PARSE
+		return ERROR_COMMAND_PARSE
 	}
 
-	count, err := ParseInt(c.Buffer[1:newlinePos])
+	count, err := ParseInt(b[1:newlinePos])
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	if count > 0 {
 		c.ArgCount = count - 1
+		// Every argument takes at least 4 bytes, which bounds the array for bogus counts
+		size := c.ArgCount
+		if size > len(b)/4 {
+			size = len(b) / 4
+		}
+		if cap(c.Args) < size {
+			c.Args = make([][]byte, 0, size)
+		}
 	}
 
-	cBuf := c.Buffer[newlinePos+2:]
-	for i := 0; i < 2 && i < count; i++ {
-		if cBuf[0] != '$' {
-			return nil, ERROR_COMMAND_PARSE
+	cBuf := b[newlinePos+2:]
+	for i := 0; i < count; i++ {
+		if len(cBuf) == 0 || cBuf[0] != '$' {
+			return ERROR_COMMAND_PARSE
 		}
 
 		newlinePos := bytes.Index(cBuf, REDIS_NEWLINE)
 		if newlinePos < 0 {
-			return nil, ERROR_COMMAND_PARSE
+			return ERROR_COMMAND_PARSE
 		}
 
-		count, err := ParseInt(cBuf[1:newlinePos])
+		length, err := ParseInt(cBuf[1:newlinePos])
 		if err != nil {
-			return nil, err
-		} else if count < 0 {
+			return err
+		}
+
+		var value []byte
+		if length >= 0 {
+			if len(cBuf) < newlinePos+2+length+2 {
+				return ERROR_COMMAND_PARSE
+			}
+			value = cBuf[newlinePos+2 : newlinePos+2+length]
+			cBuf = cBuf[newlinePos+2+length+2:]
+		} else {
 			cBuf = cBuf[newlinePos+2:]
-			continue
 		}
 
 		if i == 0 {
-			c.Command = cBuf[newlinePos+2 : newlinePos+2+count]
+			c.Command = value
 		} else {
-			c.FirstArg = cBuf[newlinePos+2 : newlinePos+2+count]
+			c.Args = append(c.Args, value)
 		}
+	}
 
-		cBuf = cBuf[newlinePos+2+count+2:]
+	if len(c.Args) > 0 {
+		c.FirstArg = c.Args[0]
 	}
 
 	for i := 0; i < len(c.Command); i++ {
@@ -96,7 +137,15 @@ func ParseMultibulkCommand(b []byte) (*MultibulkCommand, error) {
 		}
 	}
 
-	return c, nil
+	return nil
+}
+
+// Clears the command for reuse, keeping the Args array
+func (c *MultibulkCommand) reset() {
+	for i := range c.Args {
+		c.Args[i] = nil
+	}
+	*c = MultibulkCommand{Args: c.Args[:0]}
 }
 
 // Satisfy Command Interface
@@ -112,6 +161,10 @@ func (this *MultibulkCommand) GetFirstArg() []byte {
 	return this.FirstArg
 }
 
+func (this *MultibulkCommand) GetArgs() [][]byte {
+	return this.Args
+}
+
 func (this *MultibulkCommand) GetArgCount() int {
 	return this.ArgCount
 }
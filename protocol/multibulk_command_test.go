@@ -98,3 +98,63 @@ func TestMultibulkCommand(test *testing.T) {
 		tester.checkCommandOutput(expected, command, err, input)
 	}
 }
+
+func TestMultibulkCommand_InPlace(test *testing.T) {
+	tester := commandTester{test}
+
+	for input, expected := range multibulkTestData {
+		buffer := []byte(input)
+		command, err := ParseCommandInPlace(buffer)
+
+		tester.checkCommandOutput(expected, command, err, input)
+		if &command.GetBuffer()[0] != &buffer[0] {
+			test.Errorf("The command parsed from %q does not reference the input", input)
+		}
+		ReleaseCommand(command)
+	}
+}
+
+func TestMultibulkCommand_Args(test *testing.T) {
+	testData := []struct {
+		input string
+		args  []string
+	}{
+		{"*1\r\n$4\r\nping\r\n", nil},
+		{"*2\r\n$3\r\nget\r\n$3\r\nkey\r\n", []string{"key"}},
+		{"*4\r\n$4\r\nmset\r\n$1\r\na\r\n$0\r\n\r\n$2\r\nbc\r\n", []string{"a", "", "bc"}},
+		{"*3\r\n$3\r\ndel\r\n$-1\r\n$4\r\nkey2\r\n", []string{"", "key2"}},
+	}
+
+	for _, testCase := range testData {
+		command, err := ParseCommandInPlace([]byte(testCase.input))
+		if err != nil {
+			test.Fatalf("Failed to parse %q: %s", testCase.input, err)
+		}
+
+		args := command.GetArgs()
+		if len(args) != len(testCase.args) || len(args) != command.GetArgCount() {
+			test.Fatalf("Expected %d args for %q, got %q", len(testCase.args), testCase.input, args)
+		}
+		for i, arg := range args {
+			if string(arg) != testCase.args[i] {
+				test.Errorf("Expected arg %d of %q to be %q, got %q", i, testCase.input, testCase.args[i], arg)
+			}
+		}
+		ReleaseCommand(command)
+	}
+}
+
+func TestMultibulkCommand_Truncated(test *testing.T) {
+	for _, input := range []string{
+		"*2\r\n$3\r\nget\r\n",
+		"*2\r\n$3\r\nget\r\n$10\r\nkey\r\n",
+		"*2\r\n$3\r\nget\r\n:1\r\n",
+	} {
+		if _, err := ParseCommandInPlace([]byte(input)); err == nil {
+			test.Errorf("Expected an error parsing %q", input)
+		}
+		if _, err := ParseMultibulkCommand([]byte(input)); err == nil {
+			test.Errorf("Expected an error parsing %q", input)
+		}
+	}
+}
@@ -27,6 +27,7 @@ package protocol
 
 import (
 	"bufio"
+	"bytes"
 	"io"
 	"rmux/writer"
 )
@@ -50,6 +51,17 @@ var (
 	//Error for when we receive bad arguments (for multiplexing) accompanying a command
 	ERR_BAD_ARGUMENTS = &RecoverableError{"Bad arguments for command"}
 
+	//Errors for requests beyond the ScanLimits of a client. The connection can not be resynchronised after them
+	ERR_BULK_TOO_LONG      = &RecoverableError{"Protocol error: invalid bulk length"}
+	ERR_TOO_MANY_ARGUMENTS = &RecoverableError{"Protocol error: invalid multibulk length"}
+	ERR_LINE_TOO_LONG      = &RecoverableError{"Protocol error: too big inline request"}
+	//Error for the commands of a pipeline beyond the depth a client may pipeline
+	ERR_PIPELINE_TOO_DEEP = &RecoverableError{"max pipeline depth exceeded"}
+	//Error for commands beyond the rate limits of a client
+	ERR_RATE_LIMITED = &RecoverableError{"rate limited"}
+	//Error for a response longer than the limit it is read with. The rest of it is dropped, so the connection stays in sync
+	ERR_RESPONSE_TOO_LONG = &RecoverableError{"response too long"}
+
 	//Commands declared once for convenience
 	DEL_COMMAND         = []byte("del")
 	SUBSCRIBE_COMMAND   = []byte("subscribe")
@@ -64,12 +76,19 @@ var (
 	MULTI_COMMAND       = []byte("multi")
 	EXEC_COMMAND        = []byte("exec")
 	DISCARD_COMMAND     = []byte("discard")
+	AUTH_COMMAND        = []byte("auth")
+	CLIENT_COMMAND      = []byte("client")
+	SETNAME_SUBCOMMAND  = []byte("setname")
 
 	//Responses declared once for convenience
 	OK_RESPONSE   = []byte("+OK")
 	PONG_RESPONSE = []byte("+PONG")
 	ERR_RESPONSE  = []byte("$-1")
 
+	//Error responses of servers that are temporarily unable to serve requests
+	LOADING_RESPONSE = []byte("-LOADING ")
+	BUSY_RESPONSE    = []byte("-BUSY ")
+
 	//Redis expects \r\n newlines.  Using this means we can stop remembering that
 	REDIS_NEWLINE = []byte("\r\n")
 
@@ -133,8 +152,158 @@ var (
 		"zinterstore": true,
 		"zunionstore": true,
 	}
+
+	//These functions change the state of the server connection, or block it, so they can not be sent over a connection
+	//that is shared with other clients
+	EXCLUSIVE_CONNECTION_FUNCTIONS = map[string]bool{
+		"blmove":       true,
+		"blmpop":       true,
+		"blpop":        true,
+		"brpop":        true,
+		"brpoplpush":   true,
+		"bzmpop":       true,
+		"bzpopmax":     true,
+		"bzpopmin":     true,
+		"discard":      true,
+		"exec":         true,
+		"hello":        true,
+		"multi":        true,
+		"psync":        true,
+		"readonly":     true,
+		"readwrite":    true,
+		"replconf":     true,
+		"reset":        true,
+		"ssubscribe":   true,
+		"sunsubscribe": true,
+		"unwatch":      true,
+		"wait":         true,
+		"waitaof":      true,
+		"watch":        true,
+		"xread":        true,
+		"xreadgroup":   true,
+	}
+
+	//These functions modify the data of the server
+	WRITE_FUNCTIONS = map[string]bool{
+		"append":           true,
+		"bitop":            true,
+		"blmove":           true,
+		"blmpop":           true,
+		"blpop":            true,
+		"brpop":            true,
+		"brpoplpush":       true,
+		"bzpopmax":         true,
+		"bzpopmin":         true,
+		"copy":             true,
+		"decr":             true,
+		"decrby":           true,
+		"del":              true,
+		"eval":             true,
+		"evalsha":          true,
+		"expire":           true,
+		"expireat":         true,
+		"flushall":         true,
+		"flushdb":          true,
+		"getdel":           true,
+		"getex":            true,
+		"getset":           true,
+		"hdel":             true,
+		"hincrby":          true,
+		"hincrbyfloat":     true,
+		"hmset":            true,
+		"hset":             true,
+		"hsetnx":           true,
+		"incr":             true,
+		"incrby":           true,
+		"incrbyfloat":      true,
+		"linsert":          true,
+		"lmove":            true,
+		"lmpop":            true,
+		"lpop":             true,
+		"lpush":            true,
+		"lpushx":           true,
+		"lrem":             true,
+		"lset":             true,
+		"ltrim":            true,
+		"mset":             true,
+		"msetnx":           true,
+		"persist":          true,
+		"pexpire":          true,
+		"pexpireat":        true,
+		"pfadd":            true,
+		"pfmerge":          true,
+		"psetex":           true,
+		"rename":           true,
+		"renamenx":         true,
+		"restore":          true,
+		"rpop":             true,
+		"rpoplpush":        true,
+		"rpush":            true,
+		"rpushx":           true,
+		"sadd":             true,
+		"sdiffstore":       true,
+		"set":              true,
+		"setbit":           true,
+		"setex":            true,
+		"setnx":            true,
+		"setrange":         true,
+		"sinterstore":      true,
+		"smove":            true,
+		"sort":             true,
+		"spop":             true,
+		"srem":             true,
+		"sunionstore":      true,
+		"unlink":           true,
+		"xadd":             true,
+		"xdel":             true,
+		"xtrim":            true,
+		"zadd":             true,
+		"zincrby":          true,
+		"zinterstore":      true,
+		"zpopmax":          true,
+		"zpopmin":          true,
+		"zrem":             true,
+		"zremrangebylex":   true,
+		"zremrangebyrank":  true,
+		"zremrangebyscore": true,
+		"zunionstore":      true,
+	}
+
+	//These functions can take the server a long time, depending on the size of the data they work on
+	HEAVY_FUNCTIONS = map[string]bool{
+		"bitop":       true,
+		"eval":        true,
+		"evalsha":     true,
+		"flushall":    true,
+		"flushdb":     true,
+		"keys":        true,
+		"sdiff":       true,
+		"sdiffstore":  true,
+		"sinter":      true,
+		"sinterstore": true,
+		"sort":        true,
+		"sunion":      true,
+		"sunionstore": true,
+		"zinterstore": true,
+		"zunionstore": true,
+	}
 )
 
+// Whether or not the command needs a server connection of its own, instead of one that is shared with other clients
+func NeedsExclusiveConnection(command []byte) bool {
+	return EXCLUSIVE_CONNECTION_FUNCTIONS[string(command)]
+}
+
+// Whether or not the command modifies the data of the server
+func IsWriteFunction(command []byte) bool {
+	return WRITE_FUNCTIONS[string(command)]
+}
+
+// Whether or not the command can take the server a long time
+func IsHeavyFunction(command []byte) bool {
+	return HEAVY_FUNCTIONS[string(command)]
+}
+
 func IsSupportedFunction(command []byte, isMultiplexing, isMultipleArgument bool) bool {
 	commandLength := len(command)
 
@@ -354,24 +523,22 @@ func ParseInt(response []byte) (value int, err error) {
 	return
 }
 
+// Parses a copy of b, each command type copying the bytes once
 func ParseCommand(b []byte) (command Command, err error) {
-	if len(b) < 0 {
+	if len(b) == 0 {
 		return nil, ERROR_COMMAND_PARSE
 	}
 
-	bc := make([]byte, len(b))
-	copy(bc, b)
-
-	switch peek := bc[0]; peek {
+	switch peek := b[0]; peek {
 	case '+':
-		command, err = ParseSimpleCommand(bc)
+		command, err = ParseSimpleCommand(b)
 	case '$':
-		command, err = ParseStringCommand(bc)
+		command, err = ParseStringCommand(b)
 	case '*':
-		command, err = ParseMultibulkCommand(bc)
+		command, err = ParseMultibulkCommand(b)
 	default:
 		if (peek >= 'a' && peek <= 'z') || (peek >= 'A' && peek <= 'Z') {
-			command, err = ParseInlineCommand(bc)
+			command, err = ParseInlineCommand(b)
 		} else {
 			command, err = nil, ERROR_INVALID_COMMAND_FORMAT
 		}
@@ -380,6 +547,32 @@ func ParseCommand(b []byte) (command Command, err error) {
 	return
 }
 
+// Parses a command that references b instead of copying it, lowercasing the command name within b.
+// b must stay unchanged until the command is passed to ReleaseCommand, such as a token of a
+// RespScanner that retains tokens. Multibulk commands come from a pool; other formats are copied.
+func ParseCommandInPlace(b []byte) (Command, error) {
+	if len(b) == 0 || b[0] != '*' {
+		return ParseCommand(b)
+	}
+
+	command := multibulkCommandPool.Get().(*MultibulkCommand)
+	command.pooled = true
+	if err := command.parse(b); err != nil {
+		ReleaseCommand(command)
+		return nil, err
+	}
+	return command, nil
+}
+
+// Returns a command from ParseCommandInPlace to its pool. The command must not be used afterwards.
+// Commands that were not parsed in place are left alone.
+func ReleaseCommand(command Command) {
+	if multibulk, ok := command.(*MultibulkCommand); ok && multibulk.pooled {
+		multibulk.reset()
+		multibulkCommandPool.Put(multibulk)
+	}
+}
+
 // Writes the given error to the buffer, preceded by a '-' and followed by a GO_NEWLINE
 // Bubbles any errors from underlying writer
 func WriteError(line []byte, dest *writer.FlexibleWriter, flush bool) (err error) {
@@ -425,31 +618,168 @@ func WriteLine(line []byte, destination *writer.FlexibleWriter, flush bool) (err
 	return
 }
 
+// Whether or not the response is an error of a server that is temporarily unable to serve requests, because it is
+// loading its dataset or busy running a script
+func IsUnavailableResponse(response []byte) bool {
+	return bytes.HasPrefix(response, LOADING_RESPONSE) || bytes.HasPrefix(response, BUSY_RESPONSE)
+}
+
 // Copies a server response from the remoteBuffer into your localBuffer
 // If a protocol or buffer error is encountered, it is bubbled up
 func CopyServerResponses(reader *bufio.Reader, localBuffer *writer.FlexibleWriter, numResponses int) error {
+	_, err := CopyServerResponsesWithStatus(reader, localBuffer, numResponses)
+	return err
+}
+
+// Copies server responses like CopyServerResponses, and additionally reports whether any of them signalled that the
+// server is unavailable
+// Responses are written to the local buffer and flushed as they arrive, rather than once each is complete, so that a
+// response takes at most STREAM_BUFFER_SIZE in the proxy however large it is. Only its framing is parsed, to know where
+// it ends.
+// If data beyond the expected responses was received, all responses are still copied, and an *UnexpectedDataError is
+// returned, since the connection is out of sync.
+func CopyServerResponsesWithStatus(reader *bufio.Reader, localBuffer *writer.FlexibleWriter, numResponses int) (unavailable bool, err error) {
 	//start := time.Now()
 	//defer func() {
 	//	graphite.Timing("copy_server_responses", time.Now().Sub(start))
 	//}()
 
+	var parser RespParser
+	buf := getScanBuffer(STREAM_BUFFER_SIZE)
+	defer func() {
+		// Responses are written from buf, so it is only reused once they were flushed
+		if flushErr := localBuffer.Flush(); err == nil {
+			err = flushErr
+		}
+		putScanBuffer(buf)
+	}()
+
+	// Data that was read but not copied yet is buf[start:end]
+	start, end := 0, 0
+	// Whether part of the current response was copied already
+	partial := false
+	var readErr error
+	for numRead := 0; numRead < numResponses; {
+		advance, token, err := parser.Scan(buf[start:end], false)
+		if err != nil {
+			return unavailable, err
+		}
+
+		if token != nil {
+			unavailable = unavailable || (!partial && IsUnavailableResponse(token))
+			if err = localBuffer.WriteChunk(token); err != nil {
+				return unavailable, err
+			}
+			start += advance
+			parser.Reset()
+			partial = false
+			numRead++
+			continue
+		}
+
+		if streamable := parser.Streamable(end - start); streamable > 0 {
+			if err = localBuffer.WriteChunk(buf[start : start+streamable]); err != nil {
+				return unavailable, err
+			}
+			parser.Discard(streamable)
+			start += streamable
+			partial = true
+		}
+		if readErr != nil {
+			return unavailable, readErr
+		}
+
+		// Pass on what was copied before waiting for more
+		if err = localBuffer.Flush(); err != nil {
+			return unavailable, err
+		}
+
+		if start == end {
+			start, end = 0, 0
+		} else if end == len(buf) {
+			unscanned := end - start
+			if unscanned*2 > len(buf) {
+				// A line longer than half the buffer
+				grown := getScanBuffer(2 * len(buf))
+				copy(grown, buf[start:end])
+				putScanBuffer(buf)
+				buf = grown
+			} else {
+				copy(buf, buf[start:end])
+			}
+			start, end = 0, unscanned
+		}
+
+		var n int
+		n, readErr = reader.Read(buf[end:])
+		end += n
+	}
+
+	if start < end {
+		return unavailable, newUnexpectedDataError(buf[start:end])
+	}
+
+	return unavailable, nil
+}
+
+// Reads server responses like CopyServerResponsesWithStatus, but returns a copy of each response instead of writing
+// them out, so that responses of several servers can be put back into the order of their commands
+// Responses longer than maxLength are not held, see ScanServerResponses.
+func ReadServerResponses(reader *bufio.Reader, numResponses, maxLength int) (responses [][]byte, unavailable bool, err error) {
 	scanner := NewRespScanner(reader)
+	defer scanner.Free()
+	if responses, unavailable, err = ScanServerResponses(scanner, numResponses, maxLength); err != nil {
+		return responses, unavailable, err
+	}
 
-	numRead := 0
+	if leftover := scanner.Buffered(); len(leftover) > 0 {
+		return responses, unavailable, newUnexpectedDataError(leftover)
+	}
 
-	for numRead < numResponses && scanner.Scan() {
-		localBuffer.Write(scanner.Bytes())
-		localBuffer.Flush()
+	return responses, unavailable, nil
+}
+
+// Reads numResponses responses from a scanner that is kept for the lifetime of its connection, returning a copy of
+// each.  Data beyond the responses stays buffered in the scanner, for the next call.
+// A response longer than maxLength is dropped as it is read, instead of being held, and ERR_RESPONSE_TOO_LONG is
+// returned once all responses were read.  Zero disables the limit.
+func ScanServerResponses(scanner *RespScanner, numResponses, maxLength int) (responses [][]byte, unavailable bool, err error) {
+	scanner.SetLimits(ScanLimits{MaxValueLength: maxLength})
+	responses = make([][]byte, 0, numResponses)
+	unavailable, err = scanResponses(scanner, numResponses, func(response []byte) {
+		responses = append(responses, append([]byte(nil), response...))
+	})
+	return responses, unavailable, err
+}
+
+// Scans numResponses responses, handing each to the given function, except for the ones that were too long to hold
+func scanResponses(scanner *RespScanner, numResponses int, handle func(response []byte)) (unavailable bool, err error) {
+	numRead := 0
+	tooLong := false
+
+	for numRead < numResponses {
+		if scanner.Scan() {
+			unavailable = unavailable || IsUnavailableResponse(scanner.Bytes())
+			handle(scanner.Bytes())
+		} else if scanner.Err() == ERR_RESPONSE_TOO_LONG && scanner.Skip() {
+			tooLong = true
+		} else {
+			break
+		}
 		numRead++
 	}
 
 	if sErr := scanner.Err(); sErr != nil {
-		return sErr
+		return unavailable, sErr
 	}
 
 	if numRead < numResponses {
-		return io.EOF
+		return unavailable, io.EOF
+	}
+
+	if tooLong {
+		return unavailable, ERR_RESPONSE_TOO_LONG
 	}
 
-	return nil
+	return unavailable, nil
 }
@@ -28,6 +28,7 @@ package protocol
 import (
 	"bufio"
 	"bytes"
+	"io"
 	"rmux/writer"
 	"strings"
 	"testing"
@@ -148,6 +149,119 @@ func (test *ProtocolTester) verifyGoodCopyServerResponse(goodMessage, extraMessa
 	}
 }
 
+func TestCopyServerResponsesWithStatus(test *testing.T) {
+	testCases := []struct {
+		responses    string
+		numResponses int
+		unavailable  bool
+	}{
+		{"+OK\r\n$3\r\nfoo\r\n", 2, false},
+		{"-BUSYKEY Target key name already exists.\r\n", 1, false},
+		{"+OK\r\n-LOADING Redis is loading the dataset in memory\r\n", 2, true},
+		{"-BUSY Redis is busy running a script.\r\n+OK\r\n", 2, true},
+	}
+
+	for _, testCase := range testCases {
+		w := new(bytes.Buffer)
+		reader := bufio.NewReader(bytes.NewBufferString(testCase.responses))
+
+		unavailable, err := CopyServerResponsesWithStatus(reader, writer.NewFlexibleWriter(w), testCase.numResponses)
+		if err != nil {
+			test.Errorf("Should not have errored copying %q: %s", testCase.responses, err)
+		} else if unavailable != testCase.unavailable {
+			test.Errorf("Copying %q should have reported unavailable=%t", testCase.responses, testCase.unavailable)
+		}
+
+		if w.String() != testCase.responses {
+			test.Errorf("Expected %q to be copied, got %q", testCase.responses, w.String())
+		}
+	}
+}
+
+func TestCopyServerResponses_Streaming(test *testing.T) {
+	remoteReader, remoteWriter := io.Pipe()
+	localReader, localWriter := io.Pipe()
+
+	header := "$200000\r\n"
+	first, second := strings.Repeat("a", 100000), strings.Repeat("b", 100000)
+	firstCopied := make(chan bool)
+	go func() {
+		remoteWriter.Write([]byte(header + first))
+		<-firstCopied
+		remoteWriter.Write([]byte(second + "\r\n+OK\r\n"))
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := CopyServerResponsesWithStatus(bufio.NewReader(remoteReader), writer.NewFlexibleWriter(localWriter), 2)
+		localWriter.Close()
+		done <- err
+	}()
+
+	// The first half of the value reaches the client before the rest of it was received
+	copied := make([]byte, len(header+first))
+	if _, err := io.ReadFull(localReader, copied); err != nil || string(copied) != header+first {
+		test.Fatalf("Expected the start of the response to be copied, got %d bytes: %v", len(copied), err)
+	}
+	close(firstCopied)
+
+	rest, err := io.ReadAll(localReader)
+	if err != nil || string(rest) != second+"\r\n+OK\r\n" {
+		test.Fatalf("Expected the rest of the responses to be copied, got %d bytes: %v", len(rest), err)
+	}
+	if err := <-done; err != nil {
+		test.Fatalf("Unexpected error %s", err)
+	}
+}
+
+func TestCopyServerResponses_UnexpectedData(test *testing.T) {
+	w := new(bytes.Buffer)
+	reader := bufio.NewReader(bytes.NewBufferString("+OK\r\n+EXTRA\r\n"))
+
+	_, err := CopyServerResponsesWithStatus(reader, writer.NewFlexibleWriter(w), 1)
+	if unexpectedData, ok := err.(*UnexpectedDataError); !ok {
+		test.Fatalf("Expected an UnexpectedDataError, got: %v", err)
+	} else if unexpectedData.Length != 8 || string(unexpectedData.Sample) != "+EXTRA\r\n" {
+		test.Errorf("Unexpected data was not reported correctly: %s", unexpectedData)
+	}
+
+	// The expected response was still copied in full
+	if w.String() != "+OK\r\n" {
+		test.Errorf("Expected the response to be copied, got %q", w.String())
+	}
+}
+
+func TestCopyServerResponses_WriteError(test *testing.T) {
+	localReader, localWriter := io.Pipe()
+	localReader.Close()
+	destination := writer.NewFlexibleWriter(localWriter)
+	destination.HighWaterMark = 1
+
+	response := "$2000\r\n" + strings.Repeat("a", 2000) + "\r\n"
+	reader := bufio.NewReader(bytes.NewBufferString(response))
+	if _, err := CopyServerResponsesWithStatus(reader, destination, 1); err != io.ErrClosedPipe {
+		test.Errorf("Expected the failed write to be returned, got: %v", err)
+	}
+}
+
+func TestScanServerResponses_TooLong(test *testing.T) {
+	long := "*2\r\n$3\r\nfoo\r\n$100000\r\n" + strings.Repeat("a", 100000) + "\r\n"
+	scanner := NewRespScanner(bytes.NewBufferString("+OK\r\n" + long + "$3\r\nbar\r\n+NEXT\r\n"))
+
+	responses, _, err := ScanServerResponses(scanner, 3, 1000)
+	if err != ERR_RESPONSE_TOO_LONG {
+		test.Fatalf("Expected the long response to be refused, got: %v", err)
+	}
+	if len(responses) != 2 || string(responses[0]) != "+OK\r\n" || string(responses[1]) != "$3\r\nbar\r\n" {
+		test.Errorf("Expected the other responses to be read, got %q", responses)
+	}
+
+	// The long response was read to its end, so the next response is found where it belongs
+	if responses, _, err = ScanServerResponses(scanner, 1, 1000); err != nil || string(responses[0]) != "+NEXT\r\n" {
+		test.Errorf("Expected the next response, got %q: %v", responses, err)
+	}
+}
+
 func BenchmarkGoodParseInt(bench *testing.B) {
 	for i := 0; i < bench.N; i++ {
 		ParseInt([]byte("12345"))
@@ -385,3 +499,100 @@ func BenchmarkIsSupportedFunction(b *testing.B) {
 		IsSupportedFunction(slice, true, true)
 	}
 }
+
+var benchmarkCommand = []byte("*3\r\n$3\r\nset\r\n$10\r\nbenchmark1\r\n$32\r\n01234567890123456789012345678901\r\n")
+
+func BenchmarkParseCommand(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseCommand(benchmarkCommand); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseCommandInPlace(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		command, err := ParseCommandInPlace(benchmarkCommand)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ReleaseCommand(command)
+	}
+}
+
+// Scans and parses a pipeline of 16 commands the way a client is read, releasing them once all were parsed
+func BenchmarkScanPipelineInPlace(b *testing.B) {
+	pipeline := bytes.Repeat(benchmarkCommand, 16)
+	reader := bytes.NewReader(pipeline)
+	scanner := NewRespScanner(reader)
+	scanner.RetainTokens()
+	commands := make([]Command, 0, 16)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(pipeline)))
+	for i := 0; i < b.N; i++ {
+		reader.Reset(pipeline)
+		for len(commands) < 16 && scanner.Scan() {
+			command, err := ParseCommandInPlace(scanner.Bytes())
+			if err != nil {
+				b.Fatal(err)
+			}
+			commands = append(commands, command)
+		}
+		if len(commands) != 16 {
+			b.Fatalf("Scanned %d commands: %s", len(commands), scanner.Err())
+		}
+		for j, command := range commands {
+			ReleaseCommand(command)
+			commands[j] = nil
+		}
+		commands = commands[:0]
+		scanner.Release()
+	}
+}
+
+// Reads at most size bytes at a time, like a socket receiving a large reply in packets
+type chunkReader struct {
+	reader *bytes.Reader
+	size   int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(p) > r.size {
+		p = p[:r.size]
+	}
+	return r.reader.Read(p)
+}
+
+func benchmarkCopyReply(b *testing.B, reply []byte) {
+	reader := bytes.NewReader(reply)
+	remote := bufio.NewReader(&chunkReader{reader, 16 * 1024})
+	local := writer.NewFlexibleWriter(io.Discard)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(reply)))
+	for i := 0; i < b.N; i++ {
+		reader.Reset(reply)
+		remote.Reset(&chunkReader{reader, 16 * 1024})
+		if err := CopyServerResponses(remote, local, 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// An LRANGE reply of 100000 elements
+func BenchmarkCopyLargeArrayReply(b *testing.B) {
+	var reply bytes.Buffer
+	reply.WriteString("*100000\r\n")
+	for i := 0; i < 100000; i++ {
+		reply.WriteString("$10\r\n0123456789\r\n")
+	}
+	benchmarkCopyReply(b, reply.Bytes())
+}
+
+// A GET reply of a 4MB value
+func BenchmarkCopyLargeBulkReply(b *testing.B) {
+	benchmarkCopyReply(b, []byte("$4194304\r\n"+strings.Repeat("x", 4194304)+"\r\n"))
+}
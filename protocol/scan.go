@@ -30,34 +30,231 @@ import (
 )
 
 func ScanResp(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	//	if len(data) > 0 {
-//	//		Debug("Scanning %q", data)
-	//	}
-
-	if atEOF && len(data) == 0 {
+	if len(data) == 0 {
 		return 0, nil, nil
 	}
 
-	if len(data) == 0 {
-		return 0, nil, nil
+	var parser RespParser
+	return parser.Scan(data, atEOF)
+}
+
+// Limits on the values a parser accepts, so that a client can not make rmux buffer arbitrary amounts of data.
+// Zero disables a limit.
+type ScanLimits struct {
+	// The length of a bulk string
+	MaxBulkLength int
+	// The number of elements of an array, such as the arguments of a command
+	MaxArrayLength int
+	// The length of a line, such as an inline command
+	MaxLineLength int
+	// The total length of a value, such as a response that is held in memory
+	MaxValueLength int
+}
+
+// Whether the error is one of a value beyond the ScanLimits
+func IsLimitError(err error) bool {
+	return err == ERR_BULK_TOO_LONG || err == ERR_TOO_MANY_ARGUMENTS || err == ERR_LINE_TOO_LONG
+}
+
+// Scans RESP values incrementally. It remembers how far into a value it got, so that scanning the same value again
+// with more data appended continues where it stopped instead of starting over. That keeps scanning a large bulk
+// string or array linear in its size, however many reads it arrives in.
+type RespParser struct {
+	// How much of the value was scanned, and whether that is all of it
+	offset int
+	done   bool
+	err    error
+	// The end of the bulk string being skipped, including its newline
+	bulkEnd int
+	// Where the line being searched for its newline starts, and how far it was searched
+	lineStart, searched int
+	// The number of values still expected by each open array, innermost last
+	remaining []int
+
+	Limits ScanLimits
+}
+
+// Scans data for one value, like ScanResp. data has to start with the same value every call until Reset, with
+// anything read since the previous call appended. Once a value or an error is found, it is returned until Reset.
+func (p *RespParser) Scan(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if p.done {
+		return p.offset, data[:p.offset], nil
+	} else if p.err != nil {
+		return 0, nil, p.err
+	}
+
+	for {
+		if p.bulkEnd > 0 {
+			if len(data) < p.bulkEnd {
+				return p.needMore(data, atEOF)
+			}
+			p.offset, p.bulkEnd = p.bulkEnd, 0
+			if p.completeValue() {
+				break
+			}
+			continue
+		}
+
+		if p.offset >= len(data) {
+			return p.needMore(data, atEOF)
+		}
+
+		end, err := p.lineEnd(data)
+		if err != nil {
+			p.err = err
+			return 0, nil, err
+		} else if end == 0 {
+			return p.needMore(data, atEOF)
+		}
+
+		switch data[p.offset] {
+		case '$':
+			length, err := parseHeader(data[p.offset+1 : end-2])
+			if err != nil {
+				p.err = err
+				return 0, nil, err
+			}
+			if p.Limits.MaxBulkLength > 0 && length > p.Limits.MaxBulkLength {
+				p.err = ERR_BULK_TOO_LONG
+				return 0, nil, p.err
+			}
+			if err := p.checkValueLength(end + length + 2); err != nil {
+				return 0, nil, err
+			}
+			p.offset = end
+			if length >= 0 {
+				p.bulkEnd = end + length + 2
+				continue
+			}
+		case '*':
+			count, err := parseHeader(data[p.offset+1 : end-2])
+			if err != nil {
+				p.err = err
+				return 0, nil, err
+			}
+			if p.Limits.MaxArrayLength > 0 && count > p.Limits.MaxArrayLength {
+				p.err = ERR_TOO_MANY_ARGUMENTS
+				return 0, nil, p.err
+			}
+			p.offset = end
+			if count > 0 {
+				p.remaining = append(p.remaining, count)
+				continue
+			}
+		default:
+			p.offset = end
+		}
+
+		if p.completeValue() {
+			break
+		}
+	}
+
+	p.done = true
+	return p.offset, data[:p.offset], nil
+}
+
+// Forgets the value that was scanned, to scan the next one
+func (p *RespParser) Reset() {
+	*p = RespParser{remaining: p.remaining[:0], Limits: p.Limits}
+}
+
+// Returns how many bytes at the start of the data the parser no longer needs to continue the value it is scanning,
+// given the length of the data scanned last. Dropping them with Discard lets a value be streamed without holding all
+// of it, such as a bulk string that is passed on as it arrives.
+func (p *RespParser) Streamable(length int) int {
+	if p.done || p.err != nil {
+		return 0
+	} else if p.bulkEnd > 0 && length < p.bulkEnd {
+		return length
+	}
+	return p.offset
+}
+
+// Forgets the first n bytes of the value, so that the data passed to Scan starts after them from then on
+func (p *RespParser) Discard(n int) {
+	p.offset -= n
+	if p.bulkEnd > 0 {
+		p.bulkEnd -= n
+	}
+	p.lineStart -= n
+	p.searched -= n
+}
+
+// Asks for more data, or at EOF gives up on the incomplete value
+func (p *RespParser) needMore(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if err = p.checkValueLength(len(data)); err != nil {
+		return 0, nil, err
+	}
+	if atEOF {
+		return len(data), nil, nil
+	}
+	return 0, nil, nil
+}
+
+// Returns the end of the line at the offset, or 0 if its newline was not read yet. Like scanNewline, a newline that is
+// not preceded by a '\r' does not end the line.
+func (p *RespParser) lineEnd(data []byte) (end int, err error) {
+	if p.searched < p.offset {
+		p.lineStart, p.searched = p.offset, p.offset
+	}
+
+	for {
+		ndxNL := bytes.IndexByte(data[p.searched:], '\n')
+		if ndxNL < 0 {
+			p.searched = len(data)
+			// The last byte may be the '\r' of the newline
+			return 0, p.checkLineLength(len(data) - 1)
+		}
+
+		newline := p.searched + ndxNL
+		if err := p.checkLineLength(newline - 1); err != nil {
+			return 0, err
+		}
+		if newline-p.lineStart < 2 {
+			return 0, ERROR_COMMAND_PARSE
+		} else if data[newline-1] == '\r' {
+			return newline + 1, nil
+		}
+		// Didn't match a CRNL, scan past the newline
+		p.lineStart, p.searched = newline+1, newline+1
 	}
+}
+
+// Fails lines longer than the limit, given where the line ends, not counting its newline
+func (p *RespParser) checkLineLength(end int) error {
+	if p.Limits.MaxLineLength > 0 && end-p.offset > p.Limits.MaxLineLength {
+		return ERR_LINE_TOO_LONG
+	}
+	return nil
+}
+
+// Fails values longer than the limit, given how long the value is known to be at least
+func (p *RespParser) checkValueLength(length int) error {
+	if p.Limits.MaxValueLength > 0 && length > p.Limits.MaxValueLength {
+		p.err = ERR_RESPONSE_TOO_LONG
+	}
+	return p.err
+}
 
-	switch peek := data[0]; peek {
-	case '+':
-		advance, token, err = ScanSimpleString(data, atEOF)
-	case '$':
-		advance, token, err = ScanBulkString(data, atEOF)
-	case ':':
-		advance, token, err = ScanInteger(data, atEOF)
-	case '-':
-		advance, token, err = ScanError(data, atEOF)
-	case '*':
-		advance, token, err = ScanArray(data, atEOF)
-	default:
-		advance, token, err = ScanInlineString(data, atEOF)
+// Counts a value towards the arrays it is in, returning whether the outermost value is complete
+func (p *RespParser) completeValue() bool {
+	for len(p.remaining) > 0 {
+		last := len(p.remaining) - 1
+		if p.remaining[last]--; p.remaining[last] > 0 {
+			return false
+		}
+		p.remaining = p.remaining[:last]
 	}
+	return true
+}
 
-	return
+// Parses the length of a bulk string or the count of an array
+func parseHeader(header []byte) (int, error) {
+	if len(header) == 0 {
+		return 0, ERROR_COMMAND_PARSE
+	}
+	return ParseInt(header)
 }
 
 func scanNewline(data []byte, atEOF bool) (advance int, token []byte, err error) {
@@ -186,10 +383,6 @@ func ScanInlineString(data []byte, atEOF bool) (advance int, token []byte, err e
 
 // =============== Array ==============
 func ScanArray(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	if atEOF && len(data) == 0 {
-		return 0, nil, nil
-	}
-
 	if len(data) == 0 {
 		return 0, nil, nil
 	}
@@ -198,44 +391,6 @@ func ScanArray(data []byte, atEOF bool) (advance int, token []byte, err error) {
 		return 0, nil, ERROR_COMMAND_PARSE
 	}
 
-	advance, token, err = scanNewline(data, atEOF)
-	if err != nil {
-		return 0, nil, err
-	} else if advance == 0 || token == nil || len(token) < 3 {
-		if len(token) < 3 && len(token) > 0 {
-//			Debug("Hm. %q", token)
-		}
-		// Asking for more data
-		return 0, nil, nil
-	}
-
-	arrayCountBytes := token[1 : len(token)-2]
-	if len(arrayCountBytes) == 0 {
-		return 0, nil, ERROR_COMMAND_PARSE
-	}
-
-	arrayCount, err := ParseInt(arrayCountBytes)
-	if err != nil {
-		return 0, nil, err
-	}
-
-	s := advance
-	rData := data[s:]
-	for i := 0; i < arrayCount; i++ {
-		advance, token, err = ScanResp(rData, atEOF)
-		if token == nil || err != nil {
-			if advance == 0 {
-				return 0, token, err
-			} else {
-				return s + advance, token, err
-			}
-		}
-
-		s += advance
-
-		rData = data[s:]
-	}
-
-	return s, data[:s], nil
+	var parser RespParser
+	return parser.Scan(data, atEOF)
 }
-
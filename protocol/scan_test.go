@@ -28,7 +28,10 @@ package protocol
 import (
 	"bufio"
 	"bytes"
+	"fmt"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func TestScanResp(t *testing.T) {
@@ -121,3 +124,126 @@ func TestScanNewline(t *testing.T) {
 		}
 	}
 }
+
+func TestRespScanner_RetainTokens(t *testing.T) {
+	// Enough commands to go through several buffers
+	var input strings.Builder
+	var expected []string
+	for i := 0; i < 1000; i++ {
+		command := fmt.Sprintf("*2\r\n$3\r\nget\r\n$%d\r\nkey%d\r\n", len(fmt.Sprint(i))+3, i)
+		input.WriteString(command)
+		expected = append(expected, command)
+	}
+
+	scanner := NewRespScanner(iotest.HalfReader(strings.NewReader(input.String())))
+	scanner.RetainTokens()
+
+	var tokens [][]byte
+	for scanner.Scan() {
+		tokens = append(tokens, scanner.Bytes())
+		if len(tokens)%100 == 0 {
+			for i, token := range tokens {
+				if string(token) != expected[i] {
+					t.Fatalf("Token %d changed to %q before being released", i, token)
+				}
+			}
+			if len(tokens)%200 == 0 {
+				scanner.Release()
+				tokens = tokens[:0]
+				expected = expected[200:]
+			}
+		}
+	}
+	if scanner.Err() != nil {
+		t.Fatalf("Unexpected error %s", scanner.Err())
+	}
+	if len(tokens) != 0 {
+		t.Fatalf("Expected every token to be released, %d were not", len(tokens))
+	}
+}
+
+func TestRespParser_Resume(t *testing.T) {
+	testData := []string{
+		"+OK\r\n",
+		"$5\r\nbulks\r\n",
+		"$-1\r\n",
+		"*0\r\n",
+		"*-1\r\n",
+		"*5\r\n$4\r\nping\r\n$3\r\nget\r\n$2\r\nok\r\n:5\r\n+ok\r\n",
+		"*2\r\n*2\r\n+OK\r\n+PING\r\n*2\r\n$6\r\nSELECT\r\n:5\r\n",
+		"*3\r\n*0\r\n$0\r\n\r\n*1\r\n*1\r\n$2\r\n\r\n\r\n",
+		"Test newline\nin middle\r\n",
+	}
+
+	for _, value := range testData {
+		var parser RespParser
+		// Feed the value a byte at a time, followed by the next value
+		data := []byte(value + "+next\r\n")
+		for i := 0; i <= len(data); i++ {
+			advance, token, err := parser.Scan(data[:i], false)
+			if err != nil {
+				t.Fatalf("Unexpected error scanning %q: %s", data[:i], err)
+			}
+			if i < len(value) && (advance != 0 || token != nil) {
+				t.Fatalf("Scanned %q from %q, before %q was complete", token, data[:i], value)
+			}
+			if i >= len(value) && (advance != len(value) || string(token) != value) {
+				t.Fatalf("Expected %q from %q, got %q", value, data[:i], token)
+			}
+		}
+
+		parser.Reset()
+		if _, token, _ := parser.Scan(data[len(value):], false); string(token) != "+next\r\n" {
+			t.Errorf("Expected the next value after a reset, got %q", token)
+		}
+	}
+}
+
+func TestRespScanner_SmallReads(t *testing.T) {
+	// A large reply arriving a byte at a time, followed by another one
+	var reply strings.Builder
+	reply.WriteString("*1000\r\n")
+	for i := 0; i < 1000; i++ {
+		reply.WriteString(fmt.Sprintf("$%d\r\nvalue%d\r\n", len(fmt.Sprint(i))+5, i))
+	}
+	bulk := "$10000\r\n" + strings.Repeat("x", 10000) + "\r\n"
+
+	scanner := NewRespScanner(iotest.OneByteReader(strings.NewReader(reply.String() + bulk)))
+	for _, expected := range []string{reply.String(), bulk} {
+		if !scanner.Scan() {
+			t.Fatalf("Failed to scan: %v", scanner.Err())
+		} else if string(scanner.Bytes()) != expected {
+			t.Fatalf("Expected %d bytes, got %d", len(expected), len(scanner.Bytes()))
+		}
+	}
+	if scanner.Scan() {
+		t.Fatalf("Did not expect another token, got %q", scanner.Bytes())
+	}
+}
+
+func TestRespParser_Limits(t *testing.T) {
+	limits := ScanLimits{MaxBulkLength: 5, MaxArrayLength: 2, MaxLineLength: 16}
+	testData := []struct {
+		data string
+		err  error
+	}{
+		{"*2\r\n$3\r\nget\r\n$5\r\nkey12\r\n", nil},
+		{"*2\r\n$3\r\nget\r\n$6\r\n", ERR_BULK_TOO_LONG},
+		{"*3\r\n", ERR_TOO_MANY_ARGUMENTS},
+		{"*1\r\n*3\r\n", ERR_TOO_MANY_ARGUMENTS},
+		{"get 0123456789ab\r\n", nil},
+		{"get 0123456789abcd", ERR_LINE_TOO_LONG},
+		{"get 0123456789abc\r\n", ERR_LINE_TOO_LONG},
+	}
+
+	for _, d := range testData {
+		parser := RespParser{Limits: limits}
+		_, _, err := parser.Scan([]byte(d.data), false)
+		if err != d.err {
+			t.Errorf("Expected %v scanning %q, got %v", d.err, d.data, err)
+		}
+		if err != nil && !IsLimitError(err) {
+			t.Errorf("Expected a limit error scanning %q, got %v", d.data, err)
+		}
+	}
+}
@@ -26,33 +26,84 @@
 package protocol
 
 import (
-	"bytes"
 	"io"
+	"sync"
 )
 
+// The smallest and largest amount a scanner reads at once. Scanners start with the smallest, and adapt to how much
+// data their reader has available. Buffers between these sizes are reused through pools.
+const (
+	SCAN_BUFFER_SIZE     = 4096
+	SCAN_MAX_BUFFER_SIZE = 64 * 1024
+	// How much of a response is held at most while it is passed on to a client
+	STREAM_BUFFER_SIZE = 16 * 1024
+)
+
+// A pool for each power of two from SCAN_BUFFER_SIZE to SCAN_MAX_BUFFER_SIZE
+var scanBufferPools [5]sync.Pool
+
+func scanBufferPool(size int) *sync.Pool {
+	class := 0
+	for poolSize := SCAN_BUFFER_SIZE; poolSize < size; poolSize *= 2 {
+		class++
+	}
+	if class >= len(scanBufferPools) || SCAN_BUFFER_SIZE<<class != size {
+		return nil
+	}
+	return &scanBufferPools[class]
+}
+
+func getScanBuffer(size int) []byte {
+	if pool := scanBufferPool(size); pool != nil {
+		if buffer, ok := pool.Get().(*[]byte); ok {
+			return *buffer
+		}
+	}
+	return make([]byte, size)
+}
+
+func putScanBuffer(buffer []byte) {
+	if pool := scanBufferPool(cap(buffer)); pool != nil {
+		buffer = buffer[:cap(buffer)]
+		pool.Put(&buffer)
+	}
+}
+
 // A partially-built scanner that can handle >64kb
+// Tokens reference the scanner's buffer rather than being copied out of it.
 type RespScanner struct {
 	r     io.Reader
 	token []byte
-	tmp [2048]byte // temp read buffer
-	b *bytes.Buffer
-	err   error
+	// Data that was read but not scanned yet is buf[start:end]
+	buf        []byte
+	start, end int
+	err        error
+	// Remembers how much of the token at start was scanned already
+	parser RespParser
+	// How much to read at once, between SCAN_BUFFER_SIZE and SCAN_MAX_BUFFER_SIZE
+	readSize int
+
+	// When retaining, tokens stay valid until Release. pinned is set while
+	// the buffer holds such tokens, and buffers replaced while pinned wait in retired.
+	retain  bool
+	pinned  bool
+	retired [][]byte
 
 	empties int
 }
 
 func NewRespScanner(r io.Reader) *RespScanner {
 	return &RespScanner{
-		r: r,
-		b: new(bytes.Buffer),
+		r:        r,
+		readSize: SCAN_BUFFER_SIZE,
 	}
 }
 
 func (s *RespScanner) Scan() bool {
 	for {
-		if s.b.Len() > 0 || s.err != nil {
+		if s.end > s.start || s.err != nil {
 			// See if we can get a token with what we already have.
-			advance, token, err := ScanResp(s.b.Bytes(), s.err != nil)
+			advance, token, err := s.parser.Scan(s.buf[s.start:s.end], s.err != nil)
 
 			if err != nil {
 				s.setErr(err)
@@ -65,6 +116,7 @@ func (s *RespScanner) Scan() bool {
 
 			s.token = token
 			if token != nil {
+				s.pinned = s.retain
 				if s.err == nil || advance > 0 {
 					s.empties = 0
 				} else {
@@ -86,30 +138,146 @@ func (s *RespScanner) Scan() bool {
 		}
 
 		// Time to read data.
-		for loop := 0; ; {
-			n, err := s.r.Read(s.tmp[:])
+		s.read()
+	}
+}
 
-			if err != nil {
-				s.setErr(err)
-				break
-			}
+// Reads the rest of the value that Scan gave up on for being longer than the MaxValueLength of the scanner, dropping
+// it as it arrives instead of holding it, so that the values after it can be scanned.  Returns false if the rest of the
+// value could not be read.
+func (s *RespScanner) Skip() bool {
+	if s.err != ERR_RESPONSE_TOO_LONG {
+		return false
+	}
+	s.err = nil
 
-			s.b.Write(s.tmp[:n])
+	limits := s.parser.Limits
+	s.parser.Reset()
+	s.parser.Limits = ScanLimits{}
+	defer s.SetLimits(limits)
 
-			if n > 0 {
-				s.empties = 0
-				break
-			}
+	for {
+		advance, token, err := s.parser.Scan(s.buf[s.start:s.end], s.err != nil)
+		if err != nil {
+			s.setErr(err)
+			return false
+		} else if token != nil {
+			return s.advance(advance)
+		} else if s.err != nil {
+			return false
+		}
 
-			loop++
-			if loop > 100 {
-				s.setErr(io.ErrNoProgress)
-				break
-			}
+		// Only the data the parser still needs to find the end of the value is kept
+		dropped := s.parser.Streamable(s.end - s.start)
+		s.parser.Discard(dropped)
+		s.start += dropped
+		s.read()
+	}
+}
+
+// Reads once from the reader, after making room for it
+func (s *RespScanner) read() {
+	s.makeRoom()
+	for loop := 0; ; {
+		n, err := s.r.Read(s.buf[s.end:])
+		s.adaptReadSize(n, len(s.buf)-s.end)
+		s.end += n
+
+		if err != nil {
+			s.setErr(err)
+			return
+		}
+
+		if n > 0 {
+			s.empties = 0
+			return
+		}
+
+		loop++
+		if loop > 100 {
+			s.setErr(io.ErrNoProgress)
+			return
 		}
 	}
 }
 
+// Makes sure there is room to read after the unscanned data, in a buffer of at least twice the unscanned data, so
+// that a token too large for the buffer takes a number of copies logarithmic in its size to complete.
+// Scanned data is only overwritten when tokens are not retained.
+func (s *RespScanner) makeRoom() {
+	unscanned := s.end - s.start
+	size := s.readSize
+	for size < unscanned*2 {
+		size *= 2
+	}
+
+	if s.buf != nil && !s.pinned {
+		if unscanned == 0 {
+			s.start, s.end = 0, 0
+		}
+		if len(s.buf) == size && s.end == len(s.buf) {
+			// Slide the unscanned data to the front
+			copy(s.buf, s.buf[s.start:s.end])
+			s.start, s.end = 0, unscanned
+		}
+	}
+	if s.buf != nil && s.end < len(s.buf) && (len(s.buf) == size || s.pinned || unscanned > 0) {
+		return
+	}
+
+	// Grow, shrink back after a large token or change to another read size
+	buf := getScanBuffer(size)
+	if s.buf != nil {
+		copy(buf, s.buf[s.start:s.end])
+		if s.pinned {
+			s.retired = append(s.retired, s.buf)
+		} else {
+			putScanBuffer(s.buf)
+		}
+	}
+	s.buf, s.start, s.end = buf, 0, unscanned
+}
+
+// Reads more at once from a reader that keeps filling the buffer, and less from one that doesn't
+func (s *RespScanner) adaptReadSize(n, room int) {
+	if n == room && room >= s.readSize/2 && s.readSize < SCAN_MAX_BUFFER_SIZE {
+		s.readSize *= 2
+	} else if n < s.readSize/4 && s.readSize > SCAN_BUFFER_SIZE {
+		s.readSize /= 2
+	}
+}
+
+// Makes the scanner fail with a limit error on values beyond the given limits
+func (s *RespScanner) SetLimits(limits ScanLimits) {
+	s.parser.Limits = limits
+}
+
+// Makes tokens stay valid until Release is called, instead of until the next call to Scan
+func (s *RespScanner) RetainTokens() {
+	s.retain = true
+}
+
+// Lets the scanner reuse the memory of every token it returned so far.
+// Only meaningful after RetainTokens.
+func (s *RespScanner) Release() {
+	for i, buf := range s.retired {
+		putScanBuffer(buf)
+		s.retired[i] = nil
+	}
+	s.retired = s.retired[:0]
+	s.pinned = false
+}
+
+// Returns the scanner's buffer to the pool when it holds neither unscanned data nor retained tokens, for scanners that
+// are done or about to be idle. The scanner gets a new buffer if it reads again.
+func (s *RespScanner) Free() {
+	if s.pinned || s.start != s.end || s.buf == nil {
+		return
+	}
+	putScanBuffer(s.buf)
+	s.buf, s.start, s.end = nil, 0, 0
+}
+
 func (s *RespScanner) setErr(err error) {
 	if s.err == nil || s.err == io.EOF {
 		s.err = err
@@ -125,13 +293,34 @@ func (s *RespScanner) Err() error {
 }
 
 func (s *RespScanner) advance(n int) bool {
-	s.b.Next(n)
+	s.start += n
+	if n > 0 {
+		s.parser.Reset()
+	}
 	return true
 }
 
+// Whether the next call to Scan returns without reading, because a whole token or an error is buffered already
+func (s *RespScanner) Ready() bool {
+	if s.err != nil {
+		return true
+	}
+	if s.end == s.start {
+		return false
+	}
+	// Whatever is scanned here is not scanned again by Scan
+	_, token, err := s.parser.Scan(s.Buffered(), false)
+	return token != nil || err != nil
+}
+
+// Returns the data that was read, but not returned as a token yet
+func (s *RespScanner) Buffered() []byte {
+	return s.buf[s.start:s.end]
+}
+
 // Returns the most recent token generated by a successful call to Scan()
-// The array's contents may be invalid on the next call to scan, make sure
-// to copy it somewhere safe.
+// The array's contents may be invalid on the next call to scan (or, after
+// RetainTokens, the next call to Release), make sure to copy it somewhere safe.
 func (s *RespScanner) Bytes() []byte {
 	return s.token
 }
@@ -67,6 +67,10 @@ func (this *SimpleCommand) GetFirstArg() []byte {
 	return nil
 }
 
+func (this *SimpleCommand) GetArgs() [][]byte {
+	return nil
+}
+
 func (this *SimpleCommand) GetArgCount() int {
 	return 0
 }
@@ -79,6 +79,10 @@ func (this *StringCommand) GetFirstArg() []byte {
 	return nil
 }
 
+func (this *StringCommand) GetArgs() [][]byte {
+	return nil
+}
+
 func (this *StringCommand) GetArgCount() int {
 	return 0
 }
@@ -0,0 +1,287 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package rmux
+
+import (
+	"rmux/graphite"
+	"rmux/protocol"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The commands clients send to the redis servers are rate limited by token buckets: for the whole multiplexer, for
+// the clients of each identity (see Client.identity), and for the write and heavy commands of all clients. A command
+// that exceeds a limit waits for up to the RateLimiter's MaxDelay, or is answered with protocol.ERR_RATE_LIMITED if it
+// would have to wait longer.  A client that holds queued commands or a reserved connection is not delayed, since it
+// would hold them while it waits, but rejected right away.
+
+const (
+	//How often the rate limits of identities that have no clients anymore are dropped
+	EXTERN_RATE_LIMIT_PURGE_INTERVAL = time.Minute
+)
+
+// A token bucket that allows Rate commands per second on average, in bursts of up to Burst commands
+type RateLimit struct {
+	// The name the commands beyond this limit are counted as, rate_limited_<name> and rate_delayed_<name>
+	Name  string
+	Rate  float64
+	Burst float64
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+	// The amount of commands that were rejected or delayed by this limit
+	limited uint64
+	delayed uint64
+}
+
+// Creates a full bucket.  A burst of zero or less allows a second's worth of commands at once
+func NewRateLimit(name string, rate, burst int) *RateLimit {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &RateLimit{Name: name, Rate: float64(rate), Burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Takes a token for a command, which is available after the returned delay.  A command that would have to wait for
+// longer than maxDelay does not take a token
+func (this *RateLimit) reserve(now time.Time, maxDelay time.Duration) (delay time.Duration, ok bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.refill(now)
+	if this.tokens < 1 {
+		delay = time.Duration((1 - this.tokens) / this.Rate * float64(time.Second))
+		if delay > maxDelay {
+			return 0, false
+		}
+	}
+	this.tokens--
+	return delay, true
+}
+
+// Gives back the token of a command that is not sent after all
+func (this *RateLimit) cancel() {
+	this.lock.Lock()
+	if this.tokens++; this.tokens > this.Burst {
+		this.tokens = this.Burst
+	}
+	this.lock.Unlock()
+}
+
+func (this *RateLimit) refill(now time.Time) {
+	if elapsed := now.Sub(this.last); elapsed > 0 {
+		this.tokens += elapsed.Seconds() * this.Rate
+		if this.tokens > this.Burst {
+			this.tokens = this.Burst
+		}
+		this.last = now
+	}
+}
+
+// Whether the bucket is full again, so that it limits no differently than a new one
+func (this *RateLimit) full(now time.Time) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.refill(now)
+	return this.tokens >= this.Burst
+}
+
+// The amount of commands that were rejected by this limit
+func (this *RateLimit) Limited() uint64 {
+	return atomic.LoadUint64(&this.limited)
+}
+
+// The amount of commands that were delayed by this limit
+func (this *RateLimit) Delayed() uint64 {
+	return atomic.LoadUint64(&this.delayed)
+}
+
+// The rate limits of a multiplexer.  Zero rates disable a limit.  The instance, write and heavy limits are shared by
+// all clients of the multiplexer, whatever their identity; only the client limit is kept per identity
+type RateLimiter struct {
+	// How long a command may be delayed to stay within the limits.  Zero rejects commands beyond a limit right away
+	MaxDelay time.Duration
+
+	instance, write, heavy *RateLimit
+	clientRate             int
+
+	lock sync.Mutex
+	// The limits of the clients of each identity, and how many clients share them
+	identities map[string]*sharedRateLimit
+}
+
+type sharedRateLimit struct {
+	limit   *RateLimit
+	clients int
+}
+
+func NewRateLimiter(rate, clientRate, writeRate, heavyRate int, maxDelay time.Duration) *RateLimiter {
+	limiter := &RateLimiter{MaxDelay: maxDelay, clientRate: clientRate, identities: make(map[string]*sharedRateLimit)}
+	if rate > 0 {
+		limiter.instance = NewRateLimit("instance", rate, 0)
+	}
+	if writeRate > 0 {
+		limiter.write = NewRateLimit("write", writeRate, 0)
+	}
+	if heavyRate > 0 {
+		limiter.heavy = NewRateLimit("heavy", heavyRate, 0)
+	}
+	return limiter
+}
+
+// Returns the limit shared by the clients of the given identity, or a limit of its own for a client of an unknown
+// identity.  The limit has to be given back with releaseClient once the client disconnects or changes its identity
+func (this *RateLimiter) clientLimit(identity string) *RateLimit {
+	if this.clientRate <= 0 {
+		return nil
+	}
+	if identity == "" {
+		return NewRateLimit("client", this.clientRate, 0)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	shared := this.identities[identity]
+	if shared == nil {
+		shared = &sharedRateLimit{limit: NewRateLimit("client", this.clientRate, 0)}
+		this.identities[identity] = shared
+	}
+	shared.clients++
+	return shared.limit
+}
+
+// Stops sharing the limit of the given identity with a client that disconnected or changed its identity
+func (this *RateLimiter) releaseClient(identity string) {
+	this.lock.Lock()
+	if shared := this.identities[identity]; shared != nil {
+		shared.clients--
+	}
+	this.lock.Unlock()
+}
+
+// Drops the limits of identities that have no clients anymore, once their buckets are full, since a new one would limit
+// their next client no differently.  Returns the amount of limits that were dropped
+func (this *RateLimiter) purge() (purged int) {
+	now := time.Now()
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for identity, shared := range this.identities {
+		if shared.clients <= 0 && shared.limit.full(now) {
+			delete(this.identities, identity)
+			purged++
+		}
+	}
+	return
+}
+
+// Waits until the command is within all limits that apply to it, or returns protocol.ERR_RATE_LIMITED if it would
+// have to wait longer than maxDelay
+func (this *RateLimiter) wait(clientLimit *RateLimit, command []byte, maxDelay time.Duration) error {
+	var limits [4]*RateLimit
+	applying := append(limits[:0], this.instance, clientLimit)
+	if this.write != nil && protocol.IsWriteFunction(command) {
+		applying = append(applying, this.write)
+	}
+	if this.heavy != nil && protocol.IsHeavyFunction(command) {
+		applying = append(applying, this.heavy)
+	}
+
+	now := time.Now()
+	var delay time.Duration
+	var delayedBy *RateLimit
+	for i, limit := range applying {
+		if limit == nil {
+			continue
+		}
+		limitDelay, ok := limit.reserve(now, maxDelay)
+		if !ok {
+			// The tokens taken already are not used
+			for _, taken := range applying[:i] {
+				if taken != nil {
+					taken.cancel()
+				}
+			}
+			atomic.AddUint64(&limit.limited, 1)
+			graphite.Increment("rate_limited_" + limit.Name)
+			return protocol.ERR_RATE_LIMITED
+		}
+		if limitDelay > delay {
+			delay, delayedBy = limitDelay, limit
+		}
+	}
+
+	if delay > 0 {
+		atomic.AddUint64(&delayedBy.delayed, 1)
+		graphite.Increment("rate_delayed_" + delayedBy.Name)
+		time.Sleep(delay)
+	}
+	return nil
+}
+
+// Identifies the client for its client rate limit: by the user it authenticated as, or else by the name it gave
+// itself with CLIENT SETNAME, or else by its Source
+func (this *Client) identity() string {
+	if this.user != "" {
+		return "user:" + this.user
+	}
+	if this.name != "" {
+		return "name:" + this.name
+	}
+	return this.Source
+}
+
+// Shares the client limit of the client's identity, after leaving the one of its previous identity
+func (this *Client) joinRateLimit() {
+	if this.RateLimiter == nil {
+		return
+	}
+	identity := this.identity()
+	if this.rateLimit != nil && identity == this.rateLimitIdentity {
+		return
+	}
+	this.leaveRateLimit()
+	this.rateLimit, this.rateLimitIdentity = this.RateLimiter.clientLimit(identity), identity
+}
+
+// Stops sharing the client limit of the client's identity, once it disconnects
+func (this *Client) leaveRateLimit() {
+	if this.rateLimit != nil {
+		this.RateLimiter.releaseClient(this.rateLimitIdentity)
+		this.rateLimit = nil
+	}
+}
+
+// Waits until the command is within the client's rate limits.  A client that holds queued commands or a reserved
+// connection is rejected instead of delayed, since it would hold them while it waits
+func (this *Client) waitForRateLimits(command []byte) error {
+	maxDelay := this.RateLimiter.MaxDelay
+	if this.HasQueued() || this.reservedRedisConn != nil {
+		maxDelay = 0
+	}
+	return this.RateLimiter.wait(this.rateLimit, command, maxDelay)
+}
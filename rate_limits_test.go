@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package rmux
+
+import (
+	"bufio"
+	"net"
+	"rmux/protocol"
+	"testing"
+	"time"
+)
+
+func TestRateLimit_Reserve(t *testing.T) {
+	limit := NewRateLimit("test", 10, 2)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if delay, ok := limit.reserve(now, 0); !ok || delay != 0 {
+			t.Fatalf("Expected the burst to be allowed right away, got %s, %v", delay, ok)
+		}
+	}
+	if _, ok := limit.reserve(now, 0); ok {
+		t.Error("Expected a command beyond the burst to be rejected")
+	}
+	if delay, ok := limit.reserve(now, 200*time.Millisecond); !ok || delay != 100*time.Millisecond {
+		t.Errorf("Expected a command beyond the burst to be delayed by 100ms, got %s, %v", delay, ok)
+	}
+	if delay, ok := limit.reserve(now.Add(time.Second), 0); !ok || delay != 0 {
+		t.Errorf("Expected the bucket to refill, got %s, %v", delay, ok)
+	}
+}
+
+func TestRateLimiter_Wait(t *testing.T) {
+	limiter := NewRateLimiter(2, 0, 1, 0, 0)
+
+	if err := limiter.wait(nil, []byte("set"), limiter.MaxDelay); err != nil {
+		t.Fatalf("Expected the first write to be allowed, got %s", err)
+	}
+	if err := limiter.wait(nil, []byte("set"), limiter.MaxDelay); err != protocol.ERR_RATE_LIMITED {
+		t.Fatalf("Expected the second write to be limited, got %v", err)
+	}
+	// The token the rejected write took of the instance limit was given back
+	if err := limiter.wait(nil, []byte("get"), limiter.MaxDelay); err != nil {
+		t.Fatalf("Expected a read to be allowed, got %s", err)
+	}
+	if err := limiter.wait(nil, []byte("get"), limiter.MaxDelay); err != protocol.ERR_RATE_LIMITED {
+		t.Fatalf("Expected a read beyond the instance limit to be limited, got %v", err)
+	}
+	if limiter.write.Limited() != 1 || limiter.instance.Limited() != 1 {
+		t.Errorf("Expected one command to be limited by each limit, got %d writes and %d in total",
+			limiter.write.Limited(), limiter.instance.Limited())
+	}
+
+	limiter = NewRateLimiter(0, 0, 0, 20, 100*time.Millisecond)
+	for i := 0; i < 21; i++ {
+		if err := limiter.wait(nil, []byte("sort"), limiter.MaxDelay); err != nil {
+			t.Fatalf("Expected a heavy command to be delayed instead of limited, got %s", err)
+		}
+	}
+	if limiter.heavy.Delayed() != 1 {
+		t.Errorf("Expected one command to be delayed, got %d", limiter.heavy.Delayed())
+	}
+}
+
+func TestRateLimiter_Sources(t *testing.T) {
+	limiter := NewRateLimiter(0, 10, 0, 0, 0)
+
+	first, second := limiter.clientLimit("uid:1000"), limiter.clientLimit("uid:1000")
+	if first != second {
+		t.Error("Expected the clients of a source to share their limit")
+	}
+	if limiter.clientLimit("") == limiter.clientLimit("") {
+		t.Error("Expected the clients of unknown sources to have limits of their own")
+	}
+
+	limiter.releaseClient("uid:1000")
+	if purged := limiter.purge(); purged != 0 {
+		t.Errorf("Expected the limit of a source with clients to be kept, %d were purged", purged)
+	}
+	limiter.releaseClient("uid:1000")
+	if purged := limiter.purge(); purged != 1 {
+		t.Errorf("Expected the limit of a source without clients to be purged, %d were purged", purged)
+	}
+}
+
+func TestClient_RateLimitIdentity(t *testing.T) {
+	client := NewClient(&net.UnixConn{}, false, nil, time.Second)
+	client.Source = "uid:1000"
+	client.RateLimiter = NewRateLimiter(0, 10, 0, 0, 0)
+	client.joinRateLimit()
+
+	for _, testCase := range []struct {
+		input    string
+		identity string
+	}{
+		// A password alone does not name a user
+		{"*2\r\n$4\r\nauth\r\n$6\r\nsecret\r\n", "uid:1000"},
+		{"*3\r\n$6\r\nclient\r\n$7\r\nsetname\r\n$6\r\nworker\r\n", "name:worker"},
+		{"*3\r\n$4\r\nauth\r\n$5\r\nalice\r\n$6\r\nsecret\r\n", "user:alice"},
+		// The user takes precedence over the name
+		{"*3\r\n$6\r\nclient\r\n$7\r\nsetname\r\n$5\r\nother\r\n", "user:alice"},
+	} {
+		command, err := protocol.ParseCommand([]byte(testCase.input))
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %s", testCase.input, err)
+		}
+		if _, err := client.ParseCommand(command); err != nil {
+			t.Fatalf("Expected %q to be answered, got %s", testCase.input, err)
+		}
+		if client.rateLimitIdentity != testCase.identity {
+			t.Errorf("Expected the client to be limited as %s after %q, got %s", testCase.identity, testCase.input,
+				client.rateLimitIdentity)
+		}
+	}
+
+	for identity, clients := range map[string]int{"uid:1000": 0, "name:worker": 0, "user:alice": 1} {
+		if shared := client.RateLimiter.identities[identity]; shared == nil || shared.clients != clients {
+			t.Errorf("Expected %d clients to share the limit of %s, got %+v", clients, identity, shared)
+		}
+	}
+	client.leaveRateLimit()
+	if shared := client.RateLimiter.identities["user:alice"]; shared.clients != 0 {
+		t.Errorf("Expected the limit of a disconnected client to be released, %d clients share it", shared.clients)
+	}
+}
+
+func TestClient_RateLimitedWhileQueued(t *testing.T) {
+	client := NewClient(&net.UnixConn{}, false, nil, time.Second)
+	client.RateLimiter = NewRateLimiter(1, 0, 0, 0, time.Minute)
+	get, err := protocol.ParseCommand([]byte("*2\r\n$3\r\nget\r\n$1\r\na\r\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse get: %s", err)
+	}
+
+	if _, err := client.ParseCommand(get); err != nil {
+		t.Fatalf("Expected the first command to be allowed, got %s", err)
+	}
+	// A client that would be delayed while it holds queued commands is rejected instead
+	client.queued = append(client.queued, get)
+	start := time.Now()
+	if _, err := client.ParseCommand(get); err != protocol.ERR_RATE_LIMITED {
+		t.Fatalf("Expected a queued client to be rate limited, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Expected a queued client not to be delayed, it waited for %s", elapsed)
+	}
+}
+
+func TestHandleClientRequests_RateLimited(t *testing.T) {
+	server, stop := newBenchmarkServer(t)
+	defer stop()
+	local, remote := net.Pipe()
+	defer remote.Close()
+	client := NewClient(local, server.multiplexing, server.HashRing, time.Second)
+	client.RateLimiter = NewRateLimiter(0, 1, 0, 0, 0)
+	client.joinRateLimit()
+	go server.HandleClientRequests(client)
+
+	// Commands rmux answers itself are not limited
+	go remote.Write([]byte("*2\r\n$3\r\nget\r\n$1\r\na\r\n*1\r\n$4\r\nping\r\n*2\r\n$3\r\nget\r\n$1\r\nb\r\n"))
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(remote)
+	for _, expected := range []string{"+redis:a\r\n", "+PONG\r\n", "-ERR rate limited\r\n"} {
+		if line, err := reader.ReadString('\n'); err != nil || line != expected {
+			t.Fatalf("Expected %q, got %q: %v", expected, line, err)
+		}
+	}
+}
@@ -50,6 +50,10 @@ var (
 	CONNECTION_DOWN_RESPONSE = []byte("Connection down")
 	//Default diagnostic check interval
 	EXTERN_DIAGNOSTIC_CHECK_INTERVAL = 1 * time.Second
+	//Default interval in which credentials that are read from files or the environment are re-read
+	EXTERN_CREDENTIAL_REFRESH_INTERVAL = 30 * time.Second
+	//Interval in which the checkouts of all connection pools are checked for long checkouts
+	EXTERN_CHECKOUT_CHECK_INTERVAL = 1 * time.Second
 )
 
 var version string = "dev"
@@ -79,16 +83,99 @@ type RedisMultiplexer struct {
 	EndpointWriteTimeout time.Duration
 	//An overridable reconnection interval. Defaults to EXTERN_RECONNECT_INTERVAL
 	EndpointReconnectInterval time.Duration
+	//An overridable random reduction of the reconnection interval.  Defaults to a tenth of the reconnection interval
+	EndpointReconnectJitter time.Duration
+	//The amount of idle connections per endpoint that are dialed ahead of time and kept connected
+	EndpointMinIdle int
+	//Idle time after which connections beyond EndpointMinIdle are closed.  Zero keeps idle connections connected
+	EndpointMaxIdleTime time.Duration
 	//An overridable diagnostic check interval.  Defaults to EXTERN_DIAGNOSTIC_CHECK_INTERVAL
 	EndpointDiagnosticCheckInterval time.Duration
+	//An overridable timeout for diagnostic checks.  Zero uses the endpoint connect, read and write timeouts
+	EndpointDiagnosticCheckTimeout time.Duration
+	//An overridable time clients wait for a free connection.  Defaults to EXTERN_POOL_WAIT_TIMEOUT
+	EndpointWaitTimeout time.Duration
+	//The amount of clients that may wait for a free connection per endpoint.  Zero lets any amount of clients wait
+	EndpointMaxWaiters int
+	//The amount of connections per endpoint shared by all clients for stateless requests.  Zero disables sharing
+	EndpointSharedConnections int
+	//The lowest limit on the requests in flight per endpoint an adaptive concurrency limit may drop to.  Zero, the
+	//default, disables adaptive concurrency limits
+	EndpointConcurrencyMinLimit int
+	//An overridable factor by which round trips may exceed their average before the concurrency limit of an endpoint is
+	//reduced.  Defaults to EXTERN_CONCURRENCY_TOLERANCE
+	EndpointConcurrencyTolerance float64
+	//An overridable delay before probing an endpoint that could not be dialed.  Defaults to EXTERN_DIAL_BACKOFF_MIN
+	EndpointDialBackoffMin time.Duration
+	//An overridable maximum delay between probes of an endpoint.  Defaults to EXTERN_DIAL_BACKOFF_MAX
+	EndpointDialBackoffMax time.Duration
+	//An overridable idle time after which pooled connections are probed on checkout.  Defaults to EXTERN_IDLE_VALIDATION_THRESHOLD
+	EndpointIdleValidationThreshold time.Duration
+	//An overridable interval in which idle pooled connections are pinged.  Defaults to EXTERN_IDLE_PING_INTERVAL
+	EndpointIdlePingInterval time.Duration
+	//An overridable time after which a checked out connection is reported.  Defaults to EXTERN_LONG_CHECKOUT_THRESHOLD
+	//A negative threshold disables the reports
+	EndpointLongCheckoutThreshold time.Duration
+	//Consecutive failed diagnostic checks that mark an endpoint down.  Defaults to EXTERN_HEALTH_FAILURE_THRESHOLD
+	EndpointHealthFailureThreshold int
+	//Consecutive successful diagnostic checks that mark an endpoint up.  Defaults to EXTERN_HEALTH_SUCCESS_THRESHOLD
+	EndpointHealthSuccessThreshold int
+	//An overridable credential refresh interval.  Defaults to EXTERN_CREDENTIAL_REFRESH_INTERVAL
+	CredentialRefreshInterval time.Duration
+	//Consecutive failed requests that open the circuit breaker of a connection pool.  Zero disables circuit breakers
+	CircuitBreakerFailureThreshold int
+	//An overridable time an open circuit waits before probing.  Defaults to EXTERN_CIRCUIT_OPEN_TIMEOUT
+	CircuitBreakerOpenTimeout time.Duration
+	//An overridable amount of concurrent probes of a half-open circuit.  Defaults to EXTERN_CIRCUIT_HALF_OPEN_REQUESTS
+	CircuitBreakerHalfOpenRequests int
+	//An overridable amount of successful probes that close a circuit.  Defaults to EXTERN_CIRCUIT_SUCCESS_THRESHOLD
+	CircuitBreakerSuccessThreshold int
 	//An overridable read timeout.  Defaults to EXTERN_READ_TIMEOUT
 	ClientReadTimeout time.Duration
 	//An overridable write timeout.  Defaults to EXTERN_WRITE_TIMEOUT
 	ClientWriteTimeout time.Duration
+	//The time a client may wait between commands before it is disconnected.  Zero, the default, lets clients idle forever
+	ClientIdleTimeout time.Duration
 	//An overridable transaction timeout.  Defaults to EXTERN_TRANSACTION_TIMEOUT
 	ClientTransactionTimeout time.Duration
+	//An overridable amount of pipelined commands a client sends at once.  Defaults to EXTERN_MAX_IN_FLIGHT
+	ClientMaxInFlight int
+	//Overridable limits on the requests of clients.  Default to EXTERN_MAX_BULK_LENGTH, EXTERN_MAX_ARGUMENTS and
+	//EXTERN_MAX_INLINE_LENGTH
+	ClientMaxBulkLength   int
+	ClientMaxArguments    int
+	ClientMaxInlineLength int
+	//The amount of commands a client may pipeline before waiting for responses.  Zero allows any amount
+	ClientMaxPipelineDepth int
+	//An overridable amount of bytes buffered for a client before they are written.  Defaults to EXTERN_WRITE_HIGH_WATER_MARK
+	ClientWriteHighWaterMark int
+	//Limits on the output a client holds: more than ClientOutputHardLimit bytes, or more than ClientOutputSoftLimit bytes
+	//for longer than ClientOutputSoftLimitDuration, disconnects it.  Zero disables a limit
+	ClientOutputHardLimit         int64
+	ClientOutputSoftLimit         int64
+	ClientOutputSoftLimitDuration time.Duration
+	//The output all clients together may hold, before the clients holding the most are disconnected.  Zero disables it
+	ClientOutputBudget int64
+	//The most clients connected at once, and the most connected from a single IP address or unix user.  Zero, the
+	//default, disables a limit
+	MaxClients          int
+	MaxClientsPerSource int
+	//Commands per second that all clients, the clients of a single source, and all clients' write and heavy commands may
+	//send to the redis servers.  Zero, the default, disables a limit
+	RateLimit       int
+	ClientRateLimit int
+	WriteRateLimit  int
+	HeavyRateLimit  int
+	//How long a command beyond a rate limit may be delayed, before it is answered with an error instead.  Zero, the
+	//default, answers it with an error right away
+	RateLimitDelay time.Duration
+	//The priority class of the clients of Listener.  Clients of higher classes are served first when they wait for a
+	//connection, and clients of lower classes are turned away first when too many wait.  Defaults to zero
+	ClientPriority int
 	// The graphite statsd server to ping with metrics
 	GraphiteServer *string
+	//The tcp address the admin interface listens on.  Empty disables the admin interface
+	AdminAddress string
 	//Whether or not the multiplexer is active.  Used to determine when a tear-down should be occuring
 	active bool
 	//The amount of active (outbound) connections that we have
@@ -101,6 +188,14 @@ type RedisMultiplexer struct {
 	infoResponse []byte
 	// Read/Write mutex for above infoResponse slice
 	infoMutex sync.RWMutex
+	// The output held by all clients
+	outputBudget *OutputBudget
+	// The clients connected by their source
+	clientLimiter *ClientLimiter
+	// The rate limits of the clients, if any
+	rateLimiter *RateLimiter
+	// The listeners besides Listener, each with the priority class of its clients
+	listeners []priorityListener
 	// Whether to failover to another connection pool if the target connection pool is down (in multiplexing mode)
 	Failover bool
 }
@@ -115,13 +210,38 @@ func (this *RedisMultiplexer) initializeCleanup() {
 	<-c
 	//Flag ourselves as cleaning up
 	this.active = false
-	//And close our listener
-	this.Listener.Close()
+	//And close our listeners
+	this.CloseListeners()
 	//Give ourselves a bit to clean up
 	time.Sleep(time.Millisecond * 150)
 	os.Exit(0)
 }
 
+// A listener whose clients belong to a priority class other than the multiplexer's ClientPriority
+type priorityListener struct {
+	listener net.Listener
+	priority int
+}
+
+// Listens on another protocol/endpoint, whose clients belong to the given priority class
+// ex: "unix", "/tmp/myBatchSocket", -1
+func (this *RedisMultiplexer) AddListener(listenProtocol, listenEndpoint string, priority int) error {
+	listener, err := net.Listen(listenProtocol, listenEndpoint)
+	if err != nil {
+		return err
+	}
+	this.listeners = append(this.listeners, priorityListener{listener: listener, priority: priority})
+	return nil
+}
+
+// Closes all listeners of the multiplexer
+func (this *RedisMultiplexer) CloseListeners() {
+	this.Listener.Close()
+	for _, priorityListener := range this.listeners {
+		priorityListener.listener.Close()
+	}
+}
+
 // Initializes a new redis multiplexer, listening on the given protocol/endpoint, with a set connectionPool size
 // ex: "unix", "/tmp/myAwesomeSocket", 50
 func NewRedisMultiplexer(listenProtocol, listenEndpoint string, poolSize int) (newRedisMultiplexer *RedisMultiplexer, err error) {
@@ -139,19 +259,96 @@ func NewRedisMultiplexer(listenProtocol, listenEndpoint string, poolSize int) (n
 	newRedisMultiplexer.EndpointWriteTimeout = connection.EXTERN_WRITE_TIMEOUT
 	newRedisMultiplexer.EndpointReconnectInterval = connection.EXTERN_RECONNECT_INTERVAL
 	newRedisMultiplexer.EndpointDiagnosticCheckInterval = EXTERN_DIAGNOSTIC_CHECK_INTERVAL
+	newRedisMultiplexer.EndpointWaitTimeout = connection.EXTERN_POOL_WAIT_TIMEOUT
+	newRedisMultiplexer.EndpointDialBackoffMin = connection.EXTERN_DIAL_BACKOFF_MIN
+	newRedisMultiplexer.EndpointDialBackoffMax = connection.EXTERN_DIAL_BACKOFF_MAX
+	newRedisMultiplexer.EndpointIdleValidationThreshold = connection.EXTERN_IDLE_VALIDATION_THRESHOLD
+	newRedisMultiplexer.EndpointIdlePingInterval = connection.EXTERN_IDLE_PING_INTERVAL
+	newRedisMultiplexer.EndpointLongCheckoutThreshold = connection.EXTERN_LONG_CHECKOUT_THRESHOLD
+	newRedisMultiplexer.EndpointHealthFailureThreshold = connection.EXTERN_HEALTH_FAILURE_THRESHOLD
+	newRedisMultiplexer.EndpointHealthSuccessThreshold = connection.EXTERN_HEALTH_SUCCESS_THRESHOLD
+	newRedisMultiplexer.EndpointConcurrencyTolerance = connection.EXTERN_CONCURRENCY_TOLERANCE
+	newRedisMultiplexer.CredentialRefreshInterval = EXTERN_CREDENTIAL_REFRESH_INTERVAL
+	newRedisMultiplexer.CircuitBreakerOpenTimeout = connection.EXTERN_CIRCUIT_OPEN_TIMEOUT
+	newRedisMultiplexer.CircuitBreakerHalfOpenRequests = connection.EXTERN_CIRCUIT_HALF_OPEN_REQUESTS
+	newRedisMultiplexer.CircuitBreakerSuccessThreshold = connection.EXTERN_CIRCUIT_SUCCESS_THRESHOLD
 	newRedisMultiplexer.ClientReadTimeout = connection.EXTERN_READ_TIMEOUT
 	newRedisMultiplexer.ClientWriteTimeout = connection.EXTERN_WRITE_TIMEOUT
 	newRedisMultiplexer.ClientTransactionTimeout = EXTERN_TRANSACTION_TIMEOUT
+	newRedisMultiplexer.ClientMaxInFlight = EXTERN_MAX_IN_FLIGHT
+	newRedisMultiplexer.ClientWriteHighWaterMark = EXTERN_WRITE_HIGH_WATER_MARK
+	newRedisMultiplexer.ClientMaxBulkLength = EXTERN_MAX_BULK_LENGTH
+	newRedisMultiplexer.ClientMaxArguments = EXTERN_MAX_ARGUMENTS
+	newRedisMultiplexer.ClientMaxInlineLength = EXTERN_MAX_INLINE_LENGTH
 	newRedisMultiplexer.infoMutex = sync.RWMutex{}
+	newRedisMultiplexer.outputBudget = NewOutputBudget(0)
+	newRedisMultiplexer.clientLimiter = NewClientLimiter(0, 0)
 	//	Debug("Redis Multiplexer Initialized")
 	return
 }
 
 // Adds a connection to the redis multiplexer, for the given protocol and endpoint
 func (this *RedisMultiplexer) AddConnection(remoteProtocol, remoteEndpoint string) {
-	connectionCluster := connection.NewConnectionPool(remoteProtocol, remoteEndpoint, this.PoolSize,
-		this.EndpointConnectTimeout, this.EndpointReadTimeout, this.EndpointWriteTimeout, this.EndpointReconnectInterval,
-		this.AuthUser, this.AuthPassword)
+	this.AddEndpoint(&connection.Endpoint{Protocol: remoteProtocol, Address: remoteEndpoint})
+}
+
+// Adds a connection to the redis multiplexer for the given endpoint
+// Settings that are not specified by the endpoint are taken from the multiplexer
+func (this *RedisMultiplexer) AddEndpoint(endpoint *connection.Endpoint) {
+	poolEndpoint := *endpoint
+	if poolEndpoint.AuthUser == "" && poolEndpoint.AuthPassword == "" {
+		poolEndpoint.AuthUser = this.AuthUser
+		poolEndpoint.AuthPassword = this.AuthPassword
+	}
+	if poolEndpoint.PoolSize < 1 {
+		poolEndpoint.PoolSize = this.PoolSize
+	}
+	if poolEndpoint.ConnectTimeout == 0 {
+		poolEndpoint.ConnectTimeout = this.EndpointConnectTimeout
+	}
+	if poolEndpoint.ReadTimeout == 0 {
+		poolEndpoint.ReadTimeout = this.EndpointReadTimeout
+	}
+	if poolEndpoint.WriteTimeout == 0 {
+		poolEndpoint.WriteTimeout = this.EndpointWriteTimeout
+	}
+	if poolEndpoint.ReconnectInterval == 0 {
+		poolEndpoint.ReconnectInterval = this.EndpointReconnectInterval
+	}
+	if poolEndpoint.ReconnectJitter == 0 {
+		poolEndpoint.ReconnectJitter = this.EndpointReconnectJitter
+	}
+	if poolEndpoint.MinIdle == 0 {
+		poolEndpoint.MinIdle = this.EndpointMinIdle
+	}
+	if poolEndpoint.HealthCheckInterval == 0 {
+		poolEndpoint.HealthCheckInterval = this.EndpointDiagnosticCheckInterval
+	}
+	if poolEndpoint.HealthCheckTimeout == 0 {
+		poolEndpoint.HealthCheckTimeout = this.EndpointDiagnosticCheckTimeout
+	}
+
+	connectionCluster := connection.NewEndpointConnectionPool(&poolEndpoint)
+	connectionCluster.MaxIdleTime = this.EndpointMaxIdleTime
+	connectionCluster.WaitTimeout = this.EndpointWaitTimeout
+	connectionCluster.MaxWaiters = this.EndpointMaxWaiters
+	connectionCluster.SharedConnections = this.EndpointSharedConnections
+	connectionCluster.DialBackoffMin = this.EndpointDialBackoffMin
+	connectionCluster.DialBackoffMax = this.EndpointDialBackoffMax
+	connectionCluster.IdleValidationThreshold = this.EndpointIdleValidationThreshold
+	connectionCluster.IdlePingInterval = this.EndpointIdlePingInterval
+	connectionCluster.LongCheckoutThreshold = this.EndpointLongCheckoutThreshold
+	connectionCluster.HealthFailureThreshold = this.EndpointHealthFailureThreshold
+	connectionCluster.HealthSuccessThreshold = this.EndpointHealthSuccessThreshold
+	if this.CircuitBreakerFailureThreshold > 0 {
+		connectionCluster.CircuitBreaker = connection.NewCircuitBreaker(poolEndpoint.String(),
+			this.CircuitBreakerFailureThreshold, this.CircuitBreakerOpenTimeout, this.CircuitBreakerHalfOpenRequests,
+			this.CircuitBreakerSuccessThreshold)
+	}
+	if this.EndpointConcurrencyMinLimit > 0 {
+		connectionCluster.ConcurrencyLimiter = connection.NewConcurrencyLimiter(poolEndpoint.String(),
+			this.EndpointConcurrencyMinLimit, poolEndpoint.PoolSize, this.EndpointConcurrencyTolerance)
+	}
 	this.ConnectionCluster = append(this.ConnectionCluster, connectionCluster)
 	if len(this.ConnectionCluster) == 1 {
 		this.PrimaryConnectionPool = connectionCluster
@@ -160,38 +357,108 @@ func (this *RedisMultiplexer) AddConnection(remoteProtocol, remoteEndpoint strin
 	}
 }
 
-// Counts the number of active endpoints (connection pools) on the server
+// Checks all endpoints (connection pools) of the server once, and counts the number of active ones
+// The pools are checked concurrently, so that a hung server does not delay the checks of the others
 func (this *RedisMultiplexer) countActiveConnections() (activeConnections int) {
-	activeConnections = 0
+	var waitGroup sync.WaitGroup
 	for _, connectionPool := range this.ConnectionCluster {
-		if connectionPool.CheckConnectionState() {
-			activeConnections++
-		}
+		waitGroup.Add(1)
+		go func(connectionPool *connection.ConnectionPool) {
+			defer waitGroup.Done()
+			connectionPool.CheckConnectionState()
+		}(connectionPool)
 	}
+	waitGroup.Wait()
 
+	activeConnections = this.countConnectedPools()
 	if this.activeConnectionCount < activeConnections {
 		log.Info("Connected diagnostics connection.")
 	}
 	return
 }
 
-// Checks the status of all connections, and calculates how many of them are currently up
+// Counts the number of endpoints (connection pools) that are currently up, without checking them
+func (this *RedisMultiplexer) countConnectedPools() (activeConnections int) {
+	for _, connectionPool := range this.ConnectionCluster {
+		if connectionPool.IsConnected() {
+			activeConnections++
+		}
+	}
+	return
+}
+
+// Calculates how many connection pools are currently up, and keeps the multiplex info and the pool gauges current
+// The pools are checked by their own health check loops; this only counts their states
 // This only counts connection pools / diagnostic connections not real redis sessions
 func (this *RedisMultiplexer) maintainConnectionStates() {
 	var m runtime.MemStats
 	for this.active {
-		this.activeConnectionCount = this.countActiveConnections()
+		activeConnections := this.countConnectedPools()
+		if this.activeConnectionCount < activeConnections {
+			log.Info("Connected diagnostics connection.")
+		}
+		this.activeConnectionCount = activeConnections
 		//		// Debug("We have %d connections", this.connectionCount)
 		runtime.ReadMemStats(&m)
 		//		// Debug("Memory profile: InUse(%d) Idle (%d) Released(%d)", m.HeapInuse, m.HeapIdle, m.HeapReleased)
 		this.generateMultiplexInfo()
+		if graphite.Enabled() {
+			for _, connectionPool := range this.ConnectionCluster {
+				connectionPool.ReportGraphite()
+			}
+		}
 		time.Sleep(this.EndpointDiagnosticCheckInterval)
 	}
 }
 
+// Whether or not the multiplexer is still active
+func (this *RedisMultiplexer) isActive() bool {
+	return this.active
+}
+
+// Periodically re-reads the credentials of all connection pools, so that rotated secrets are picked up
+func (this *RedisMultiplexer) maintainCredentials() {
+	for this.active {
+		time.Sleep(this.CredentialRefreshInterval)
+		for _, connectionPool := range this.ConnectionCluster {
+			connectionPool.RefreshCredentials()
+		}
+	}
+}
+
+// Periodically reports connections that have been checked out for too long
+func (this *RedisMultiplexer) maintainCheckouts() {
+	for this.active {
+		time.Sleep(EXTERN_CHECKOUT_CHECK_INTERVAL)
+		for _, connectionPool := range this.ConnectionCluster {
+			connectionPool.CheckLongCheckouts()
+		}
+	}
+}
+
+// Periodically disconnects clients that have been over their soft output limit for too long
+func (this *RedisMultiplexer) maintainOutputs() {
+	for this.active {
+		time.Sleep(EXTERN_OUTPUT_CHECK_INTERVAL)
+		this.outputBudget.CheckSoftLimits()
+	}
+}
+
+// Periodically drops the rate limits of sources that have no clients anymore
+func (this *RedisMultiplexer) maintainRateLimits() {
+	for this.active {
+		time.Sleep(EXTERN_RATE_LIMIT_PURGE_INTERVAL)
+		this.rateLimiter.purge()
+	}
+}
+
 // Generates the Info response for a multiplexed server
 func (this *RedisMultiplexer) generateMultiplexInfo() {
-	tmpSlice := fmt.Sprintf("rmux_version: %s\r\ngo_version: %s\r\nprocess_id: %d\r\nconnected_clients: %d\r\nactive_endpoints: %d\r\ntotal_endpoints: %d\r\nrole: master\r\n", version, runtime.Version(), os.Getpid(), this.connectionCount, this.activeConnectionCount, len(this.ConnectionCluster))
+	waitingClients := 0
+	for _, connectionPool := range this.ConnectionCluster {
+		waitingClients += connectionPool.Waiting()
+	}
+	tmpSlice := fmt.Sprintf("rmux_version: %s\r\ngo_version: %s\r\nprocess_id: %d\r\nconnected_clients: %d\r\nrejected_connections: %d\r\nwaiting_clients: %d\r\nactive_endpoints: %d\r\ntotal_endpoints: %d\r\nrole: master\r\n", version, runtime.Version(), os.Getpid(), this.connectionCount, this.clientLimiter.Rejected(), waitingClients, this.activeConnectionCount, len(this.ConnectionCluster))
 	this.infoMutex.Lock()
 	this.infoResponse = []byte(fmt.Sprintf("$%d\r\n%s", len(tmpSlice), tmpSlice))
 	this.infoMutex.Unlock()
@@ -204,14 +471,43 @@ func (this *RedisMultiplexer) Start() (err error) {
 		return err
 	}
 
+	this.activeConnectionCount = this.countActiveConnections()
+	for _, connectionPool := range this.ConnectionCluster {
+		go connectionPool.MaintainConnectionState(this.isActive)
+		go connectionPool.MaintainIdleConnections(this.isActive)
+	}
 	go this.maintainConnectionStates()
+	go this.maintainCredentials()
+	go this.maintainCheckouts()
+	this.outputBudget.Limit = this.ClientOutputBudget
+	go this.maintainOutputs()
+	this.clientLimiter.MaxClients = this.MaxClients
+	this.clientLimiter.MaxClientsPerSource = this.MaxClientsPerSource
+	if this.RateLimit > 0 || this.ClientRateLimit > 0 || this.WriteRateLimit > 0 || this.HeavyRateLimit > 0 {
+		this.rateLimiter = NewRateLimiter(this.RateLimit, this.ClientRateLimit, this.WriteRateLimit, this.HeavyRateLimit,
+			this.RateLimitDelay)
+		go this.maintainRateLimits()
+	}
 	go this.initializeCleanup()
+	if this.AdminAddress != "" {
+		go this.ServeAdmin(this.AdminAddress)
+	}
 	//if graphite.Enabled() {
 	//	go this.GraphiteCheckin()
 	//}
 
+	for _, priorityListener := range this.listeners {
+		go this.acceptClients(priorityListener.listener, priorityListener.priority)
+	}
+	this.acceptClients(this.Listener, this.ClientPriority)
+	time.Sleep(100 * time.Millisecond)
+	return
+}
+
+// Accepts clients of the given priority class from a listener, while the multiplexer is active
+func (this *RedisMultiplexer) acceptClients(listener net.Listener, priority int) {
 	for this.active {
-		fd, err := this.Listener.Accept()
+		fd, err := listener.Accept()
 		if err != nil {
 			//			Debug("Start: Error received from listener.Accept: %s", err.Error())
 			continue
@@ -219,20 +515,58 @@ func (this *RedisMultiplexer) Start() (err error) {
 		//		Debug("Accepted connection.")
 		graphite.Increment("accepted")
 
-		go this.initializeClient(fd, this.ClientTransactionTimeout)
+		this.acceptClient(fd, priority)
 	}
-	time.Sleep(100 * time.Millisecond)
-	return
+}
+
+// Hands an accepted connection off to be handled as a client, unless that exceeds the limits on clients
+func (this *RedisMultiplexer) acceptClient(localConnection net.Conn, priority int) {
+	source := connectionSource(localConnection)
+	if reason := this.clientLimiter.Admit(source); reason != "" {
+		rejectClient(localConnection, reason, this.ClientWriteTimeout)
+		return
+	}
+
+	go func() {
+		defer this.clientLimiter.Release(source)
+		this.initializeClient(localConnection, source, priority, this.ClientTransactionTimeout)
+	}()
 }
 
 // Initializes a client's connection to our server.  Sets up our disconnect hooks and then passes the client off for request handling
-func (this *RedisMultiplexer) initializeClient(localConnection net.Conn, transactionTimeout time.Duration) {
+func (this *RedisMultiplexer) initializeClient(localConnection net.Conn, source string, priority int, transactionTimeout time.Duration) {
 	defer func() {
 		atomic.AddInt32(&this.connectionCount, -1)
 	}()
 	atomic.AddInt32(&this.connectionCount, 1)
 	//Add the connection to our internal list
 	myClient := NewClient(localConnection, this.multiplexing, this.HashRing, transactionTimeout)
+	myClient.MaxInFlight = this.ClientMaxInFlight
+	myClient.ReadTimeout = this.ClientReadTimeout
+	myClient.IdleTimeout = this.ClientIdleTimeout
+	myClient.WriteTimeout = this.ClientWriteTimeout
+	myClient.Writer.HighWaterMark = this.ClientWriteHighWaterMark
+	myClient.Scanner.SetLimits(protocol.ScanLimits{
+		MaxBulkLength:  this.ClientMaxBulkLength,
+		MaxArrayLength: this.ClientMaxArguments,
+		MaxLineLength:  this.ClientMaxInlineLength,
+	})
+	myClient.MaxPipelineDepth = this.ClientMaxPipelineDepth
+	myClient.OutputLimits = OutputLimits{
+		HardLimit:         this.ClientOutputHardLimit,
+		SoftLimit:         this.ClientOutputSoftLimit,
+		SoftLimitDuration: this.ClientOutputSoftLimitDuration,
+	}
+	myClient.OutputBudget = this.outputBudget
+	this.outputBudget.register(myClient)
+	defer this.outputBudget.unregister(myClient)
+	myClient.Source = source
+	myClient.Priority = priority
+	if this.rateLimiter != nil {
+		myClient.RateLimiter = this.rateLimiter
+		myClient.joinRateLimit()
+		defer myClient.leaveRateLimit()
+	}
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -273,60 +607,71 @@ func (this *RedisMultiplexer) GraphiteCheckin() {
 }
 
 // Handles requests for a client.
-// Inspects all incoming commands, to find if they are key-driven or not.
+// Reads commands directly from the client connection, and inspects them to find if they are key-driven or not.
 // If they are, finds the appropriate connection pool, and passes the request off to it.
+// Commands the client pipelined are queued until everything it sent so far has been read, and then sent upstream
+// together.  Nothing more is read from the client until the responses were written, so a client that pipelines faster
+// than the redis servers answer is slowed down by its own connection instead of piling up commands in memory.
 func (this *RedisMultiplexer) HandleClientRequests(client *Client) {
-	// Create background i/o thread
-	go client.ReadLoop(this)
-
 	defer func() {
 		//		Debug("Client command handling loop closing")
 		// If the multiplexer goes down, deactivate this client.
 		client.Active = false
+		client.Scanner.Free()
+		// The client is disconnected once it is not handled anymore
+		client.abortTransaction()
 	}()
 
+	// Commands reference the scanner's memory until they were written upstream, see resetQueued
+	client.Scanner.RetainTokens()
+	// The amount of commands read since the client last waited for responses
+	depth := 0
 	for this.active && client.Active {
-		select {
-		case item := <-client.ReadChannel:
-			if item.command != nil {
-				this.HandleCommandChunk(client, item.command)
-			}
-			if item.err != nil {
-				this.HandleError(client, item.err)
+		if !client.Scanner.Scan() {
+			err := client.Scanner.Err()
+			if err == nil {
+				err = io.EOF
+			} else if protocol.IsLimitError(err) {
+				graphite.Increment("request_limit_exceeded")
 			}
-		case <-time.After(time.Second * 1):
-			// Allow heartbeat checks to happen once a second
+			this.HandleError(client, err)
+			// Nothing more can be read from a client whose stream failed
+			client.Active = false
+			return
 		}
-	}
-
-	// TODO defer closing stuff?
-}
 
-// This looks a lot like HandleClientRequests above, but will break and flush to redis if there is nothing to read.
-// Will allow it to handle a pipeline of commands without spinning indefinitely.
-func (this *RedisMultiplexer) HandleCommandChunk(client *Client, command protocol.Command) {
-	this.HandleCommand(client, command)
+		command, err := protocol.ParseCommandInPlace(client.Scanner.Bytes())
+		if depth++; client.MaxPipelineDepth > 0 && depth > client.MaxPipelineDepth {
+			// The command is answered with an error instead
+			graphite.Increment("pipeline_too_deep")
+			command, err = nil, protocol.ERR_PIPELINE_TOO_DEEP
+		}
+		if command != nil {
+			this.HandleCommand(client, command)
+		}
+		if err != nil {
+			this.HandleError(client, err)
+		}
+		if !client.HasQueued() {
+			// Nothing references what was scanned anymore
+			client.Scanner.Release()
+		}
 
-ChunkLoop:
-	for this.active && client.Active {
-		select {
-		case item := <-client.ReadChannel:
-			if item.command != nil {
-				this.HandleCommand(client, item.command)
-			}
-			if item.err != nil {
-				this.HandleError(client, item.err)
-			}
-		default:
-			break ChunkLoop
+		if !client.Scanner.Ready() {
+			// Everything the client sent so far has been handled, so respond before waiting for more
+			client.FlushRedisAndRespond()
+			depth = 0
 		}
+		this.HandleError(client, client.takeError())
 	}
-
-	client.FlushRedisAndRespond()
 }
 
 func (this *RedisMultiplexer) HandleCommand(client *Client, command protocol.Command) {
 	if this.multiplexing && bytes.Equal(command.GetCommand(), protocol.INFO_COMMAND) {
+		// Respond with anything we have queued
+		if client.HasQueued() {
+			client.FlushRedisAndRespond()
+		}
 		this.sendMultiplexInfo(client)
 		return
 	}
@@ -347,9 +692,14 @@ func (this *RedisMultiplexer) HandleCommand(client *Client, command protocol.Com
 
 		return
 	} else if err != nil {
+		// Respond with anything we have queued, so that the responses stay in the order of the commands
+		if client.HasQueued() {
+			client.FlushRedisAndRespond()
+		}
+
 		if err == ERR_QUIT {
 			client.WriteLine(protocol.OK_RESPONSE)
-			client.ReadChannel <- readItem{nil, err}
+			client.fail(err)
 			return
 		} else if recErr, ok := err.(*protocol.RecoverableError); ok {
 			client.WriteError(recErr, false)
@@ -363,8 +713,8 @@ func (this *RedisMultiplexer) HandleCommand(client *Client, command protocol.Com
 	// Otherwise, the command is ready to buffer to the connection.
 	client.Queue(command)
 
-	// If we're multiplexing, just handle one command at a time
-	if this.multiplexing && client.HasQueued() {
+	// Bound the amount of commands that are in flight at once
+	if client.QueueFull() {
 		client.FlushRedisAndRespond()
 	}
 }
@@ -377,9 +727,16 @@ func (this *RedisMultiplexer) HandleError(client *Client, err error) {
 	if err == ERR_QUIT {
 		client.Active = false
 		return
+	} else if err == ERR_OUTPUT_LIMIT {
+		// The client's connection was closed already
+		client.Active = false
+		return
 	} else if recErr, ok := err.(*protocol.RecoverableError); ok {
-		// Since we can recover, flush an error to the client
+		// Since we can recover, flush an error to the client, after the responses of the commands before it
 		log.Error("Error from server: %s", recErr)
+		if client.HasQueued() {
+			client.FlushRedisAndRespond()
+		}
 		client.FlushError(recErr)
 		return
 	} else if err == io.EOF {
@@ -388,7 +745,7 @@ func (this *RedisMultiplexer) HandleError(client *Client, err error) {
 		client.Active = false
 		return
 	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-		// We had a read timeout. Disconnect the client to ensure a known state.
+		// We had a read or write timeout. Disconnect the client to ensure a known state.
 		graphite.Increment("nettimeout")
 		client.Active = false
 		return
@@ -27,7 +27,12 @@ package rmux
 
 import (
 	"bufio"
+	"bytes"
 	"net"
+	"os"
+	"rmux/connection"
+	"rmux/protocol"
+	"runtime"
 	"testing"
 	"time"
 )
@@ -189,3 +194,249 @@ func TestCountActiveConnections_AllResponses(t *testing.T) {
 		t.Errorf("Server's connection count is wrong: %d instead of 1", connectionCount)
 	}
 }
+
+// Creates a multiplexer with a single connection pool, whose server answers every command with its first argument
+func newBenchmarkServer(b testing.TB) (*RedisMultiplexer, func()) {
+	os.Remove("/tmp/rmuxBench.sock")
+	server, err := NewRedisMultiplexer("unix", "/tmp/rmuxBench.sock", 8)
+	if err != nil {
+		b.Fatalf("Error creating multiplexer: %s", err)
+	}
+	upstream := startKeyEchoServer(b, "/tmp/rmuxBenchRedis.sock", "redis", 0)
+	server.AddConnection("unix", "/tmp/rmuxBenchRedis.sock")
+	server.PrimaryConnectionPool.SetIsConnected(true)
+	if server.HashRing, err = connection.NewHashRing(server.ConnectionCluster, false); err != nil {
+		b.Fatalf("Failed to create the hash ring: %s", err)
+	}
+
+	return server, func() {
+		server.Listener.Close()
+		upstream.Close()
+	}
+}
+
+// Connects a client to the multiplexer over an in-memory pipe, and returns the other end of the pipe
+func connectBenchmarkClient(server *RedisMultiplexer) net.Conn {
+	local, remote := net.Pipe()
+	go server.HandleClientRequests(NewClient(local, server.multiplexing, server.HashRing, time.Second))
+	return remote
+}
+
+func TestHandleClientRequests_Pipelined(t *testing.T) {
+	server, stop := newBenchmarkServer(t)
+	defer stop()
+	remote := connectBenchmarkClient(server)
+	defer remote.Close()
+
+	// Immediate responses stay in order with the responses of the redis server
+	go remote.Write([]byte("*2\r\n$3\r\nget\r\n$1\r\na\r\n*1\r\n$4\r\nping\r\n*2\r\n$3\r\nget\r\n$1\r\nb\r\n*1\r\n$4\r\nquit\r\n"))
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(remote)
+	for _, expected := range []string{"+redis:a\r\n", "+PONG\r\n", "+redis:b\r\n", "+OK\r\n"} {
+		if line, err := reader.ReadString('\n'); err != nil || line != expected {
+			t.Fatalf("Expected %q, got %q: %v", expected, line, err)
+		}
+	}
+}
+
+func TestHandleClientRequests_Limits(t *testing.T) {
+	server, stop := newBenchmarkServer(t)
+	defer stop()
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	client := NewClient(local, server.multiplexing, server.HashRing, time.Second)
+	client.Scanner.SetLimits(protocol.ScanLimits{MaxBulkLength: 10})
+	client.MaxPipelineDepth = 2
+	done := make(chan bool)
+	go func() {
+		server.HandleClientRequests(client)
+		close(done)
+	}()
+
+	remote.SetDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(remote)
+	expectLines := func(expected ...string) {
+		for _, line := range expected {
+			if read, err := reader.ReadString('\n'); err != nil || read != line {
+				t.Fatalf("Expected %q, got %q: %v", line, read, err)
+			}
+		}
+	}
+
+	// Commands beyond the pipeline depth are answered with an error, until the client waits for responses
+	go remote.Write([]byte("*2\r\n$3\r\nget\r\n$1\r\na\r\n*2\r\n$3\r\nget\r\n$1\r\nb\r\n*2\r\n$3\r\nget\r\n$1\r\nc\r\n"))
+	expectLines("+redis:a\r\n", "+redis:b\r\n", "-ERR max pipeline depth exceeded\r\n")
+	go remote.Write([]byte("*2\r\n$3\r\nget\r\n$1\r\nd\r\n"))
+	expectLines("+redis:d\r\n")
+
+	// A bulk string beyond the limit disconnects the client
+	go remote.Write([]byte("*2\r\n$3\r\nget\r\n$11\r\n"))
+	expectLines("-ERR Protocol error: invalid bulk length\r\n")
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("The client was not disconnected")
+	}
+}
+
+func TestHandleClientRequests_QueueFull(t *testing.T) {
+	server, stop := newBenchmarkServer(t)
+	defer stop()
+	pool := server.PrimaryConnectionPool
+	pool.WaitTimeout = time.Second
+	pool.MaxWaiters = 1
+
+	for _, multiplexing := range []bool{false, true} {
+		// All connections are checked out, and another client waits for one already
+		held := make([]*connection.Connection, 0, 8)
+		for i := 0; i < 8; i++ {
+			redisConn, err := pool.GetConnection()
+			if err != nil {
+				t.Fatalf("Failed to check out a connection: %s", err)
+			}
+			held = append(held, redisConn)
+		}
+		go func() {
+			if redisConn, err := pool.GetConnection(); err == nil {
+				pool.RecycleRemoteConnection(redisConn)
+			}
+		}()
+		for pool.Waiting() != 1 {
+			time.Sleep(time.Millisecond)
+		}
+
+		local, remote := net.Pipe()
+		go server.HandleClientRequests(NewClient(local, multiplexing, server.HashRing, time.Second))
+		remote.SetDeadline(time.Now().Add(time.Second))
+		reader := bufio.NewReader(remote)
+		expectLines := func(expected ...string) {
+			for _, line := range expected {
+				if read, err := reader.ReadString('\n'); err != nil || read != line {
+					t.Fatalf("Expected %q, got %q: %v", line, read, err)
+				}
+			}
+		}
+
+		// Every pipelined command is answered with an error, and the client stays connected
+		go remote.Write([]byte("*2\r\n$3\r\nget\r\n$1\r\na\r\n*2\r\n$3\r\nget\r\n$1\r\nb\r\n"))
+		expectLines("-ERR too many clients waiting for a connection\r\n", "-ERR too many clients waiting for a connection\r\n")
+		for _, redisConn := range held {
+			pool.RecycleRemoteConnection(redisConn)
+		}
+		go remote.Write([]byte("*2\r\n$3\r\nget\r\n$1\r\nc\r\n"))
+		expectLines("+redis:c\r\n")
+		remote.Close()
+	}
+}
+
+func TestHandleClientRequests_Shed(t *testing.T) {
+	server, stop := newBenchmarkServer(t)
+	defer stop()
+	pool := server.PrimaryConnectionPool
+	pool.WaitTimeout = time.Second
+	pool.MaxWaiters = 1
+
+	held := make([]*connection.Connection, 0, 8)
+	for i := 0; i < 8; i++ {
+		redisConn, err := pool.GetConnection()
+		if err != nil {
+			t.Fatalf("Failed to check out a connection: %s", err)
+		}
+		held = append(held, redisConn)
+	}
+
+	connectClient := func(priority int) (net.Conn, *bufio.Reader) {
+		local, remote := net.Pipe()
+		client := NewClient(local, server.multiplexing, server.HashRing, time.Second)
+		client.Priority = priority
+		go server.HandleClientRequests(client)
+		remote.SetDeadline(time.Now().Add(time.Second))
+		return remote, bufio.NewReader(remote)
+	}
+	expectLine := func(reader *bufio.Reader, expected string) {
+		if line, err := reader.ReadString('\n'); err != nil || line != expected {
+			t.Fatalf("Expected %q, got %q: %v", expected, line, err)
+		}
+	}
+
+	// A batch client waits for a connection, until an urgent client takes its place
+	batch, batchReader := connectClient(-1)
+	defer batch.Close()
+	go batch.Write([]byte("*2\r\n$3\r\nget\r\n$1\r\na\r\n"))
+	for pool.Waiting() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	urgent, urgentReader := connectClient(1)
+	defer urgent.Close()
+	go urgent.Write([]byte("*2\r\n$3\r\nget\r\n$1\r\nb\r\n"))
+	expectLine(batchReader, "-ERR too many clients waiting for a connection\r\n")
+
+	// The urgent client is served, and the shed batch client is still connected
+	for _, redisConn := range held {
+		pool.RecycleRemoteConnection(redisConn)
+	}
+	expectLine(urgentReader, "+redis:b\r\n")
+	go batch.Write([]byte("*2\r\n$3\r\nget\r\n$1\r\nc\r\n"))
+	expectLine(batchReader, "+redis:c\r\n")
+}
+
+func benchmarkRequests(b *testing.B, pipelined int) {
+	server, stop := newBenchmarkServer(b)
+	defer stop()
+	remote := connectBenchmarkClient(server)
+	defer remote.Close()
+
+	request := bytes.Repeat([]byte("*2\r\n$3\r\nget\r\n$1\r\na\r\n"), pipelined)
+	reader := bufio.NewReader(remote)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := remote.Write(request); err != nil {
+			b.Fatalf("Failed to write the request: %s", err)
+		}
+		for j := 0; j < pipelined; j++ {
+			if line, err := reader.ReadString('\n'); err != nil || line != "+redis:a\r\n" {
+				b.Fatalf("Unexpected response %q: %v", line, err)
+			}
+		}
+	}
+}
+
+func BenchmarkHandleClientRequests(b *testing.B) {
+	benchmarkRequests(b, 1)
+}
+
+func BenchmarkHandleClientRequests_Pipelined(b *testing.B) {
+	benchmarkRequests(b, 16)
+}
+
+// Measures the memory held by connected clients that are waiting for their next command
+func BenchmarkIdleClients(b *testing.B) {
+	server, stop := newBenchmarkServer(b)
+	defer stop()
+
+	const clients = 1000
+	var before, after runtime.MemStats
+	var total uint64
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		remotes := make([]net.Conn, clients)
+		for j := range remotes {
+			remotes[j] = connectBenchmarkClient(server)
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		total += (after.HeapInuse + after.StackInuse) - (before.HeapInuse + before.StackInuse)
+
+		for _, remote := range remotes {
+			remote.Close()
+		}
+	}
+	b.ReportMetric(float64(total)/float64(b.N*clients), "bytes/client")
+}
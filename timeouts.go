@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package rmux
+
+import (
+	"net"
+	"rmux/graphite"
+	"time"
+)
+
+// A client is disconnected when it sends part of a command and does not send the rest within its read timeout, when it
+// does not send another command within its idle timeout, or when it does not read its responses within its write
+// timeout. Nothing is checked out to the redis servers while a client is read from, other than the connection reserved
+// for a transaction, which is given back when the client is disconnected.
+
+// Reads and writes the connection of a client with deadlines, like protocol.TimedNetReadWriter, but picks the read
+// deadline by whether the client is in the middle of sending a command
+type timedClientConnection struct {
+	client *Client
+}
+
+func (this timedClientConnection) Read(p []byte) (n int, err error) {
+	client := this.client
+	timeout, reason := client.IdleTimeout, "client_idle_timeout"
+	if len(client.Scanner.Buffered()) > 0 {
+		// The rest of a command is read
+		timeout, reason = client.ReadTimeout, "client_read_timeout"
+	}
+
+	if timeout > 0 {
+		client.Connection.SetReadDeadline(time.Now().Add(timeout))
+		defer client.Connection.SetReadDeadline(time.Time{})
+	}
+	n, err = client.Connection.Read(p)
+	if isTimeout(err) {
+		graphite.Increment(reason)
+	}
+	return
+}
+
+func (this timedClientConnection) Write(p []byte) (n int, err error) {
+	this.setWriteDeadline()
+	n, err = this.client.Connection.Write(p)
+	return n, this.writeDone(err)
+}
+
+// Writes with a single gathered write, which net.Buffers.WriteTo only does for the connection itself
+func (this timedClientConnection) WriteBuffers(buffers *net.Buffers) (n int64, err error) {
+	this.setWriteDeadline()
+	n, err = buffers.WriteTo(this.client.Connection)
+	return n, this.writeDone(err)
+}
+
+func (this timedClientConnection) setWriteDeadline() {
+	if this.client.WriteTimeout > 0 {
+		this.client.Connection.SetWriteDeadline(time.Now().Add(this.client.WriteTimeout))
+	}
+}
+
+func (this timedClientConnection) writeDone(err error) error {
+	if this.client.WriteTimeout > 0 {
+		this.client.Connection.SetWriteDeadline(time.Time{})
+	}
+	if isTimeout(err) {
+		// Which part of its responses the client received is unknown, so nothing more can be written to it
+		graphite.Increment("client_write_timeout")
+		this.client.fail(err)
+		this.client.Connection.Close()
+	}
+	return err
+}
+
+// Gives back the connection reserved for the transaction of a client that went away in the middle of it. The
+// transaction is still open on the connection, so it is disconnected.
+func (this *Client) abortTransaction() {
+	if this.reservedRedisConn == nil {
+		return
+	}
+	// The channel has room for this, it is only closed otherwise
+	this.transactionDoneChannel <- ERR_TRANSACTION_ABORTED
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
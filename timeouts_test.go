@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2015, Salesforce.com, Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without modification, are permitted provided that the
+ * following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this list of conditions and the following
+ *   disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following
+ *   disclaimer in the documentation and/or other materials provided with the distribution.
+ *
+ * * Neither the name of Salesforce.com nor the names of its contributors may be used to endorse or promote products
+ *   derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES,
+ * INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+ * WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package rmux
+
+import (
+	"bufio"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Connects a client with the given timeouts to the multiplexer over an in-memory pipe, and returns the other end of the
+// pipe along with a channel that is closed once the client is not handled anymore
+func connectTimeoutClient(server *RedisMultiplexer, read, idle, write time.Duration) (net.Conn, chan struct{}) {
+	local, remote := net.Pipe()
+	client := NewClient(local, server.multiplexing, server.HashRing, time.Second)
+	client.ReadTimeout, client.IdleTimeout, client.WriteTimeout = read, idle, write
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.HandleClientRequests(client)
+	}()
+	return remote, done
+}
+
+func expectDisconnected(t *testing.T, done chan struct{}, reason string) {
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the client to be disconnected %s", reason)
+	}
+}
+
+func TestClientTimeouts_Idle(t *testing.T) {
+	server, stop := newBenchmarkServer(t)
+	defer stop()
+
+	// The read timeout does not apply between commands
+	remote, done := connectTimeoutClient(server, 20*time.Millisecond, 0, 0)
+	defer remote.Close()
+	time.Sleep(100 * time.Millisecond)
+	go remote.Write([]byte("*2\r\n$3\r\nget\r\n$1\r\na\r\n"))
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	if line, err := bufio.NewReader(remote).ReadString('\n'); err != nil || line != "+redis:a\r\n" {
+		t.Fatalf("Expected an idle client to be answered, got %q: %v", line, err)
+	}
+
+	remote, done = connectTimeoutClient(server, 0, 20*time.Millisecond, 0)
+	defer remote.Close()
+	expectDisconnected(t, done, "after its idle timeout")
+}
+
+func TestClientTimeouts_Read(t *testing.T) {
+	server, stop := newBenchmarkServer(t)
+	defer stop()
+
+	remote, done := connectTimeoutClient(server, 20*time.Millisecond, 0, 0)
+	defer remote.Close()
+	remote.Write([]byte("*2\r\n$3\r\nget\r\n$1\r\n"))
+	expectDisconnected(t, done, "without the rest of its command")
+}
+
+func TestClientTimeouts_Write(t *testing.T) {
+	server, stop := newBenchmarkServer(t)
+	defer stop()
+
+	remote, done := connectTimeoutClient(server, 0, 0, 20*time.Millisecond)
+	defer remote.Close()
+	// The response is never read
+	remote.Write([]byte("*2\r\n$3\r\nget\r\n$1\r\na\r\n"))
+	expectDisconnected(t, done, "without reading its response")
+	if count := atomic.LoadInt32(&server.PrimaryConnectionPool.Count); count != 0 {
+		t.Errorf("Expected the redis connection to be given back, %d are checked out", count)
+	}
+}
+
+func TestClientTimeouts_Transaction(t *testing.T) {
+	server, stop := newBenchmarkServer(t)
+	defer stop()
+
+	// The transaction timeout of the client is a second
+	remote, done := connectTimeoutClient(server, 0, 20*time.Millisecond, 0)
+	defer remote.Close()
+	go remote.Write([]byte("*1\r\n$5\r\nmulti\r\n"))
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	if line, err := bufio.NewReader(remote).ReadString('\n'); err != nil {
+		t.Fatalf("Expected a response to MULTI, got %q: %v", line, err)
+	}
+	if atomic.LoadInt32(&server.PrimaryConnectionPool.Count) != 1 {
+		t.Fatal("Expected a redis connection to be reserved for the transaction")
+	}
+
+	expectDisconnected(t, done, "during its transaction")
+	for start := time.Now(); atomic.LoadInt32(&server.PrimaryConnectionPool.Count) != 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 500*time.Millisecond {
+			t.Fatal("Expected the reserved redis connection to be given back before the transaction timeout")
+		}
+	}
+}
@@ -26,33 +26,165 @@
 package writer
 
 import (
-	"bytes"
 	"io"
+	"net"
+	"sync"
 )
 
 const (
-	defaultFlexibleWriterSize = 64
+	// The size of the pooled blocks that small writes are gathered in
+	BLOCK_SIZE = 4096
+	// Chunks smaller than this are copied into a block rather than written from where they are
+	minChunkSize = 512
+	// The size of the block of every writer that the first small writes after a flush are gathered in, so that small
+	// responses are written without taking a block from the pool
+	inlineBlockSize = 512
 )
 
+// Blocks are shared by all writers, and only held while data waits in them to be flushed
+var blockPool = sync.Pool{
+	New: func() interface{} {
+		block := make([]byte, 0, BLOCK_SIZE)
+		return &block
+	},
+}
+
+// Buffers what is written to it until it is flushed, and then writes it with a single gathered write (writev, for
+// network connections). Small writes are copied into a small block of the writer's own, and into pooled blocks once
+// that is full, while chunks that are already framed, such as whole responses, are written from where they are.
 type FlexibleWriter struct {
-	*bytes.Buffer
 	writer io.Writer
+	// Everything to write on the next flush before the tail, in order, and the same chunks as they are consumed by a
+	// gathered write
+	chunks, writing net.Buffers
+	// The block small writes are appended to, which is written after the chunks, or nil. Once everything was flushed,
+	// small writes are gathered in the writer's own block again
+	tail []byte
+	// The pooled blocks among the chunks and the tail
+	blocks []*[]byte
+	// The writer's own block, which is the tail after every flush
+	inline [inlineBlockSize]byte
+	// The amount of bytes in chunks and the tail
+	buffered int
+
+	// Once this many bytes are buffered, a write flushes them. Zero or less only flushes when asked to.
+	HighWaterMark int
+}
+
+// Implemented by writers that write net.Buffers with a single gathered write of their own, for writers that wrap a
+// network connection and would otherwise be written chunk by chunk by net.Buffers.WriteTo
+type BuffersWriter interface {
+	WriteBuffers(buffers *net.Buffers) (int64, error)
 }
 
 func NewFlexibleWriter(writer io.Writer) *FlexibleWriter {
 	w := &FlexibleWriter{}
 	w.writer = writer
-	buf := make([]byte, 0, defaultFlexibleWriterSize)
-	w.Buffer = bytes.NewBuffer(buf)
+	w.tail = w.inline[:0]
 	return w
 }
 
+// Copies p to be written on the next flush
+func (this *FlexibleWriter) Write(p []byte) (int, error) {
+	// A high water mark of zero or less wraps around to the largest unsigned value, so that it is never reached
+	if length := len(this.tail); len(p) <= cap(this.tail)-length &&
+		uint(this.buffered+len(p)) <= uint(this.HighWaterMark-1) {
+		// Fits in the tail without reaching the high water mark, which is what most small responses do. Reslicing the
+		// tail, rather than appending to it, only updates its length
+		this.tail = this.tail[:length+len(p)]
+		this.buffered += copy(this.tail[length:], p)
+		return len(p), nil
+	}
+	return this.write(p)
+}
+
+// Copies p like Write, into as many blocks as it takes
+func (this *FlexibleWriter) write(p []byte) (n int, err error) {
+	n = len(p)
+	for len(p) > 0 {
+		if len(this.tail) == cap(this.tail) {
+			this.endTail()
+			block := blockPool.Get().(*[]byte)
+			this.blocks = append(this.blocks, block)
+			this.tail = (*block)[:0]
+		}
+
+		copied := copy(this.tail[len(this.tail):cap(this.tail)], p)
+		this.tail = this.tail[:len(this.tail)+copied]
+		this.buffered += copied
+		p = p[copied:]
+	}
+
+	return n, this.checkHighWaterMark()
+}
+
+// Queues p to be written on the next flush without copying it. p must not be modified until then.
+func (this *FlexibleWriter) WriteChunk(p []byte) (err error) {
+	if len(p) < minChunkSize {
+		_, err = this.Write(p)
+		return err
+	}
+
+	this.endTail()
+	this.chunks = append(this.chunks, p)
+	this.buffered += len(p)
+	return this.checkHighWaterMark()
+}
+
+// Moves the tail to the chunks, so that whatever is written next comes after it
+func (this *FlexibleWriter) endTail() {
+	if len(this.tail) > 0 {
+		this.chunks = append(this.chunks, this.tail)
+	}
+	this.tail = nil
+}
+
+func (this *FlexibleWriter) checkHighWaterMark() error {
+	if this.HighWaterMark > 0 && this.buffered >= this.HighWaterMark {
+		return this.Flush()
+	}
+	return nil
+}
+
+// Writes everything that was buffered. Whatever could not be written is dropped along with the error, since the
+// underlying writer is broken at that point.
 func (this *FlexibleWriter) Flush() (err error) {
-	_, err = this.Buffer.WriteTo(this.writer)
+	if this.buffered == 0 {
+		return nil
+	}
+
+	if len(this.chunks) == 0 {
+		_, err = this.writer.Write(this.tail)
+	} else {
+		this.endTail()
+		if len(this.chunks) == 1 {
+			_, err = this.writer.Write(this.chunks[0])
+		} else {
+			this.writing = this.chunks
+			if buffersWriter, ok := this.writer.(BuffersWriter); ok {
+				_, err = buffersWriter.WriteBuffers(&this.writing)
+			} else {
+				_, err = this.writing.WriteTo(this.writer)
+			}
+			this.writing = nil
+		}
+	}
+
+	for i := range this.chunks {
+		this.chunks[i] = nil
+	}
+	this.chunks = this.chunks[:0]
+	for i, block := range this.blocks {
+		blockPool.Put(block)
+		this.blocks[i] = nil
+	}
+	this.blocks = this.blocks[:0]
+	this.tail = this.inline[:0]
+	this.buffered = 0
 
 	return
 }
 
 func (this *FlexibleWriter) Buffered() int {
-	return this.Len()
+	return this.buffered
 }
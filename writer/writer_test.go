@@ -27,6 +27,8 @@ package writer
 
 import (
 	"bytes"
+	"io"
+	"net"
 	"strings"
 	"testing"
 )
@@ -76,3 +78,177 @@ func TestFlexibleWriter_HugeWrite(t *testing.T) {
 		t.Error("Should have flushed after call to Flush()")
 	}
 }
+
+func TestFlexibleWriter_WriteChunk(t *testing.T) {
+	b := new(bytes.Buffer)
+	fw := NewFlexibleWriter(b)
+
+	// Interleave copied writes with chunks, across several blocks
+	var expected bytes.Buffer
+	chunk := bytes.Repeat([]byte("c"), 1000)
+	for i := 0; i < 20; i++ {
+		line := []byte(strings.Repeat(string(rune('a'+i)), 300*i))
+		fw.Write(line)
+		fw.WriteChunk(chunk)
+		expected.Write(line)
+		expected.Write(chunk)
+	}
+
+	if fw.Buffered() != expected.Len() {
+		t.Errorf("Expected %d bytes to be buffered, got %d", expected.Len(), fw.Buffered())
+	} else if b.Len() != 0 {
+		t.Error("Should have not flushed on a write.")
+	}
+
+	if err := fw.Flush(); err != nil {
+		t.Fatalf("fw.Flush errored: %s", err)
+	}
+	if !bytes.Equal(expected.Bytes(), b.Bytes()) {
+		t.Error("The writes were not flushed in order")
+	}
+	if fw.Buffered() != 0 {
+		t.Errorf("Expected nothing to be buffered after a flush, got %d", fw.Buffered())
+	}
+}
+
+func TestFlexibleWriter_HighWaterMark(t *testing.T) {
+	b := new(bytes.Buffer)
+	fw := NewFlexibleWriter(b)
+	fw.HighWaterMark = 10000
+
+	fw.Write(bytes.Repeat([]byte("a"), 6000))
+	if b.Len() != 0 {
+		t.Fatal("Should have not flushed below the high water mark")
+	}
+
+	fw.WriteChunk(bytes.Repeat([]byte("b"), 6000))
+	if b.Len() != 12000 || fw.Buffered() != 0 {
+		t.Fatalf("Should have flushed at the high water mark, flushed %d bytes", b.Len())
+	}
+
+	// Small writes reach the high water mark as well
+	fw.HighWaterMark = 100
+	for i := 0; i < 3; i++ {
+		fw.Write(bytes.Repeat([]byte("c"), 30))
+	}
+	if b.Len() != 12000 {
+		t.Fatal("Should have not flushed small writes below the high water mark")
+	}
+	fw.Write(bytes.Repeat([]byte("d"), 10))
+	if b.Len() != 12100 || fw.Buffered() != 0 {
+		t.Fatalf("Should have flushed small writes at the high water mark, flushed %d bytes", b.Len())
+	}
+}
+
+// Records how buffers were written
+type buffersRecorder struct {
+	bytes.Buffer
+	gathered int
+}
+
+func (this *buffersRecorder) WriteBuffers(buffers *net.Buffers) (int64, error) {
+	this.gathered++
+	return buffers.WriteTo(&this.Buffer)
+}
+
+func TestFlexibleWriter_BuffersWriter(t *testing.T) {
+	b := new(buffersRecorder)
+	fw := NewFlexibleWriter(b)
+
+	fw.Write([]byte("+OK\r\n"))
+	fw.WriteChunk(bytes.Repeat([]byte("a"), 1000))
+	if err := fw.Flush(); err != nil {
+		t.Fatalf("fw.Flush errored: %s", err)
+	}
+	if b.gathered != 1 || b.Len() != 1005 {
+		t.Errorf("Expected a single gathered write of 1005 bytes, got %d writes of %d bytes", b.gathered, b.Len())
+	}
+}
+
+// Writes a pipeline's worth of small responses and flushes them, as a client's writer does
+func BenchmarkFlexibleWriter_SmallResponses(b *testing.B) {
+	fw := NewFlexibleWriter(io.Discard)
+	response := []byte("$10\r\n0123456789\r\n")
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 16; j++ {
+			fw.Write(response)
+		}
+		fw.Flush()
+	}
+}
+
+// Writes large responses to a socket, each from a buffer of its own
+func BenchmarkFlexibleWriter_LargeResponses(b *testing.B) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	fw := NewFlexibleWriter(conn)
+	responses := make([][]byte, 8)
+	for i := range responses {
+		responses[i] = bytes.Repeat([]byte("x"), 32*1024)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(responses) * 32 * 1024))
+	for i := 0; i < b.N; i++ {
+		for _, response := range responses {
+			fw.Write(response)
+		}
+		if err := fw.Flush(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Writes the same responses as chunks, which are not copied
+func BenchmarkFlexibleWriter_LargeChunks(b *testing.B) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	fw := NewFlexibleWriter(conn)
+	responses := make([][]byte, 8)
+	for i := range responses {
+		responses[i] = bytes.Repeat([]byte("x"), 32*1024)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(responses) * 32 * 1024))
+	for i := 0; i < b.N; i++ {
+		for _, response := range responses {
+			fw.WriteChunk(response)
+		}
+		if err := fw.Flush(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}